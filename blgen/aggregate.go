@@ -0,0 +1,105 @@
+package blgen
+
+import (
+	"cmp"
+	"net/netip"
+	"slices"
+)
+
+// compareByAddr orders prefixes by their first address, then by prefix length.
+// Unlike netip.Prefix.Compare it keeps numerically adjacent networks next to
+// each other, which is what both sorting and aggregation rely on.
+func compareByAddr(a, b netip.Prefix) int {
+	if c := a.Addr().Compare(b.Addr()); c != 0 {
+		return c
+	}
+	return cmp.Compare(a.Bits(), b.Bits())
+}
+
+// lastAddr returns the highest address contained in prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Masked().Addr()
+	bytes := addr.As16()
+	hostBits := addr.BitLen() - prefix.Bits()
+	for i := len(bytes) - 1; hostBits > 0; i-- {
+		if hostBits >= 8 {
+			bytes[i] = 0xff
+			hostBits -= 8
+		} else {
+			bytes[i] |= byte(1<<hostBits) - 1
+			hostBits = 0
+		}
+	}
+
+	last := netip.AddrFrom16(bytes)
+	if addr.Is4() {
+		return last.Unmap()
+	}
+	return last
+}
+
+// aggregatePrefixes returns the minimal set of prefixes covering exactly the
+// addresses of the given prefixes, merging adjacent and overlapping networks.
+// The result is sorted by address.
+func aggregatePrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	sorted := make([]netip.Prefix, len(prefixes))
+	for i, prefix := range prefixes {
+		sorted[i] = prefix.Masked()
+	}
+	slices.SortFunc(sorted, compareByAddr)
+
+	var aggregated []netip.Prefix
+	start, end := sorted[0].Addr(), lastAddr(sorted[0])
+	for _, prefix := range sorted[1:] {
+		// An invalid next address means end is the last address of its
+		// family, so anything else of the same family overlaps it.
+		next := end.Next()
+		sameFamily := prefix.Addr().BitLen() == start.BitLen()
+		if sameFamily && (!next.IsValid() || prefix.Addr().Compare(next) <= 0) {
+			if last := lastAddr(prefix); last.Compare(end) > 0 {
+				end = last
+			}
+			continue
+		}
+		aggregated = append(aggregated, rangeToPrefixes(start, end)...)
+		start, end = prefix.Addr(), lastAddr(prefix)
+	}
+
+	return append(aggregated, rangeToPrefixes(start, end)...)
+}
+
+// rangeToPrefixes splits the inclusive address range [start, end] into the
+// fewest prefixes that cover it exactly.
+func rangeToPrefixes(start, end netip.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for {
+		// Grow the prefix for as long as it stays aligned on start and
+		// doesn't reach past end.
+		bits := start.BitLen()
+		for bits > 0 {
+			candidate := netip.PrefixFrom(start, bits-1)
+			if candidate.Masked().Addr() != start || lastAddr(candidate).Compare(end) > 0 {
+				break
+			}
+			bits--
+		}
+
+		prefix := netip.PrefixFrom(start, bits)
+		prefixes = append(prefixes, prefix)
+		last := lastAddr(prefix)
+		if last == end {
+			return prefixes
+		}
+		start = last.Next()
+	}
+}
+
+// mapV4ToV6 returns the IPv4-mapped IPv6 prefix covering the same addresses
+// as the IPv4 prefix, such as ::ffff:1.2.3.0/120 for 1.2.3.0/24.
+func mapV4ToV6(prefix netip.Prefix) netip.Prefix {
+	return netip.PrefixFrom(netip.AddrFrom16(prefix.Addr().As16()), prefix.Bits()+96)
+}
@@ -0,0 +1,89 @@
+package blgen
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// prefixes parses the networks.
+func prefixes(networks ...string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, network := range networks {
+		prefixes = append(prefixes, netip.MustParsePrefix(network))
+	}
+	return prefixes
+}
+
+func TestAggregatePrefixes(t *testing.T) {
+	tests := []struct {
+		networks []string
+		want     []string
+	}{
+		{[]string{"10.0.2.0/24", "10.0.0.0/24", "10.0.3.0/24", "10.0.1.0/24"}, []string{"10.0.0.0/22"}},
+		{[]string{"10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.1.0/24", "10.0.2.0/24"}},
+		{[]string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"}, []string{"10.0.0.0/23", "10.0.2.0/24"}},
+		{[]string{"10.0.0.0/16", "10.0.5.0/24", "10.0.0.0/16"}, []string{"10.0.0.0/16"}},
+		{[]string{"255.255.255.0/25", "255.255.255.128/25"}, []string{"255.255.255.0/24"}},
+		{[]string{"2001:db8::/33", "2001:db8:8000::/33", "10.0.0.0/24"}, []string{"10.0.0.0/24", "2001:db8::/32"}},
+		{nil, nil},
+	}
+	for _, test := range tests {
+		got := aggregatePrefixes(prefixes(test.networks...))
+		if !slices.Equal(got, prefixes(test.want...)) {
+			t.Errorf("aggregatePrefixes(%q) = %v, want %q", test.networks, got, test.want)
+		}
+	}
+}
+
+// Adjacent networks of different countries stay apart.
+func TestAggregateWithinCountries(t *testing.T) {
+	blocks := testBlocksHeader + `10.0.0.0/24,2017370,2017370,,0,0,
+10.0.1.0/24,2017370,2017370,,0,0,
+10.0.2.0/24,2017370,2017370,,0,0,
+10.0.3.0/24,2017370,2017370,,0,0,
+10.0.4.0/24,2921044,2921044,,0,0,
+10.0.5.0/24,2921044,2921044,,0,0,
+10.0.6.0/24,2017370,2017370,,0,0,
+10.0.7.0/24,2017370,2017370,,0,0,
+`
+	cfg := testConfig(t, countryArchive(t, blocks))
+	cfg.BlockedCountries = codes("RU", "DE")
+	cfg.Aggregate = true
+	result := generate(t, cfg)
+	want := []string{"10.0.0.0/22 ; RU", "10.0.6.0/23 ; RU", "10.0.4.0/23 ; DE"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMapV4ToV6(t *testing.T) {
+	tests := []struct {
+		network, want string
+	}{
+		{"1.2.3.0/24", "::ffff:1.2.3.0/120"},
+		{"2.56.10.0/23", "::ffff:2.56.10.0/119"},
+		{"8.8.8.8/32", "::ffff:8.8.8.8/128"},
+		{"0.0.0.0/0", "::ffff:0.0.0.0/96"},
+	}
+	for _, test := range tests {
+		if got := mapV4ToV6(netip.MustParsePrefix(test.network)); got != netip.MustParsePrefix(test.want) {
+			t.Errorf("mapV4ToV6(%s) = %s, want %s", test.network, got, test.want)
+		}
+	}
+
+	blocks := testBlocksHeader + `1.2.3.0/24,2017370,2017370,,0,0,
+2001:db8::/32,2017370,2017370,,0,0,
+`
+	archive := countryArchive(t, blocks)
+	for mapping, want := range map[string][]string{
+		MapV4ToV6Also:    {"1.2.3.0/24 ; RU", "::ffff:1.2.3.0/120 ; RU", "2001:db8::/32 ; RU"},
+		MapV4ToV6Instead: {"::ffff:1.2.3.0/120 ; RU", "2001:db8::/32 ; RU"},
+	} {
+		cfg := testConfig(t, archive)
+		cfg.MapV4ToV6 = mapping
+		if got := listLines(t, generate(t, cfg).OutputPath); !slices.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", mapping, got, want)
+		}
+	}
+}
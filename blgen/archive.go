@@ -0,0 +1,299 @@
+package blgen
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrDatabaseTooOld is returned by Generate when the build date of the
+// database is further back than MaxAgeDays.
+var ErrDatabaseTooOld = errors.New("database is too old")
+
+// Supported archive formats, named after the download suffix MaxMind uses.
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// archiveReader walks the files of a downloaded database archive.
+type archiveReader interface {
+	// next returns the name of the next regular file in the archive and a
+	// function opening its content, or io.EOF when there are no more files.
+	// The content is only valid until next is called again.
+	next() (string, func() (io.ReadCloser, error), error)
+	Close() error
+}
+
+func openArchive(archivePath, format string) (archiveReader, error) {
+	archiveFile, err := os.Open(archivePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s file: %w", format, err)
+	}
+	archiveInfo, err := archiveFile.Stat()
+	if err != nil {
+		archiveFile.Close()
+		return nil, fmt.Errorf("failed to open %s file: %w", format, err)
+	}
+
+	archive, err := newArchiveReader(archiveFile, archiveInfo.Size(), format)
+	if err != nil {
+		archiveFile.Close()
+		return nil, err
+	}
+	return archive, nil
+}
+
+// newArchiveReader reads an archive of the given format and size from r. The
+// archive closes r when r is an io.Closer.
+func newArchiveReader(r io.ReaderAt, size int64, format string) (archiveReader, error) {
+	closer, _ := r.(io.Closer)
+	switch format {
+	case ArchiveZip:
+		zipReader, err := zip.NewReader(r, size)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zip file: %w", err)
+		}
+		return &zipArchive{files: zipReader.File, closer: closer}, nil
+	case ArchiveTarGz:
+		gzipReader, err := gzip.NewReader(io.NewSectionReader(r, 0, size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open tar.gz file: %w", err)
+		}
+		return &tarGzArchive{closer: closer, gzipReader: gzipReader, tarReader: tar.NewReader(gzipReader)}, nil
+	}
+	return nil, fmt.Errorf("unknown archive format %q", format)
+}
+
+type zipArchive struct {
+	files  []*zip.File
+	closer io.Closer
+	index  int
+}
+
+func (a *zipArchive) next() (string, func() (io.ReadCloser, error), error) {
+	for a.index < len(a.files) {
+		file := a.files[a.index]
+		a.index++
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		return file.Name, file.Open, nil
+	}
+	return "", nil, io.EOF
+}
+
+func (a *zipArchive) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+type tarGzArchive struct {
+	closer     io.Closer
+	gzipReader *gzip.Reader
+	tarReader  *tar.Reader
+}
+
+func (a *tarGzArchive) next() (string, func() (io.ReadCloser, error), error) {
+	for {
+		header, err := a.tarReader.Next()
+		if err != nil {
+			return "", nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		return header.Name, func() (io.ReadCloser, error) {
+			return io.NopCloser(a.tarReader), nil
+		}, nil
+	}
+}
+
+func (a *tarGzArchive) Close() error {
+	a.gzipReader.Close()
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// extractAndWriteFile extracts the archive file name to extractedFilePath.
+func extractAndWriteFile(name string, open func() (io.ReadCloser, error), extractedFilePath string) error {
+	if !filepath.IsLocal(name) {
+		return fmt.Errorf("illegal file path in archive: %s", name)
+	}
+
+	fileName := filepath.Base(name)
+
+	archiveFileContent, err := open()
+	if err != nil {
+		return fmt.Errorf("failed to open file inside archive %s: %w", fileName, err)
+	}
+	defer archiveFileContent.Close()
+
+	extractedFile, err := os.Create(extractedFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", extractedFilePath, err)
+	}
+
+	_, err = io.Copy(extractedFile, archiveFileContent)
+	if err != nil {
+		extractedFile.Close()
+		return fmt.Errorf("failed to write to file %s to %s: %w", fileName, extractedFilePath, err)
+	}
+
+	if err := extractedFile.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	return nil
+}
+
+// extractArchive extracts the CSV files the list is built from into tmpDir,
+// whatever the archive format.
+func extractArchive(archivePath, tmpDir string, cfg *Config) error {
+	archive, err := openArchive(archivePath, cfg.Archive)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return extractFiles(archive, tmpDir, cfg)
+}
+
+// extractArchiveData is extractArchive for an archive held in memory.
+func extractArchiveData(data []byte, tmpDir string, cfg *Config) error {
+	archive, err := newArchiveReader(bytes.NewReader(data), int64(len(data)), cfg.Archive)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	return extractFiles(archive, tmpDir, cfg)
+}
+
+// extractFiles extracts the CSV files of the edition from the archive.
+// MaxMind's archives hold them in a single dated directory such as
+// GeoLite2-Country-CSV_20240101/, and repacked archives often hold them at
+// the root, so only files at the root or directly below one directory
+// match, and an archive with more than one candidate for a file is rejected
+// rather than extracting whichever comes last. The files are matched by the
+// patterns of the edition and extracted under their usual names. The date is
+// kept as the database's build date. With CSVDir, the files are extracted
+// there to be reused by later runs, and linked into tmpDir.
+func extractFiles(archive archiveReader, tmpDir string, cfg *Config) error {
+	destinationDir := tmpDir
+	if cfg.CSVDir != "" {
+		if err := os.MkdirAll(cfg.CSVDir, 0o755); err != nil {
+			return fmt.Errorf("failed to create CSV directory: %w", err)
+		}
+		// Until the extraction is complete, the files aren't reused.
+		if err := os.Remove(csvStampPath(cfg)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", csvStampPath(cfg), err)
+		}
+		destinationDir = cfg.CSVDir
+	}
+
+	format := cfg.Archive
+	filesToExtract := cfg.edition().csvFiles()
+	patterns := make([]string, len(filesToExtract))
+	for i, file := range filesToExtract {
+		patterns[i] = file.pattern
+	}
+	found := make(map[string]string, len(filesToExtract))
+	for {
+		name, open, err := archive.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s archive: %w", format, err)
+		}
+		index, extract := archivePathMatch(name, patterns)
+		if !extract {
+			continue
+		}
+		csvFile := filesToExtract[index].name
+		if previous, duplicate := found[csvFile]; duplicate {
+			return fmt.Errorf("%s archive contains more than one %s: %s and %s", format, csvFile, previous, name)
+		}
+		found[csvFile] = name
+
+		if err := extractAndWriteFile(name, open, filepath.Join(destinationDir, csvFile)); err != nil {
+			return err
+		}
+	}
+
+	for _, file := range filesToExtract {
+		if _, ok := found[file.name]; ok {
+			continue
+		}
+		if file.localized {
+			return fmt.Errorf("missing %s in %s archive, the database may not be translated to the %q locale", file.name, format, cfg.Locale)
+		}
+		return fmt.Errorf("missing %s in %s archive", file.pattern, format)
+	}
+
+	blocksPath := found[cfg.edition().blocksCSV()]
+	if cfg.CSVDir != "" {
+		if err := finishCSVDir(tmpDir, path.Dir(blocksPath), cfg); err != nil {
+			return err
+		}
+	}
+	cfg.databaseDate = archiveBuildDate(blocksPath)
+	return checkDatabaseAge(cfg, time.Now())
+}
+
+// archivePathMatch returns the index of the pattern the archive file name
+// matches as <pattern> or */<pattern>.
+func archivePathMatch(name string, patterns []string) (int, bool) {
+	for i, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return i, true
+		}
+		if matched, _ := path.Match("*/"+pattern, name); matched {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// archiveBuildDate returns the date of a directory name such as
+// GeoLite2-Country-CSV_20240101, or the zero time when it has none.
+func archiveBuildDate(name string) time.Time {
+	dir := path.Dir(name)
+	date, err := time.Parse("20060102", dir[strings.LastIndex(dir, "_")+1:])
+	if err != nil {
+		return time.Time{}
+	}
+	return date
+}
+
+// checkDatabaseAge fails when the database was built more than MaxAgeDays
+// before now. A database whose archive doesn't name its build date is used
+// with a warning.
+func checkDatabaseAge(cfg *Config, now time.Time) error {
+	if cfg.MaxAgeDays == 0 {
+		return nil
+	}
+	if cfg.databaseDate.IsZero() {
+		cfg.Logger.Warn("archive doesn't name the database build date, skipping the age check")
+		return nil
+	}
+	days := int(now.Sub(cfg.databaseDate).Hours() / 24)
+	if days > cfg.MaxAgeDays {
+		return fmt.Errorf("%w: built %s, %d days ago, more than the allowed %d", ErrDatabaseTooOld, cfg.databaseDate.Format(time.DateOnly), days, cfg.MaxAgeDays)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package blgen
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateFromLocalArchive(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	cfg := testConfig(t, archive)
+	cfg.HTTPClient = noHTTPClient(t)
+	result := generate(t, cfg)
+	want := []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if want := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC); !result.DatabaseDate.Equal(want) {
+		t.Errorf("database date %v, want %v from the archive directory", result.DatabaseDate, want)
+	}
+}
+
+func TestLocalArchiveSHA(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	data, err := os.ReadFile(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	tests := []struct {
+		sha   string
+		valid bool
+	}{
+		{hex.EncodeToString(sum[:]) + "  GeoLite2-Country-CSV_20260101.zip\n", true},
+		{strings.Repeat("0", 64) + "  GeoLite2-Country-CSV_20260101.zip\n", false},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.HTTPClient = noHTTPClient(t)
+		cfg.SHAPath = archive + ".sha256"
+		if err := os.WriteFile(cfg.SHAPath, []byte(test.sha), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Generate(t.Context(), cfg); (err == nil) != test.valid {
+			t.Errorf("SHA %.16s...: %v", test.sha, err)
+		}
+	}
+}
+
+// writeTarGz writes the files, in MaxMind's dated directory, to a tar.gz
+// archive and returns its path.
+func writeTarGz(t testing.TB, files map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country-CSV.tar.gz")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	archive := tar.NewWriter(gz)
+	if err := archive.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: testArchiveDir, Mode: 0o755}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range slices.Sorted(maps.Keys(files)) {
+		header := &tar.Header{Name: testArchiveDir + name, Mode: 0o644, Size: int64(len(files[name]))}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := archive.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestGenerateFromTarGz(t *testing.T) {
+	cfg := testConfig(t, writeTarGz(t, map[string]string{
+		"COPYRIGHT.txt":                     "Database and Contents Copyright (c) 2026 MaxMind, Inc.\n",
+		"GeoLite2-Country-Locations-en.csv": testLocations,
+		"GeoLite2-Country-Locations-de.csv": testLocations,
+		"GeoLite2-Country-Blocks-IPv4.csv":  testBlocks,
+	}))
+	cfg.Archive = ArchiveTarGz
+	cfg.NoHeader = true
+	fromTarGz := readFile(t, generate(t, cfg).OutputPath)
+
+	cfg = testConfig(t, countryArchive(t, testBlocks))
+	cfg.NoHeader = true
+	if fromZip := readFile(t, generate(t, cfg).OutputPath); fromTarGz != fromZip {
+		t.Errorf("the tar.gz archive gave %q, want %q as from the zip archive", fromTarGz, fromZip)
+	}
+}
+
+func TestMaxAgeDays(t *testing.T) {
+	archive := func(dir string) string {
+		return writeZip(t, map[string]string{
+			dir + "GeoLite2-Country-Locations-en.csv": testLocations,
+			dir + "GeoLite2-Country-Blocks-IPv4.csv":  testBlocks,
+		})
+	}
+	recent := time.Now().AddDate(0, 0, -3).Format("20060102")
+	tests := []struct {
+		dir   string
+		valid bool
+	}{
+		{"GeoLite2-Country-CSV_" + recent + "/", true},
+		{"GeoLite2-Country-CSV_" + time.Now().AddDate(0, 0, -45).Format("20060102") + "/", false},
+		// Without a build date the age can't be checked.
+		{"", true},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive(test.dir))
+		cfg.MaxAgeDays = 30
+		result, err := Generate(t.Context(), cfg)
+		if test.valid != (err == nil) {
+			t.Errorf("%q: got %v", test.dir, err)
+		}
+		if !test.valid && !errors.Is(err, ErrDatabaseTooOld) {
+			t.Errorf("%q: got %v, want %v", test.dir, err, ErrDatabaseTooOld)
+		}
+		if test.dir == tests[0].dir && err == nil && result.DatabaseDate.Format("20060102") != recent {
+			t.Errorf("database date %s, want %s", result.DatabaseDate, recent)
+		}
+	}
+}
+
+func TestArchivePathMatch(t *testing.T) {
+	patterns := []string{"GeoLite2-Country-Locations-en.csv", "GeoLite2-Country-Blocks-IPv4*.csv"}
+	tests := []struct {
+		name  string
+		index int
+		match bool
+	}{
+		{"GeoLite2-Country-CSV_20260101/GeoLite2-Country-Locations-en.csv", 0, true},
+		{"GeoLite2-Country-Locations-en.csv", 0, true},
+		{"GeoLite2-Country-CSV_20260101/GeoLite2-Country-Blocks-IPv4.csv", 1, true},
+		{"GeoLite2-Country-Blocks-IPv4.csv", 1, true},
+		{"a/b/GeoLite2-Country-Blocks-IPv4.csv", 0, false},
+		{"GeoLite2-Country-CSV_20260101/GeoLite2-Country-Locations-de.csv", 0, false},
+		{"GeoLite2-Country-CSV_20260101/COPYRIGHT.txt", 0, false},
+	}
+	for _, test := range tests {
+		index, match := archivePathMatch(test.name, patterns)
+		if match != test.match || match && index != test.index {
+			t.Errorf("archivePathMatch(%s) = %d, %t, want %d, %t", test.name, index, match, test.index, test.match)
+		}
+	}
+}
+
+func TestGenerateFromArchiveRoot(t *testing.T) {
+	archive := writeZip(t, map[string]string{
+		"GeoLite2-Country-Locations-en.csv": testLocations,
+		"GeoLite2-Country-Blocks-IPv4.csv":  testBlocks,
+	})
+	result := generate(t, testConfig(t, archive))
+	want := []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestGenerateRejectsDuplicateFiles(t *testing.T) {
+	archive := writeZip(t, map[string]string{
+		"GeoLite2-Country-Locations-en.csv":                 testLocations,
+		"GeoLite2-Country-Blocks-IPv4.csv":                  testBlocks,
+		testArchiveDir + "GeoLite2-Country-Blocks-IPv4.csv": testBlocks,
+	})
+	cfg := testConfig(t, archive)
+	if _, err := Generate(t.Context(), cfg); err == nil {
+		t.Error("archive with two blocks files accepted")
+	}
+}
@@ -0,0 +1,417 @@
+package blgen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Result describes a completed Generate run.
+type Result struct {
+	// OutputPath is where the list was written, or StdoutFilename when it
+	// was written to stdout or Config.Output. With several formats it is
+	// the file of the first one, and OutputPaths lists the files of all of
+	// them.
+	OutputPath         string
+	OutputPaths        []string
+	CountriesRequested int
+	GeonamesMatched    int
+	NetworksWritten    int
+	// NetworksByLabel counts the written networks by the label they were
+	// listed under, such as the country code.
+	NetworksByLabel map[string]int
+	// MalformedRows is the number of blocks file rows skipped because they
+	// couldn't be parsed, such as rows with an invalid network.
+	MalformedRows int
+	BytesWritten  int64
+	// DatabaseDate is the build date of the database the list was
+	// generated from, or the zero time when the archive doesn't name it.
+	DatabaseDate time.Time
+	Elapsed      time.Duration
+}
+
+// String formats the counts as the key=value pairs the blgen command prints
+// for -summary.
+func (r Result) String() string {
+	return fmt.Sprintf("countries=%d geonames=%d networks=%d malformed=%d bytes=%d",
+		r.CountriesRequested, r.GeonamesMatched, r.NetworksWritten, r.MalformedRows, r.BytesWritten)
+}
+
+// StageError is returned by Generate and Report when a stage of the run
+// fails. It names the stage and the file or URL the stage was working on, for
+// callers that log errors with structured fields.
+type StageError struct {
+	Stage string
+	Path  string
+	Err   error
+}
+
+func (e *StageError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StageError) Unwrap() error {
+	return e.Err
+}
+
+// runStage runs one stage of the pipeline and logs how long it took at debug
+// level. A failure is returned as a StageError.
+func (cfg *Config) runStage(stage, path string, fn func() error) error {
+	start := time.Now()
+	if err := fn(); err != nil {
+		return &StageError{Stage: stage, Path: path, Err: err}
+	}
+	cfg.Logger.Debug("stage complete", "stage", stage, "path", path, "elapsed", time.Since(start))
+	return nil
+}
+
+// logThroughput logs at debug level how many rows of the file name a stage
+// went through and how fast, to tell a slow disk from a slow CPU.
+func (cfg *Config) logThroughput(stage, name string, rows int, size int64, elapsed time.Duration) {
+	seconds := max(elapsed, time.Microsecond).Seconds()
+	cfg.Logger.Debug("throughput", "stage", stage, "path", name, "rows", rows, "bytes", size, "elapsed", elapsed,
+		"rows_per_second", int64(float64(rows)/seconds), "mb_per_second", fmt.Sprintf("%.1f", float64(size)/1e6/seconds))
+}
+
+// Generate downloads and verifies the configured GeoLite2 database, and
+// writes the list of matching networks to the configured output.
+func Generate(ctx context.Context, cfg Config) (Result, error) {
+	results, err := GenerateEditions(ctx, []Config{cfg})
+	if err != nil {
+		return Result{}, err
+	}
+	return results[0], nil
+}
+
+// GenerateEditions generates the lists of several configs in one run,
+// usually one config for each edition, each with an output of its own. The
+// databases of all of them are downloaded and verified at the same time, at
+// most DownloadConcurrency of the first config at once, before any list is
+// written. A failed download cancels the others. The results are in the
+// order of cfgs.
+func GenerateEditions(ctx context.Context, cfgs []Config) ([]Result, error) {
+	start := time.Now()
+	if len(cfgs) == 0 {
+		return nil, &StageError{Stage: "config", Err: fmt.Errorf("no config to generate a list from")}
+	}
+	cfgs = slices.Clone(cfgs)
+	runCfgs := make([]*Config, len(cfgs))
+	outputs := make(map[string]bool, len(cfgs))
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		// A list that can't be put in place fails the run before the
+		// database is downloaded for nothing.
+		if err := cfg.Prepare(); err != nil {
+			return nil, &StageError{Stage: "config", Err: err}
+		}
+		if err := checkOutputDir(cfg); err != nil {
+			return nil, &StageError{Stage: "config", Path: cfg.OutputFilePath, Err: err}
+		}
+		if cfg.Output == nil {
+			output := filepath.Join(cfg.OutputFilePath, cfg.OutputFilename)
+			if cfg.OutputFilename == StdoutFilename {
+				output = StdoutFilename
+			}
+			if outputs[output] {
+				return nil, &StageError{Stage: "config", Path: output, Err: fmt.Errorf("several lists can't be written to %s", output)}
+			}
+			outputs[output] = true
+		}
+		runCfgs[i] = cfg
+	}
+	results := make([]Result, len(cfgs))
+	err := runEditions(ctx, runCfgs, func(i int, tmpDir string) error {
+		return generateList(ctx, tmpDir, &cfgs[i], &results[i])
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	elapsed := time.Since(start)
+	for i := range results {
+		results[i].Elapsed = elapsed
+	}
+	return results, nil
+}
+
+// generateList matches the blocks of the database downloaded into tmpDir,
+// writes the list and moves it into place, filling in result.
+func generateList(ctx context.Context, tmpDir string, cfg *Config, result *Result) error {
+	result.CountriesRequested = len(cfg.BlockedCountries)
+	result.DatabaseDate = cfg.databaseDate
+	var matcher blockMatcher
+	err := cfg.runStage("match", tmpDir, func() error {
+		var err error
+		matcher, err = cfg.edition().newMatcher(ctx, tmpDir, cfg, result)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = cfg.runStage("write", filepath.Join(tmpDir, cfg.edition().blocksCSV()), func() error {
+		return getAndWriteBlocks(ctx, tmpDir, matcher, cfg, result)
+	})
+	if err != nil {
+		return err
+	}
+	if cfg.DiffAgainst != "" {
+		err := cfg.runStage("diff", cfg.DiffAgainst, func() error {
+			return writeDiff(tmpDir, cfg.OutputFilename, cfg)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// The binary database was downloaded along with the CSV one, so a
+	// failed download leaves the previous files alone.
+	if cfg.MMDBPath != "" {
+		err := cfg.runStage("move", cfg.MMDBPath, func() error {
+			return moveMMDB(tmpDir, cfg)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.OutputFilename == StdoutFilename {
+		result.OutputPath = StdoutFilename
+		result.OutputPaths = []string{StdoutFilename}
+		return nil
+	}
+	for _, format := range cfg.formats() {
+		if cfg.SplitByCountry && !cfg.SplitCombined {
+			break
+		}
+		filename := cfg.outputFilename(format)
+		if cfg.MaxLines > 0 {
+			paths, err := moveChunks(tmpDir, filename, cfg)
+			if err != nil {
+				return err
+			}
+			result.OutputPaths = append(result.OutputPaths, paths...)
+			continue
+		}
+		outputPath := filepath.Join(cfg.OutputFilePath, filename)
+		err := cfg.runStage("move", outputPath, func() error {
+			if err := moveFile(tmpDir, filename, cfg); err != nil {
+				return err
+			}
+			// The companion files follow the list, so they never
+			// describe a list that isn't in place yet.
+			for _, companion := range cfg.companionFiles(filename) {
+				if err := moveFile(tmpDir, companion, cfg); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		result.OutputPaths = append(result.OutputPaths, outputPath)
+	}
+	if cfg.SplitByCountry {
+		paths, err := moveSplitFiles(tmpDir, cfg)
+		if err != nil {
+			return err
+		}
+		result.OutputPaths = append(result.OutputPaths, paths...)
+	}
+	if len(result.OutputPaths) > 0 {
+		result.OutputPath = result.OutputPaths[0]
+	}
+	if cfg.NotifyURL != "" {
+		notify(ctx, cfg, result)
+	}
+	return nil
+}
+
+// run prepares cfg, takes the lock file and downloads the database into a
+// temp directory, then calls fn with the directory.
+func run(ctx context.Context, cfg *Config, fn func(tmpDir string) error) error {
+	return runEditions(ctx, []*Config{cfg}, func(_ int, tmpDir string) error {
+		return fn(tmpDir)
+	})
+}
+
+// runEditions is run for several configs. It takes their lock files and
+// downloads all of their databases at the same time, each into a temp
+// directory of its own, then calls fn with the index and directory of each
+// config in turn.
+func runEditions(ctx context.Context, cfgs []*Config, fn func(i int, tmpDir string) error) error {
+	for _, cfg := range cfgs {
+		if err := cfg.Prepare(); err != nil {
+			return &StageError{Stage: "config", Err: err}
+		}
+	}
+	locked := make(map[string]bool, len(cfgs))
+	for _, cfg := range cfgs {
+		if cfg.LockFile == "" || locked[cfg.LockFile] {
+			continue
+		}
+		var unlock func()
+		err := cfg.runStage("lock", cfg.LockFile, func() error {
+			var err error
+			unlock, err = acquireLock(cfg.LockFile)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		locked[cfg.LockFile] = true
+	}
+	// The downloads run at the same time, so they share the status line.
+	var progress *progressReporter
+	for _, cfg := range cfgs {
+		if !cfg.Progress {
+			continue
+		}
+		if progress == nil {
+			progress = newProgressReporter(os.Stderr, cfg.Logger)
+			defer progress.end()
+		}
+		cfg.progress = progress
+	}
+
+	tmpDirs := make([]string, len(cfgs))
+	var downloads []stageDownload
+	for i, cfg := range cfgs {
+		tmpDir, err := createTmpDir(cfg)
+		if err != nil {
+			return &StageError{Stage: "download", Path: cfg.TempDir, Err: err}
+		}
+		if cfg.KeepTemp {
+			cfg.Logger.Info("keeping temp directory", "path", tmpDir)
+		} else {
+			defer os.RemoveAll(tmpDir)
+		}
+		tmpDirs[i] = tmpDir
+		downloads = append(downloads, cfg.downloads(tmpDir)...)
+	}
+	if err := cfgs[0].runDownloads(ctx, downloads); err != nil {
+		return err
+	}
+	for i, tmpDir := range tmpDirs {
+		if err := fn(i, tmpDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// downloads returns the downloads of cfg into tmpDir: the CSV database, and
+// the binary one when MMDBPath is set.
+func (cfg *Config) downloads(tmpDir string) []stageDownload {
+	source := cfg.DBURL
+	if cfg.ZipPath != "" {
+		source = cfg.ZipPath
+	}
+	downloads := []stageDownload{{
+		stage: "download",
+		path:  source,
+		fn: func(ctx context.Context) error {
+			return downloadGeolite2(ctx, tmpDir, cfg)
+		},
+	}}
+	if cfg.MMDBPath != "" {
+		mmdbCfg := mmdbConfig(cfg)
+		downloads = append(downloads, stageDownload{
+			stage: "mmdb",
+			path:  cfg.MMDBURL,
+			fn: func(ctx context.Context) error {
+				return downloadMMDB(ctx, tmpDir, mmdbCfg)
+			},
+		})
+	}
+	return downloads
+}
+
+// stageDownload is one of the downloads of a run, run as a stage of its own.
+type stageDownload struct {
+	stage string
+	path  string
+	fn    func(ctx context.Context) error
+}
+
+// runDownloads runs the downloads concurrently, at most DownloadConcurrency
+// at a time, in the order given. The first failure cancels the others and is
+// returned once they have stopped.
+func (cfg *Config) runDownloads(ctx context.Context, downloads []stageDownload) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	limit := cfg.DownloadConcurrency
+	if limit == 0 {
+		limit = len(downloads)
+	}
+	slots := make(chan struct{}, limit)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	started := 0
+	for _, download := range downloads {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		started++
+		wg.Go(func() {
+			defer func() { <-slots }()
+			err := cfg.runStage(download.stage, download.path, func() error {
+				return download.fn(ctx)
+			})
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+				cancel()
+			}
+		})
+	}
+	wg.Wait()
+
+	if firstErr == nil && started < len(downloads) {
+		// Canceled by the caller before all downloads were started.
+		firstErr = &StageError{Stage: "download", Err: ctx.Err()}
+	}
+	return firstErr
+}
+
+// tmpDirPattern names the temp directory of a run, so one kept with KeepTemp
+// is easy to find, and stale ones are easy to clean up without touching
+// anything else in the parent directory.
+const tmpDirPattern = "maxmind-geolite2-*"
+
+func createTmpDir(cfg *Config) (string, error) {
+	tmpDir, err := os.MkdirTemp(cfg.TempDir, tmpDirPattern)
+	if err != nil {
+		return "", fmt.Errorf("Failed to create temp directory: %w", err)
+	}
+
+	return tmpDir, nil
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
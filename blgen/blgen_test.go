@@ -0,0 +1,521 @@
+package blgen
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testArchiveDir is the dated directory MaxMind's archives hold the CSV
+// files in.
+const testArchiveDir = "GeoLite2-Country-CSV_20260101/"
+
+// testLocations is the locations file of the country edition the tests
+// generate lists from. The last geoname is a continent without a country.
+const testLocations = `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union
+2017370,en,EU,Europe,RU,Russia,0
+2921044,en,EU,Europe,DE,Germany,1
+2963597,en,EU,Europe,IE,Ireland,1
+1814991,en,AS,Asia,CN,China,0
+6252001,en,NA,"North America",US,"United States",0
+6255148,en,EU,Europe,,,0
+`
+
+// testBlocksHeader is the header of the country edition's blocks file.
+const testBlocksHeader = "network,geoname_id,registered_country_geoname_id,represented_country_geoname_id," +
+	"is_anonymous_proxy,is_satellite_provider,is_anycast\n"
+
+// testBlocks is the blocks file of the country edition. 185.1.1.0/24 is
+// located in the US but registered to RU.
+const testBlocks = testBlocksHeader + `2.56.8.0/24,2017370,2017370,,0,0,
+2.56.9.0/24,2017370,2017370,,0,0,
+2.56.10.0/23,2017370,2017370,,0,0,
+5.1.0.0/16,2921044,2921044,,0,0,
+5.2.0.0/16,2963597,2963597,,0,0,
+8.8.8.0/24,6252001,6252001,,0,0,
+9.9.9.0/24,6255148,6255148,,0,0,
+36.0.0.0/12,1814991,1814991,,0,0,
+185.1.1.0/24,6252001,2017370,,0,0,
+`
+
+// writeZip writes a zip archive holding files by their path in the archive,
+// and returns its path.
+func writeZip(t testing.TB, files map[string]string) string {
+	t.Helper()
+	zipPath := filepath.Join(t.TempDir(), "GeoLite2-Country-CSV.zip")
+	file, err := os.Create(zipPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		w, err := archive.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return zipPath
+}
+
+// countryArchive writes an archive of the country edition with blocks as its
+// blocks file.
+func countryArchive(t testing.TB, blocks string) string {
+	t.Helper()
+	return writeZip(t, map[string]string{
+		testArchiveDir + "GeoLite2-Country-Locations-en.csv": testLocations,
+		testArchiveDir + "GeoLite2-Country-Blocks-IPv4.csv":  blocks,
+	})
+}
+
+// testConfig returns a config generating a list of RU from the archive into
+// a temporary directory, logging nothing.
+func testConfig(t testing.TB, archive string) Config {
+	return Config{
+		ZipPath:          archive,
+		OutputFilePath:   t.TempDir(),
+		BlockedCountries: codes("RU"),
+		Logger:           slog.New(slog.DiscardHandler),
+	}
+}
+
+// codes returns the set of country codes.
+func codes(codes ...string) map[string]struct{} {
+	set := make(map[string]struct{}, len(codes))
+	for _, code := range codes {
+		set[code] = struct{}{}
+	}
+	return set
+}
+
+// generate runs Generate, failing the test on an error.
+func generate(t testing.TB, cfg Config) Result {
+	t.Helper()
+	result, err := Generate(t.Context(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// listLines returns the lines of the list at path, leaving out the header
+// and other comments.
+func listLines(t testing.TB, path string) []string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []string
+	for line := range strings.Lines(string(data)) {
+		if !strings.HasPrefix(line, "#") {
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	return lines
+}
+
+// testServer serves a database the way MaxMind's download endpoint does:
+// the archive at /db.zip, with ranges and an ETag, and its SHA256 file at
+// /db.zip.sha256. Requests without an accepted credential are answered with
+// 401. It records the requests it gets.
+type testServer struct {
+	*httptest.Server
+	archive []byte
+	// accepted holds the license keys the server accepts by account ID.
+	accepted map[string]string
+	// handle, when set, is offered every request first and reports whether
+	// it answered it.
+	handle func(w http.ResponseWriter, r *http.Request) bool
+
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+// newTestServer serves the archive at archivePath, accepting the account
+// 1234 with the license key "key".
+func newTestServer(t testing.TB, archivePath string) *testServer {
+	t.Helper()
+	archive, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{archive: archive, accepted: map[string]string{"1234": "key"}}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) serve(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Clone(r.Context()))
+	s.mu.Unlock()
+	if s.handle != nil && s.handle(w, r) {
+		return
+	}
+	accountID, licenseKey, _ := r.BasicAuth()
+	if key, found := s.accepted[accountID]; !found || key != licenseKey {
+		http.Error(w, "Invalid license key", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/db.zip":
+		sum := sha256.Sum256(s.archive)
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:8])+`"`)
+		http.ServeContent(w, r, "db.zip", time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), bytes.NewReader(s.archive))
+	case "/db.zip.sha256":
+		sum := sha256.Sum256(s.archive)
+		w.Write([]byte(hex.EncodeToString(sum[:]) + "  GeoLite2-Country-CSV_20260101.zip\n"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// requested returns the requests the server got so far.
+func (s *testServer) requested() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// config returns a config generating a list of RU from the server into a
+// temporary directory.
+func (s *testServer) config(t testing.TB) Config {
+	cfg := testConfig(t, "")
+	cfg.DBURL = s.URL + "/db.zip"
+	cfg.SHAURL = s.URL + "/db.zip.sha256"
+	cfg.AccountID = "1234"
+	cfg.LicenseKey = "key"
+	return cfg
+}
+
+// captureLog points the logger of cfg at the returned buffer.
+func captureLog(cfg *Config) *bytes.Buffer {
+	var buf bytes.Buffer
+	cfg.Logger = slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return &buf
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+// noHTTPClient returns a client failing the test on any request.
+func noHTTPClient(t testing.TB) *http.Client {
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		t.Errorf("unexpected request for %s", r.URL)
+		return nil, http.ErrNotSupported
+	})}
+}
+
+func TestGenerate(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	result := generate(t, cfg)
+	want := []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if result.OutputPath != filepath.Join(cfg.OutputFilePath, DefaultOutputFilename) {
+		t.Errorf("list written to %s", result.OutputPath)
+	}
+}
+
+func TestResultCounts(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.BlockedCountries = codes("RU", "DE")
+	result := generate(t, cfg)
+	info, err := os.Stat(result.OutputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.CountriesRequested != 2 || result.GeonamesMatched != 2 || result.NetworksWritten != 5 ||
+		result.MalformedRows != 0 || result.BytesWritten != info.Size() || result.Elapsed <= 0 {
+		t.Errorf("got %+v for a list of %d bytes", result, info.Size())
+	}
+	if want := map[string]int{"RU": 4, "DE": 1}; !maps.Equal(result.NetworksByLabel, want) {
+		t.Errorf("networks by label %v, want %v", result.NetworksByLabel, want)
+	}
+	want := fmt.Sprintf("countries=2 geonames=2 networks=5 malformed=0 bytes=%d", info.Size())
+	if got := result.String(); got != want {
+		t.Errorf("summary %q, want %q", got, want)
+	}
+}
+
+func TestKeepTemp(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+
+	cfg := testConfig(t, archive)
+	cfg.TempDir = t.TempDir()
+	cfg.KeepTemp = true
+	generate(t, cfg)
+	kept, err := filepath.Glob(filepath.Join(cfg.TempDir, tmpDirPattern, "GeoLite2-Country-Blocks-IPv4.csv"))
+	if err != nil || len(kept) != 1 {
+		t.Errorf("kept temp directory holds %q, want the extracted CSV files", kept)
+	}
+
+	// Without KeepTemp the directory is removed, also after a failure.
+	for _, strict := range []bool{false, true} {
+		cfg := testConfig(t, archive)
+		cfg.TempDir = t.TempDir()
+		cfg.BlockedCountries = codes("RU", "UX")
+		cfg.Strict = strict
+		if _, err := Generate(t.Context(), cfg); (err != nil) != strict {
+			t.Fatalf("strict %t: %v", strict, err)
+		}
+		if entries, _ := os.ReadDir(cfg.TempDir); len(entries) != 0 {
+			t.Errorf("strict %t: temp directory left behind", strict)
+		}
+	}
+}
+
+// An injected client is used for every request, here answering them without
+// any server.
+func TestGenerateWithHTTPClient(t *testing.T) {
+	archive, err := os.ReadFile(countryArchive(t, testBlocks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(archive)
+	files := map[string][]byte{
+		"/db.zip":        archive,
+		"/db.zip.sha256": []byte(hex.EncodeToString(sum[:]) + "  GeoLite2-Country-CSV_20260101.zip\n"),
+	}
+	cfg := testConfig(t, "")
+	cfg.DBURL = "https://download.example/db.zip"
+	cfg.SHAURL = "https://download.example/db.zip.sha256"
+	cfg.AccountID, cfg.LicenseKey = "1234", "key"
+	cfg.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		body, found := files[r.URL.Path]
+		if !found || r.URL.Host != "download.example" {
+			t.Errorf("unexpected request for %s", r.URL)
+			return nil, http.ErrNotSupported
+		}
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Header:        http.Header{},
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       r,
+		}, nil
+	})}
+
+	result := generate(t, cfg)
+	want := []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if result.NetworksWritten != len(want) || result.OutputPath != filepath.Join(cfg.OutputFilePath, DefaultOutputFilename) {
+		t.Errorf("got %+v", result)
+	}
+}
+
+func TestStageLogs(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	var log bytes.Buffer
+	cfg.Logger = slog.New(slog.NewJSONHandler(&log, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	generate(t, cfg)
+
+	var stages []string
+	decoder := json.NewDecoder(&log)
+	for decoder.More() {
+		var record struct {
+			Msg     string
+			Stage   string
+			Path    string
+			Elapsed *int64
+		}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Msg != "stage complete" {
+			continue
+		}
+		if record.Path == "" || record.Elapsed == nil {
+			t.Errorf("stage %s logged without its path or time", record.Stage)
+		}
+		stages = append(stages, record.Stage)
+	}
+	if want := []string{"download", "match", "write", "move"}; !slices.Equal(stages, want) {
+		t.Errorf("logged the stages %q, want %q", stages, want)
+	}
+}
+
+func TestStageError(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.zip")
+	_, err := Generate(t.Context(), testConfig(t, missing))
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != "download" || stageErr.Path != missing {
+		t.Errorf("got %#v, want a download stage error for %s", err, missing)
+	}
+}
+
+func TestTempDirNames(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	cfg := server.config(t)
+	cfg.TempDir = t.TempDir()
+	cfg.KeepTemp = true
+	generate(t, cfg)
+	entries, err := os.ReadDir(cfg.TempDir)
+	if err != nil || len(entries) != 1 || !strings.HasPrefix(entries[0].Name(), "maxmind-geolite2-") {
+		t.Fatalf("temp directory %v: %v, want one named maxmind-geolite2-*", entries, err)
+	}
+	files, err := os.ReadDir(filepath.Join(cfg.TempDir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	want := []string{"GeoLite2-Country-Blocks-IPv4.csv", "GeoLite2-Country-CSV.zip", "GeoLite2-Country-Locations-en.csv"}
+	if !slices.Equal(names, want) {
+		t.Errorf("temp directory holds %q, want %q", names, want)
+	}
+}
+
+func TestThroughputLogs(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	var log bytes.Buffer
+	cfg.Logger = slog.New(slog.NewJSONHandler(&log, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	generate(t, cfg)
+
+	rows := map[string]int{}
+	decoder := json.NewDecoder(&log)
+	for decoder.More() {
+		var record struct {
+			Msg           string
+			Stage         string
+			Rows          int
+			Bytes         int64
+			RowsPerSecond *int64 `json:"rows_per_second"`
+			MBPerSecond   string `json:"mb_per_second"`
+		}
+		if err := decoder.Decode(&record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Msg != "throughput" {
+			continue
+		}
+		if record.Bytes <= 0 || record.RowsPerSecond == nil || record.MBPerSecond == "" {
+			t.Errorf("%s throughput logged as %+v", record.Stage, record)
+		}
+		rows[record.Stage] = record.Rows
+	}
+	// The locations file has 6 geonames, the blocks file 9 networks, 4 of
+	// which are listed.
+	if want := map[string]int{"locations": 6, "scan": 9, "write": 4}; !maps.Equal(rows, want) {
+		t.Errorf("logged the rows %v, want %v", rows, want)
+	}
+}
+
+func TestGenerateEditions(t *testing.T) {
+	country := newTestServer(t, countryArchive(t, testBlocks))
+	asn := newTestServer(t, writeZip(t, map[string]string{
+		"GeoLite2-ASN-CSV_20260101/GeoLite2-ASN-Blocks-IPv4.csv": `network,autonomous_system_number,autonomous_system_organization
+1.0.0.0/24,13335,CLOUDFLARENET
+8.8.8.0/24,15169,GOOGLE
+`,
+	}))
+	// Each archive is only served once both were requested, which they
+	// only are when downloaded at the same time.
+	var both sync.WaitGroup
+	both.Add(2)
+	for _, server := range []*testServer{country, asn} {
+		server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+			if r.URL.Path != "/db.zip" {
+				return false
+			}
+			both.Done()
+			done := make(chan struct{})
+			go func() { both.Wait(); close(done) }()
+			select {
+			case <-done:
+				return false
+			case <-time.After(5 * time.Second):
+				http.Error(w, "editions downloaded one after the other", http.StatusBadRequest)
+				return true
+			}
+		}
+	}
+	countryCfg := country.config(t)
+	asnCfg := asn.config(t)
+	asnCfg.Edition = EditionASN
+	asnCfg.BlockedCountries = nil
+	asnCfg.BlockedASNsInput = []string{"AS13335"}
+	asnCfg.OutputFilePath = countryCfg.OutputFilePath
+	asnCfg.OutputFilename = "asn.txt"
+	results, err := GenerateEditions(t.Context(), []Config{countryCfg, asnCfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := listLines(t, results[0].OutputPath); len(got) != 4 || results[0].NetworksWritten != 4 {
+		t.Errorf("country edition wrote %q", got)
+	}
+	want := []string{"1.0.0.0/24 ; AS13335"}
+	if got := listLines(t, results[1].OutputPath); !slices.Equal(got, want) || results[1].OutputPath != filepath.Join(asnCfg.OutputFilePath, "asn.txt") {
+		t.Errorf("ASN edition wrote %q to %s, want %q", got, results[1].OutputPath, want)
+	}
+
+	// A failed download cancels the other editions.
+	country.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/db.zip" {
+			return false
+		}
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		return true
+	}
+	asn.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		http.NotFound(w, r)
+		return true
+	}
+	start := time.Now()
+	if _, err := GenerateEditions(t.Context(), []Config{countryCfg, asnCfg}); err == nil {
+		t.Error("run succeeded with the ASN edition missing")
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("the country download went on for %v after the ASN download failed", elapsed)
+	}
+
+	// Two lists can't share an output.
+	asnCfg.OutputFilename = ""
+	_, err = GenerateEditions(t.Context(), []Config{countryCfg, asnCfg})
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != "config" {
+		t.Errorf("got %v for two lists written to the same file, want a config error", err)
+	}
+}
@@ -0,0 +1,49 @@
+package blgen
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestIsBogon(t *testing.T) {
+	tests := []struct {
+		network string
+		want    bool
+	}{
+		{"10.1.0.0/16", true},
+		{"10.0.0.0/8", true},
+		{"10.0.0.0/7", false},
+		{"172.20.0.0/16", true},
+		{"172.32.0.0/16", false},
+		{"192.168.1.0/24", true},
+		{"100.64.0.0/10", true},
+		{"fd00::/8", true},
+		{"2.56.8.0/24", false},
+		{"2a00::/16", false},
+	}
+	for _, test := range tests {
+		if got := isBogon(netip.MustParsePrefix(test.network)); got != test.want {
+			t.Errorf("isBogon(%s) = %t, want %t", test.network, got, test.want)
+		}
+	}
+}
+
+func TestStripBogons(t *testing.T) {
+	blocks := testBlocksHeader + `2.56.8.0/24,2017370,2017370,,0,0,
+10.0.0.0/8,2017370,2017370,,0,0,
+192.168.0.0/24,2017370,2017370,,0,0,
+fc00::/7,2017370,2017370,,0,0,
+`
+	archive := countryArchive(t, blocks)
+	for strip, want := range map[bool][]string{
+		false: {"2.56.8.0/24 ; RU", "10.0.0.0/8 ; RU", "192.168.0.0/24 ; RU", "fc00::/7 ; RU"},
+		true:  {"2.56.8.0/24 ; RU"},
+	} {
+		cfg := testConfig(t, archive)
+		cfg.StripBogons = strip
+		if got := listLines(t, generate(t, cfg).OutputPath); !slices.Equal(got, want) {
+			t.Errorf("strip bogons %t: got %q, want %q", strip, got, want)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package blgen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// cacheMeta is stored next to the cached archive. It records what is needed
+// to revalidate the archive with a conditional request on the next run, and
+// the SHA256 it was verified with together with the size and modification
+// time it had then, so an unchanged archive doesn't have to be hashed again.
+type cacheMeta struct {
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+	SHA256       string    `json:"sha256"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"mod_time"`
+}
+
+func cacheMetaPath(cfg *Config) string {
+	return filepath.Join(cfg.CacheDir, editionArchiveFilename(cfg.edition(), cfg.Archive)+".json")
+}
+
+func loadCacheMeta(cfg *Config) cacheMeta {
+	var meta cacheMeta
+	data, err := os.ReadFile(cacheMetaPath(cfg))
+	if err != nil {
+		return meta
+	}
+	// A corrupt file just means the archive is downloaded again.
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return cacheMeta{}
+	}
+	return meta
+}
+
+func saveCacheMeta(cfg *Config, meta cacheMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache metadata: %w", err)
+	}
+	if err := os.WriteFile(cacheMetaPath(cfg), data, 0o644); err != nil {
+		return fmt.Errorf("failed to write cache metadata: %w", err)
+	}
+	return nil
+}
+
+// downloadCachedArchive returns the path of a verified archive in
+// cfg.CacheDir. A previously verified archive is revalidated with
+// If-None-Match and If-Modified-Since and kept on 304 Not Modified. Its
+// stored SHA256 is reused when its size and modification time are unchanged,
+// and it is hashed again otherwise. Either way the SHA256 is still checked
+// against the remote SHA file.
+func downloadCachedArchive(ctx context.Context, cfg *Config) (string, error) {
+	if err := os.MkdirAll(cfg.CacheDir, 0o755); err != nil {
+		return "", fmt.Errorf("failed to create cache directory %s: %w", cfg.CacheDir, err)
+	}
+
+	meta := loadCacheMeta(cfg)
+	header := http.Header{}
+	if meta.SHA256 != "" {
+		if meta.ETag != "" {
+			header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+
+	// Drop the metadata before the archive can be replaced, so an interrupted
+	// run or an archive that fails verification is never treated as verified
+	// later.
+	if err := os.Remove(cacheMetaPath(cfg)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to remove cache metadata: %w", err)
+	}
+
+	download, err := downloadArchive(ctx, cfg.CacheDir, cfg, header, true)
+	if err != nil {
+		return "", err
+	}
+	if download.notModified {
+		download.sha256, err = cachedArchiveSHA256(download.path, meta, cfg)
+		if errors.Is(err, os.ErrNotExist) {
+			// The archive was removed while its metadata was kept, so
+			// fetch it again unconditionally.
+			download, err = downloadArchive(ctx, cfg.CacheDir, cfg, nil, true)
+		}
+		if err != nil {
+			return "", err
+		}
+		download.etag, download.lastModified = meta.ETag, meta.LastModified
+	}
+
+	// The remote SHA256 is checked even for a cached archive, so a changed
+	// mirror is noticed.
+	err = verifySHA256(ctx, download.sha256, cfg)
+	if err != nil && download.resumed {
+		// The partial download may be from an archive that has since been
+		// replaced, so download the whole archive once more.
+		cfg.Logger.Warn("resumed download failed verification, downloading it again", "path", download.path, "error", err)
+		download, err = downloadArchive(ctx, cfg.CacheDir, cfg, nil, false)
+		if err == nil {
+			err = verifySHA256(ctx, download.sha256, cfg)
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	archiveInfo, err := os.Stat(download.path)
+	if err != nil {
+		return "", fmt.Errorf("failed to stat cached archive: %w", err)
+	}
+	err = saveCacheMeta(cfg, cacheMeta{
+		ETag:         download.etag,
+		LastModified: download.lastModified,
+		SHA256:       download.sha256,
+		Size:         archiveInfo.Size(),
+		ModTime:      archiveInfo.ModTime(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return download.path, nil
+}
+
+// cachedArchiveSHA256 returns the SHA256 of the cached archive, reusing the
+// stored one when the archive's size and modification time are unchanged.
+func cachedArchiveSHA256(archivePath string, meta cacheMeta, cfg *Config) (string, error) {
+	archiveInfo, err := os.Stat(archivePath)
+	if err != nil {
+		return "", err
+	}
+	if archiveInfo.Size() == meta.Size && archiveInfo.ModTime().Equal(meta.ModTime) {
+		cfg.Logger.Info("using cached archive", "path", archivePath)
+		return meta.SHA256, nil
+	}
+
+	cfg.Logger.Info("cached archive changed since it was verified, hashing it again", "path", archivePath)
+	return hashFile(archivePath)
+}
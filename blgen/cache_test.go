@@ -0,0 +1,159 @@
+package blgen
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statusRecorder returns a client recording the status of every response
+// to a request for path.
+func statusRecorder(path string, statuses *[]int) *http.Client {
+	return &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		response, err := http.DefaultTransport.RoundTrip(r)
+		if err == nil && r.URL.Path == path {
+			*statuses = append(*statuses, response.StatusCode)
+		}
+		return response, err
+	})}
+}
+
+func TestCacheRevalidated(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	cacheDir := t.TempDir()
+	var statuses []int
+	var lists []string
+	for range 2 {
+		cfg := server.config(t)
+		cfg.CacheDir = cacheDir
+		cfg.HTTPClient = statusRecorder("/db.zip", &statuses)
+		lists = append(lists, readFile(t, generate(t, cfg).OutputPath))
+	}
+
+	if want := []int{http.StatusOK, http.StatusNotModified}; !slices.Equal(statuses, want) {
+		t.Errorf("archive requests answered with %v, want %v", statuses, want)
+	}
+	var conditional int
+	for _, r := range server.requested() {
+		if r.URL.Path == "/db.zip" && r.Header.Get("If-None-Match") != "" {
+			conditional++
+		}
+	}
+	if conditional != 1 {
+		t.Errorf("%d conditional archive requests, want 1", conditional)
+	}
+	if lists[0] != lists[1] {
+		t.Errorf("the cached archive gave %q, want %q", lists[1], lists[0])
+	}
+	if entries, _ := os.ReadDir(cacheDir); len(entries) != 2 {
+		t.Errorf("cache holds %d files, want the archive and its metadata", len(entries))
+	}
+}
+
+func TestCachedArchiveSHA256(t *testing.T) {
+	path := countryArchive(t, testBlocks)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, "")
+
+	// A stored SHA256 that isn't the archive's shows it wasn't hashed.
+	meta := cacheMeta{SHA256: "stored", Size: info.Size(), ModTime: info.ModTime()}
+	if got, err := cachedArchiveSHA256(path, meta, &cfg); err != nil || got != "stored" {
+		t.Errorf("unchanged archive: got %q, %v, want the stored SHA256", got, err)
+	}
+
+	meta.ModTime = info.ModTime().Add(-time.Hour)
+	if got, err := cachedArchiveSHA256(path, meta, &cfg); err != nil || got != hash {
+		t.Errorf("touched archive: got %q, %v, want it hashed again", got, err)
+	}
+	meta.ModTime, meta.Size = info.ModTime(), info.Size()+1
+	if got, err := cachedArchiveSHA256(path, meta, &cfg); err != nil || got != hash {
+		t.Errorf("resized archive: got %q, %v, want it hashed again", got, err)
+	}
+}
+
+// The remote SHA256 is fetched on every run, so a changed mirror is noticed
+// even when the cached archive is reused.
+func TestCacheChecksumChanged(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	cfg := server.config(t)
+	cfg.CacheDir = t.TempDir()
+	generate(t, cfg)
+
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/db.zip.sha256" {
+			return false
+		}
+		w.Write([]byte(strings.Repeat("0", 64) + "  GeoLite2-Country-CSV_20260101.zip\n"))
+		return true
+	}
+	cacheDir := cfg.CacheDir
+	cfg = server.config(t)
+	cfg.CacheDir = cacheDir
+	if _, err := Generate(t.Context(), cfg); err == nil {
+		t.Error("cached archive accepted against a changed SHA256")
+	}
+}
+
+func TestResumeDownload(t *testing.T) {
+	archivePath := countryArchive(t, testBlocks)
+	archive, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := len(archive) / 2
+	tests := []struct {
+		name    string
+		partial []byte
+		ranges  bool
+		// want are the Range headers of the archive requests.
+		want []string
+	}{
+		{"resumed", archive[:half], true, []string{"bytes=" + strconv.Itoa(half) + "-"}},
+		{"no range support", archive[:half], false, []string{"bytes=" + strconv.Itoa(half) + "-"}},
+		{"stale partial download", bytes.Repeat([]byte{'x'}, half), true, []string{"bytes=" + strconv.Itoa(half) + "-", ""}},
+	}
+	for _, test := range tests {
+		server := newTestServer(t, archivePath)
+		if !test.ranges {
+			server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				r.Header.Del("Range")
+				return false
+			}
+		}
+		cfg := server.config(t)
+		cfg.CacheDir = t.TempDir()
+		if err := os.WriteFile(filepath.Join(cfg.CacheDir, "GeoLite2-Country-CSV.zip.tmp"), test.partial, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if result := generate(t, cfg); result.NetworksWritten != 4 {
+			t.Errorf("%s: %d networks written, want 4", test.name, result.NetworksWritten)
+		}
+
+		var ranges []string
+		for _, r := range server.requested() {
+			if r.URL.Path == "/db.zip" {
+				ranges = append(ranges, r.Header.Get("Range"))
+			}
+		}
+		if !slices.Equal(ranges, test.want) {
+			t.Errorf("%s: archive requested with the ranges %q, want %q", test.name, ranges, test.want)
+		}
+		cached, err := os.ReadFile(filepath.Join(cfg.CacheDir, "GeoLite2-Country-CSV.zip"))
+		if err != nil || !bytes.Equal(cached, archive) {
+			t.Errorf("%s: cached archive differs from the served one: %v", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package blgen
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// listChunks splits a list into files of at most MaxLines lines, the header
+// included, named after the list with .1, .2 and so on appended. Every chunk
+// starts with the header, so each can be loaded on its own. The networks go
+// to the chunks in the order they would be written to a single file, after
+// aggregation and sorting, so the same list is always split the same way.
+type listChunks struct {
+	cfg *Config
+	// path is the path of the list the chunks are named after.
+	path   string
+	header string
+	// section is the label of the grouped section being written, whose
+	// heading a new chunk repeats.
+	section string
+	chunk   int
+	// lines counts the lines of the current chunk, and startLines those
+	// before its first network.
+	lines      int
+	startLines int
+	err        error
+}
+
+// chunkName is the name of chunk n of the list name.
+func chunkName(name string, n int) string {
+	return name + "." + strconv.Itoa(n)
+}
+
+func (c *listChunks) chunkPath() string {
+	return chunkName(c.path, c.chunk)
+}
+
+// lineCountingWriter counts the lines written through it.
+type lineCountingWriter struct {
+	w     io.Writer
+	lines *int
+}
+
+func (l *lineCountingWriter) Write(p []byte) (int, error) {
+	*l.lines += bytes.Count(p, []byte("\n"))
+	return l.w.Write(p)
+}
+
+// reserve moves on to the next chunk unless lines more lines fit in the
+// current one. A failure is kept in chunks.err, the rest of the list is
+// still written to the current chunk but the run fails.
+func (out *listOutput) reserve(lines int) {
+	c := out.chunks
+	if c.err != nil || c.lines+lines <= c.cfg.MaxLines {
+		return
+	}
+	if c.lines == c.startLines {
+		c.err = fmt.Errorf("a chunk of %d lines has no room for the networks after the header", c.cfg.MaxLines)
+		return
+	}
+	c.err = out.nextChunk()
+}
+
+// nextChunk finishes the current chunk and starts the next one.
+func (out *listOutput) nextChunk() error {
+	c := out.chunks
+	endListOutput(out)
+	if err := out.finish(c.cfg); err != nil {
+		return err
+	}
+	c.chunk++
+	out.name = c.chunkPath()
+	file, err := createOutputFile(out.name, c.cfg)
+	if err != nil {
+		return err
+	}
+	out.file = file
+	c.lines = 0
+	out.attach(file, c.cfg)
+	startListOutput(out, c.header, c.cfg)
+	if c.section != "" {
+		writeSectionHeading(out.w, c.section)
+		c.startLines = c.lines
+	}
+	return nil
+}
+
+// moveChunks moves the chunks of the list filename, each followed by its
+// companion files, to OutputFilePath and returns their paths. The chunks an
+// earlier run split the list into beyond the last one are removed, so none
+// of them is loaded along with the current list.
+func moveChunks(tmpDir, filename string, cfg *Config) ([]string, error) {
+	var paths []string
+	n := 1
+	for ; ; n++ {
+		chunk := chunkName(filename, n)
+		if _, err := os.Stat(filepath.Join(tmpDir, chunk)); err != nil {
+			break
+		}
+		outputPath := filepath.Join(cfg.OutputFilePath, chunk)
+		err := cfg.runStage("move", outputPath, func() error {
+			if err := moveFile(tmpDir, chunk, cfg); err != nil {
+				return err
+			}
+			for _, companion := range cfg.companionFiles(chunk) {
+				if err := moveFile(tmpDir, companion, cfg); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, outputPath)
+	}
+	for ; ; n++ {
+		stalePath := filepath.Join(cfg.OutputFilePath, chunkName(filename, n))
+		err := os.Remove(stalePath)
+		if errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		if err != nil {
+			return nil, &StageError{Stage: "move", Path: stalePath, Err: fmt.Errorf("failed to remove stale chunk: %w", err)}
+		}
+		os.Remove(stalePath + checksumSuffix)
+		cfg.Logger.Info("removed stale chunk", "path", stalePath)
+	}
+	return paths, nil
+}
@@ -0,0 +1,86 @@
+package blgen
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestChunkBoundaries(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	ru := []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}
+	tests := []struct {
+		maxLines int
+		want     [][]string
+	}{
+		{1, [][]string{ru[0:1], ru[1:2], ru[2:3], ru[3:4]}},
+		{2, [][]string{ru[0:2], ru[2:4]}},
+		{3, [][]string{ru[0:3], ru[3:4]}},
+		{4, [][]string{ru}},
+		{5, [][]string{ru}},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.NoHeader = true
+		cfg.MaxLines = test.maxLines
+		result := generate(t, cfg)
+		if len(result.OutputPaths) != len(test.want) {
+			t.Errorf("%d lines: got %d chunks, want %d", test.maxLines, len(result.OutputPaths), len(test.want))
+			continue
+		}
+		for i, path := range result.OutputPaths {
+			if want := filepath.Join(cfg.OutputFilePath, fmt.Sprintf("%s.%d", DefaultOutputFilename, i+1)); path != want {
+				t.Errorf("%d lines: chunk %d written to %s, want %s", test.maxLines, i+1, path, want)
+			}
+			if got := listLines(t, path); !slices.Equal(got, test.want[i]) {
+				t.Errorf("%d lines: chunk %d holds %q, want %q", test.maxLines, i+1, got, test.want[i])
+			}
+		}
+	}
+}
+
+func TestChunksRepeatTheHeader(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Format = FormatCIDR
+	cfg.MaxLines = 3
+	result := generate(t, cfg)
+	if len(result.OutputPaths) != 2 {
+		t.Fatalf("got %d chunks, want 2", len(result.OutputPaths))
+	}
+	for _, path := range result.OutputPaths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+		if len(lines) != 3 || !strings.HasPrefix(lines[0], "# ") {
+			t.Errorf("%s holds %q, want the header and two networks", path, lines)
+		}
+	}
+}
+
+func TestChunkWithoutRoomForNetworks(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Format = FormatCIDR
+	cfg.MaxLines = 1
+	if _, err := Generate(t.Context(), cfg); err == nil {
+		t.Error("chunks holding only the header accepted")
+	}
+}
+
+func TestChunksOfEarlierRunRemoved(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.NoHeader = true
+	cfg.MaxLines = 2
+	stale := filepath.Join(cfg.OutputFilePath, DefaultOutputFilename+".3")
+	if err := os.WriteFile(stale, []byte("5.1.0.0/16 ; DE\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	generate(t, cfg)
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("chunk of an earlier run left in place: %v", err)
+	}
+}
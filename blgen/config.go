@@ -0,0 +1,839 @@
+// Package blgen downloads MaxMind's GeoLite2 CSV databases and generates IP
+// lists from the networks of the configured countries, continents,
+// subdivisions or autonomous systems.
+package blgen
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config configures Generate. The field tags name the keys of the config
+// file read by the blgen command.
+type Config struct {
+	AccountID                 string       `yaml:"account_id" json:"account_id" toml:"account_id"`
+	LicenseKey                string       `yaml:"license_key" json:"license_key" toml:"license_key"`
+	AccountIDFile             string       `yaml:"account_id_file" json:"account_id_file" toml:"account_id_file"`
+	LicenseKeyFile            string       `yaml:"license_key_file" json:"license_key_file" toml:"license_key_file"`
+	NetrcFile                 string       `yaml:"netrc_file" json:"netrc_file" toml:"netrc_file"`
+	Credentials               []Credential `yaml:"credentials" json:"credentials" toml:"credentials"`
+	BlockedCountriesInput     []string     `yaml:"blocked_countries" json:"blocked_countries" toml:"blocked_countries"`
+	BlockedContinentsInput    []string     `yaml:"blocked_continents" json:"blocked_continents" toml:"blocked_continents"`
+	BlockedSubdivisionsInput  []string     `yaml:"blocked_subdivisions" json:"blocked_subdivisions" toml:"blocked_subdivisions"`
+	BlockedASNsInput          []string     `yaml:"blocked_asns" json:"blocked_asns" toml:"blocked_asns"`
+	ExcludedCountriesInput    []string     `yaml:"excluded_countries" json:"excluded_countries" toml:"excluded_countries"`
+	ExcludedSubdivisionsInput []string     `yaml:"excluded_subdivisions" json:"excluded_subdivisions" toml:"excluded_subdivisions"`
+	Edition                   string       `yaml:"edition" json:"edition" toml:"edition"`
+	Locale                    string       `yaml:"locale" json:"locale" toml:"locale"`
+	OutputFilePath            string       `yaml:"output_filepath" json:"output_filepath" toml:"output_filepath"`
+	OutputFilename            string       `yaml:"output_filename" json:"output_filename" toml:"output_filename"`
+	Mode                      string       `yaml:"mode" json:"mode" toml:"mode"`
+	Proxy                     string       `yaml:"proxy" json:"proxy" toml:"proxy"`
+	NoHeader                  bool         `yaml:"no_header" json:"no_header" toml:"no_header"`
+	DBURL                     string       `yaml:"db_url" json:"db_url" toml:"db_url"`
+	SHAURL                    string       `yaml:"sha_url" json:"sha_url" toml:"sha_url"`
+	NotifyURL                 string       `yaml:"notify_url" json:"notify_url" toml:"notify_url"`
+	FileModeInput             string       `yaml:"file_mode" json:"file_mode" toml:"file_mode"`
+	Format                    string       `yaml:"-" json:"-" toml:"-"`
+	SetName                   string       `yaml:"-" json:"-" toml:"-"`
+	NginxVar                  string       `yaml:"-" json:"-" toml:"-"`
+	NetshRulePrefix           string       `yaml:"-" json:"-" toml:"-"`
+	Aggregate                 bool         `yaml:"-" json:"-" toml:"-"`
+	// TimestampFormat is the Go time layout of the time in the header, in
+	// local time unless TimestampUTC is set.
+	TimestampFormat string `yaml:"-" json:"-" toml:"-"`
+	TimestampUTC    bool   `yaml:"-" json:"-" toml:"-"`
+	// VerboseHeader adds how the list was generated to the header: the
+	// Generator, such as "blgen 1.2.0", the edition, the mode, the codes and
+	// the time in UTC.
+	VerboseHeader bool   `yaml:"-" json:"-" toml:"-"`
+	Generator     string `yaml:"-" json:"-" toml:"-"`
+	// MatchFields is a comma-separated list of the blocks file columns a
+	// network is matched on by the country and city editions: geoname_id,
+	// registered_country_geoname_id and represented_country_geoname_id. All
+	// three are used when it is empty.
+	MatchFields string `yaml:"-" json:"-" toml:"-"`
+	// OnlyRegistered matches networks on the country they are registered
+	// to alone, as MatchFields set to registered_country_geoname_id does.
+	OnlyRegistered bool `yaml:"-" json:"-" toml:"-"`
+	// AnnotateReason adds which of the match fields matched to each line of
+	// the plain, range and csv formats: geo, registered or represented, or
+	// several of them joined by +.
+	AnnotateReason bool `yaml:"-" json:"-" toml:"-"`
+	// NumericCodes labels the networks with the ISO 3166-1 numeric code of
+	// their country, such as 643 instead of RU. Continent and subdivision
+	// codes are left alone.
+	NumericCodes bool `yaml:"-" json:"-" toml:"-"`
+	// MapV4ToV6 writes the IPv4-mapped IPv6 equivalent of every IPv4
+	// network, MapV4ToV6Also next to the network and MapV4ToV6Instead in its
+	// place.
+	MapV4ToV6 string `yaml:"-" json:"-" toml:"-"`
+	// ConflictPolicy decides what happens to a network listed under more
+	// than one label: ConflictFirst writes it under every label as it comes,
+	// ConflictLast keeps the last label, and ConflictError fails the run. It
+	// defaults to ConflictFirst, the only one that keeps no network in
+	// memory.
+	ConflictPolicy string `yaml:"-" json:"-" toml:"-"`
+	// ReportSort orders the counts returned by Report, by ReportSortCode
+	// when empty.
+	ReportSort string `yaml:"-" json:"-" toml:"-"`
+	// Newline ends the lines of the list, the header included, with
+	// NewlineLF or NewlineCRLF. It defaults to NewlineLF. The netsh format
+	// always uses CRLF.
+	Newline string `yaml:"-" json:"-" toml:"-"`
+	// StripBogons leaves out networks within private and reserved ranges,
+	// such as 10.0.0.0/8 and fc00::/7, which the database isn't expected to
+	// contain.
+	StripBogons bool `yaml:"-" json:"-" toml:"-"`
+	// MinPrefix and MaxPrefix limit the prefix length of the listed IPv4
+	// networks, zero means no limit. IPv6 prefix lengths aren't comparable,
+	// so MinPrefixV6 and MaxPrefixV6 limit those of the IPv6 networks.
+	MinPrefix   int `yaml:"-" json:"-" toml:"-"`
+	MaxPrefix   int `yaml:"-" json:"-" toml:"-"`
+	MinPrefixV6 int `yaml:"-" json:"-" toml:"-"`
+	MaxPrefixV6 int `yaml:"-" json:"-" toml:"-"`
+	Retries     int `yaml:"-" json:"-" toml:"-"`
+	Workers     int `yaml:"-" json:"-" toml:"-"`
+	// Sample uses only every Sample-th row of the blocks file, for a quick
+	// partial list. Zero and one use every row.
+	Sample int `yaml:"-" json:"-" toml:"-"`
+	// RequestDelay is the least time between two requests to the download
+	// server. It is widened for the rest of the run whenever the server
+	// answers 429 Too Many Requests.
+	RequestDelay time.Duration `yaml:"-" json:"-" toml:"-"`
+	// DownloadConcurrency is the number of downloads of a run, such as the
+	// CSV and the binary database or the databases of GenerateEditions,
+	// that run at the same time. Zero runs them all at once.
+	DownloadConcurrency int `yaml:"-" json:"-" toml:"-"`
+	// ConnectTimeout limits establishing a connection to the download
+	// server, DownloadTimeout each attempt at downloading the archive,
+	// including the body. The SHA256 request has a fixed 30 second limit.
+	ConnectTimeout  time.Duration `yaml:"-" json:"-" toml:"-"`
+	DownloadTimeout time.Duration `yaml:"-" json:"-" toml:"-"`
+	// HTTP2 makes the downloads use HTTP/2 only, over TLS as well as
+	// unencrypted to http:// URLs, which otherwise use HTTP/1.1.
+	HTTP2 bool `yaml:"-" json:"-" toml:"-"`
+	// SkipSHA uses the downloaded archives without checking them against
+	// the SHA256 published next to them, for mirrors that don't publish
+	// one.
+	SkipSHA bool `yaml:"-" json:"-" toml:"-"`
+	// UserAgent is sent with every request, DefaultUserAgent when empty.
+	UserAgent string `yaml:"-" json:"-" toml:"-"`
+	// MaxErrors is the number of malformed blocks file rows skipped with a
+	// warning before Generate fails. Zero fails on the first one.
+	MaxErrors       int    `yaml:"-" json:"-" toml:"-"`
+	Strict          bool   `yaml:"-" json:"-" toml:"-"`
+	StrictSchema    bool   `yaml:"-" json:"-" toml:"-"`
+	Gzip            bool   `yaml:"-" json:"-" toml:"-"`
+	Checksum        bool   `yaml:"-" json:"-" toml:"-"`
+	Names           bool   `yaml:"-" json:"-" toml:"-"`
+	AllowDuplicates bool   `yaml:"-" json:"-" toml:"-"`
+	Sort            bool   `yaml:"-" json:"-" toml:"-"`
+	CacheDir        string `yaml:"-" json:"-" toml:"-"`
+	// MaxAgeDays fails the run when the database was built more days ago
+	// than this, going by the date in the archive's directory name. Zero
+	// accepts a database of any age.
+	MaxAgeDays int `yaml:"-" json:"-" toml:"-"`
+	// CSVDir is where the CSV files are extracted to, instead of the temp
+	// directory, so they outlive the run. With UseCachedCSV, files extracted
+	// there less than CSVMaxAge ago are used without downloading anything.
+	CSVDir       string        `yaml:"-" json:"-" toml:"-"`
+	UseCachedCSV bool          `yaml:"-" json:"-" toml:"-"`
+	CSVMaxAge    time.Duration `yaml:"-" json:"-" toml:"-"`
+	// LowMemory sorts the networks for Sort and Grouped on disk, in chunks
+	// merged as the list is written, so the memory used stays bounded
+	// however long the list is. Duplicate lines are then only left out when
+	// they follow the line they repeat.
+	LowMemory bool `yaml:"-" json:"-" toml:"-"`
+	// Grouped writes the networks of each label in a section of their own,
+	// headed by a comment such as "# --- RU ---", with the labels sorted and
+	// the networks sorted numerically within each section.
+	Grouped bool `yaml:"-" json:"-" toml:"-"`
+	// Append adds the networks to the lines of the existing output file
+	// instead of replacing them, leaving out the lines it already has. The
+	// file keeps its own header.
+	Append bool `yaml:"-" json:"-" toml:"-"`
+	// MaxLines splits the list into files of at most this many lines, the
+	// header included, named after the output file with .1, .2 and so on
+	// appended. Zero writes the list to a single file.
+	MaxLines int `yaml:"-" json:"-" toml:"-"`
+	// DiffAgainst is a previously generated list. When set, the lines added
+	// since and the lines removed since are written next to the list.
+	DiffAgainst string `yaml:"-" json:"-" toml:"-"`
+	// SplitByCountry writes every country's networks to a file of its own
+	// in OutputFilePath, named after its code, such as RU.txt, and removes
+	// the files of countries an earlier run wrote and this one didn't. The
+	// combined list is only written as well with SplitCombined.
+	SplitByCountry bool `yaml:"-" json:"-" toml:"-"`
+	SplitCombined  bool `yaml:"-" json:"-" toml:"-"`
+	// MkdirOutput creates OutputFilePath when it doesn't exist, instead of
+	// failing before anything is downloaded.
+	MkdirOutput bool `yaml:"-" json:"-" toml:"-"`
+	// MMDBPath, when set, is where the binary database of the edition is
+	// saved next to the list. It is downloaded from MMDBURL, which defaults
+	// to MaxMind's URL, and verified against MMDBURL + ".sha256".
+	MMDBPath string `yaml:"-" json:"-" toml:"-"`
+	MMDBURL  string `yaml:"-" json:"-" toml:"-"`
+	// LockFile is held locked for the whole run, so runs sharing it never
+	// overlap. Generate fails with ErrLocked when another run holds it.
+	LockFile string `yaml:"-" json:"-" toml:"-"`
+	// Timeout, Summary, Manifest, MetricsFile, VerifyIP, AllowEmpty,
+	// AllowEmptyOutput, Report, CheckCredentials, LogLevel and LogFormat are
+	// handled by the blgen command, Generate ignores them. Library callers
+	// set Logger instead of the last two.
+	Timeout              time.Duration       `yaml:"-" json:"-" toml:"-"`
+	Summary              bool                `yaml:"-" json:"-" toml:"-"`
+	Manifest             string              `yaml:"-" json:"-" toml:"-"`
+	MetricsFile          string              `yaml:"-" json:"-" toml:"-"`
+	VerifyIP             string              `yaml:"-" json:"-" toml:"-"`
+	AllowEmpty           bool                `yaml:"-" json:"-" toml:"-"`
+	AllowEmptyOutput     bool                `yaml:"-" json:"-" toml:"-"`
+	Report               bool                `yaml:"-" json:"-" toml:"-"`
+	CheckCredentials     bool                `yaml:"-" json:"-" toml:"-"`
+	LogLevel             string              `yaml:"-" json:"-" toml:"-"`
+	LogFormat            string              `yaml:"-" json:"-" toml:"-"`
+	KeepTemp             bool                `yaml:"-" json:"-" toml:"-"`
+	Backup               bool                `yaml:"-" json:"-" toml:"-"`
+	BackupTimestamped    bool                `yaml:"-" json:"-" toml:"-"`
+	Stream               bool                `yaml:"-" json:"-" toml:"-"`
+	Progress             bool                `yaml:"-" json:"-" toml:"-"`
+	TempDir              string              `yaml:"-" json:"-" toml:"-"`
+	Archive              string              `yaml:"-" json:"-" toml:"-"`
+	ZipPath              string              `yaml:"-" json:"-" toml:"-"`
+	SHAPath              string              `yaml:"-" json:"-" toml:"-"`
+	BlockedCountries     map[string]struct{} `yaml:"-" json:"-" toml:"-"`
+	BlockedContinents    map[string]struct{} `yaml:"-" json:"-" toml:"-"`
+	BlockedSubdivisions  map[string]struct{} `yaml:"-" json:"-" toml:"-"`
+	BlockedASNs          map[string]struct{} `yaml:"-" json:"-" toml:"-"`
+	ExcludedCountries    map[string]struct{} `yaml:"-" json:"-" toml:"-"`
+	ExcludedSubdivisions map[string]struct{} `yaml:"-" json:"-" toml:"-"`
+	// FileMode is the permission of the written list. When zero, a replaced
+	// list keeps its permission and a new one gets 0644 less the umask.
+	// FileModeInput, in octal, sets it too.
+	FileMode os.FileMode `yaml:"-" json:"-" toml:"-"`
+	// HTTPClient is used for all downloads, the archive as well as its
+	// SHA256, so a custom transport (mTLS, tracing, a stub) sees every
+	// request. When nil, a client that honors Proxy, ConnectTimeout and
+	// HTTP2 is created.
+	HTTPClient *http.Client `yaml:"-" json:"-" toml:"-"`
+	// Output, when set, receives the list instead of a file, for callers
+	// streaming it elsewhere, such as to an object store. It is written
+	// like stdout, in a single format and without the files that go next
+	// to the list, and is left open. OutputFilename must be empty or
+	// StdoutFilename then.
+	Output io.Writer `yaml:"-" json:"-" toml:"-"`
+	// Logger receives the warnings and progress of the run, and the time
+	// each stage took at debug level. When nil, slog.Default is used.
+	Logger *slog.Logger `yaml:"-" json:"-" toml:"-"`
+
+	progress    *progressReporter
+	limiter     *requestLimiter
+	credentials *credentialPool
+	// databaseDate is the build date of the extracted database, when the
+	// archive names it.
+	databaseDate time.Time
+}
+
+const (
+	// StdoutFilename as the output filename writes the list to stdout.
+	StdoutFilename = "-"
+
+	// DefaultOutputFilename is the output filename used when none is set.
+	DefaultOutputFilename = "BlockedCountriesBlocks.txt"
+
+	// DefaultTimestampFormat is the layout of the header time used when
+	// TimestampFormat is not set.
+	DefaultTimestampFormat = "2006/01/02-15:04"
+
+	// DefaultLocale is the locale of the locations file used when Locale is
+	// not set.
+	DefaultLocale = "en"
+
+	// DefaultUserAgent is the User-Agent header used when UserAgent is not
+	// set.
+	DefaultUserAgent = "maxmind-geolite2-textfile-go"
+
+	// DefaultRetries is the number of attempts for each download used when
+	// Retries is not set.
+	DefaultRetries = 3
+
+	// DefaultConnectTimeout and DefaultDownloadTimeout are used when
+	// ConnectTimeout and DownloadTimeout are not set.
+	DefaultConnectTimeout  = 10 * time.Second
+	DefaultDownloadTimeout = 30 * time.Minute
+
+	// shortRequestTimeout limits the requests that only transfer a few
+	// bytes, the SHA256 and the notifications.
+	shortRequestTimeout = 30 * time.Second
+)
+
+// Values of MapV4ToV6.
+const (
+	MapV4ToV6Also    = "also"
+	MapV4ToV6Instead = "instead"
+)
+
+// Values of ConflictPolicy.
+const (
+	ConflictFirst = "first"
+	ConflictLast  = "last"
+	ConflictError = "error"
+)
+
+// Values of ReportSort.
+const (
+	ReportSortCode  = "code"
+	ReportSortCount = "count"
+	ReportSortSpace = "space"
+)
+
+// Values of Newline.
+const (
+	NewlineLF   = "lf"
+	NewlineCRLF = "crlf"
+)
+
+// Modes, deciding whether the configured codes are blocked or allowed.
+const (
+	ModeBlock = "block"
+	ModeAllow = "allow"
+)
+
+// Prepare fills in the defaults for unset fields and validates the
+// configuration. Generate calls it itself, so calling it beforehand is only
+// needed to report configuration errors early.
+func (cfg *Config) Prepare() error {
+	if cfg.Logger == nil {
+		cfg.Logger = slog.Default()
+	}
+
+	switch cfg.Mode {
+	case "":
+		cfg.Mode = ModeBlock
+	case ModeBlock, ModeAllow:
+	default:
+		return fmt.Errorf("unknown mode %q, expected %q or %q", cfg.Mode, ModeBlock, ModeAllow)
+	}
+
+	if cfg.Output != nil {
+		if cfg.OutputFilename != "" && cfg.OutputFilename != StdoutFilename {
+			return fmt.Errorf("the list goes to the output writer, so no output filename can be set")
+		}
+		cfg.OutputFilename = StdoutFilename
+	}
+	if cfg.OutputFilename == "" {
+		cfg.OutputFilename = DefaultOutputFilename
+	}
+	if strings.HasSuffix(cfg.OutputFilename, ".gz") {
+		cfg.Gzip = true
+	}
+	if cfg.FileModeInput != "" {
+		mode, err := strconv.ParseUint(cfg.FileModeInput, 8, 32)
+		if err != nil || mode > uint64(os.ModePerm) {
+			return fmt.Errorf("invalid file mode %q, expected an octal permission such as 0640", cfg.FileModeInput)
+		}
+		cfg.FileMode = os.FileMode(mode)
+	}
+	if cfg.FileMode&^os.ModePerm != 0 {
+		return fmt.Errorf("file mode %s has bits other than the permission set", cfg.FileMode)
+	}
+
+	if cfg.Format == "" {
+		cfg.Format = FormatPlain
+	}
+	if err := validateFormats(cfg.formats()); err != nil {
+		return err
+	}
+	if len(cfg.formats()) > 1 && cfg.OutputFilename == StdoutFilename {
+		return fmt.Errorf("several output formats can't be written to stdout")
+	}
+	if cfg.Checksum && cfg.OutputFilename == StdoutFilename {
+		return fmt.Errorf("a checksum file can't be written for stdout")
+	}
+	if cfg.DiffAgainst != "" && (cfg.OutputFilename == StdoutFilename || cfg.Gzip || len(cfg.formats()) > 1) {
+		return fmt.Errorf("a diff can only be written for a single uncompressed output file")
+	}
+	if cfg.SplitByCountry && cfg.OutputFilename == StdoutFilename {
+		return fmt.Errorf("per-country files can't be written to stdout")
+	}
+	if cfg.SplitCombined && !cfg.SplitByCountry {
+		return fmt.Errorf("a combined list is only written in addition to per-country files")
+	}
+	if cfg.LowMemory && !cfg.Sort && !cfg.Grouped {
+		return fmt.Errorf("the low memory mode only applies to sorted output, the rest is written as it is scanned")
+	}
+	if cfg.VerboseHeader && cfg.NoHeader {
+		return fmt.Errorf("a verbose header can't be written without a header")
+	}
+	if cfg.Append && cfg.Grouped {
+		return fmt.Errorf("appended networks can't be grouped, they would end up in the last section")
+	}
+	if cfg.Append {
+		if cfg.OutputFilename == StdoutFilename || cfg.Gzip || cfg.SplitByCountry {
+			return fmt.Errorf("networks can only be appended to a single uncompressed output file")
+		}
+		if slices.Contains(cfg.formats(), FormatNginx) {
+			return fmt.Errorf("networks can't be appended to the %s format, whose lines are enclosed in a block", FormatNginx)
+		}
+		if slices.Contains(cfg.formats(), FormatNetsh) {
+			return fmt.Errorf("networks can't be appended to the %s format, whose rules list many networks each", FormatNetsh)
+		}
+		if cfg.AllowDuplicates {
+			return fmt.Errorf("appending leaves out the lines the file already has, so duplicates can't be allowed")
+		}
+	}
+	if cfg.MaxLines < 0 {
+		return fmt.Errorf("max lines must not be negative")
+	}
+	if cfg.MaxLines > 0 {
+		if cfg.OutputFilename == StdoutFilename || cfg.Append || cfg.SplitByCountry || cfg.DiffAgainst != "" {
+			return fmt.Errorf("only a new list written to a file of its own can be split into chunks, not stdout, an appended list, per-country files or a diff")
+		}
+		for _, format := range []string{FormatNginx, FormatNetsh} {
+			if slices.Contains(cfg.formats(), format) {
+				return fmt.Errorf("the %s format can't be split into chunks, its files only work whole", format)
+			}
+		}
+	}
+	if cfg.DiffAgainst != "" && cfg.SplitByCountry && !cfg.SplitCombined {
+		return fmt.Errorf("a diff can only be written for the combined list")
+	}
+	if cfg.TimestampFormat == "" {
+		cfg.TimestampFormat = DefaultTimestampFormat
+	}
+	if strings.ContainsAny(cfg.TimestampFormat, "\r\n") {
+		return fmt.Errorf("the timestamp format must fit on one line")
+	}
+	if cfg.SetName == "" {
+		cfg.SetName = "blocked"
+	}
+	if cfg.UserAgent == "" {
+		cfg.UserAgent = DefaultUserAgent
+	}
+	cfg.NginxVar = strings.TrimPrefix(cfg.NginxVar, "$")
+	if cfg.NginxVar == "" {
+		cfg.NginxVar = "blocked"
+	}
+	if err := validateNginxVariable(cfg.NginxVar); err != nil {
+		return err
+	}
+	if cfg.NetshRulePrefix == "" {
+		cfg.NetshRulePrefix = "blgen"
+	}
+	if err := validateNetshRulePrefix(cfg.NetshRulePrefix); err != nil {
+		return err
+	}
+
+	switch cfg.MapV4ToV6 {
+	case "", MapV4ToV6Also, MapV4ToV6Instead:
+	default:
+		return fmt.Errorf("unknown IPv4 to IPv6 mapping %q, expected %q or %q", cfg.MapV4ToV6, MapV4ToV6Also, MapV4ToV6Instead)
+	}
+
+	switch cfg.ConflictPolicy {
+	case "":
+		cfg.ConflictPolicy = ConflictFirst
+	case ConflictFirst, ConflictLast, ConflictError:
+	default:
+		return fmt.Errorf("unknown conflict policy %q, expected %q, %q or %q", cfg.ConflictPolicy, ConflictFirst, ConflictLast, ConflictError)
+	}
+
+	switch cfg.ReportSort {
+	case "":
+		cfg.ReportSort = ReportSortCode
+	case ReportSortCode, ReportSortCount, ReportSortSpace:
+	default:
+		return fmt.Errorf("unknown report sort %q, expected %q, %q or %q", cfg.ReportSort, ReportSortCode, ReportSortCount, ReportSortSpace)
+	}
+
+	switch cfg.Newline {
+	case "":
+		cfg.Newline = NewlineLF
+	case NewlineLF, NewlineCRLF:
+	default:
+		return fmt.Errorf("unknown newline %q, expected %q or %q", cfg.Newline, NewlineLF, NewlineCRLF)
+	}
+
+	if cfg.MinPrefix < 0 || cfg.MinPrefix > 32 || cfg.MaxPrefix < 0 || cfg.MaxPrefix > 32 {
+		return fmt.Errorf("prefix lengths must be between 0 and 32")
+	}
+	if cfg.MaxPrefix != 0 && cfg.MinPrefix > cfg.MaxPrefix {
+		return fmt.Errorf("the minimum prefix length %d is above the maximum %d", cfg.MinPrefix, cfg.MaxPrefix)
+	}
+	if cfg.MinPrefixV6 < 0 || cfg.MinPrefixV6 > 128 || cfg.MaxPrefixV6 < 0 || cfg.MaxPrefixV6 > 128 {
+		return fmt.Errorf("IPv6 prefix lengths must be between 0 and 128")
+	}
+	if cfg.MaxPrefixV6 != 0 && cfg.MinPrefixV6 > cfg.MaxPrefixV6 {
+		return fmt.Errorf("the minimum IPv6 prefix length %d is above the maximum %d", cfg.MinPrefixV6, cfg.MaxPrefixV6)
+	}
+
+	if cfg.Retries == 0 {
+		cfg.Retries = DefaultRetries
+	}
+	if cfg.Retries < 1 {
+		return fmt.Errorf("retries must be at least 1")
+	}
+	if cfg.ConnectTimeout == 0 {
+		cfg.ConnectTimeout = DefaultConnectTimeout
+	}
+	if cfg.DownloadTimeout == 0 {
+		cfg.DownloadTimeout = DefaultDownloadTimeout
+	}
+	if cfg.ConnectTimeout < 0 || cfg.DownloadTimeout < 0 {
+		return fmt.Errorf("timeouts must not be negative")
+	}
+	if cfg.MaxAgeDays < 0 {
+		return fmt.Errorf("maximum database age must not be negative")
+	}
+	if cfg.DownloadConcurrency < 0 {
+		return fmt.Errorf("download concurrency must not be negative")
+	}
+	if cfg.RequestDelay < 0 {
+		return fmt.Errorf("request delay must not be negative")
+	}
+	if cfg.limiter == nil {
+		cfg.limiter = newRequestLimiter(cfg.RequestDelay)
+	}
+	if cfg.Workers == 0 {
+		cfg.Workers = 1
+	}
+	if cfg.Workers < 1 {
+		return fmt.Errorf("workers must be at least 1")
+	}
+	if cfg.Sample < 0 {
+		return fmt.Errorf("sample rate must not be negative")
+	}
+	if cfg.MaxErrors < 0 {
+		return fmt.Errorf("max errors must not be negative")
+	}
+
+	if cfg.Archive == "" {
+		cfg.Archive = ArchiveZip
+	}
+	if cfg.Archive != ArchiveZip && cfg.Archive != ArchiveTarGz {
+		return fmt.Errorf("unknown archive format %q, expected %q or %q", cfg.Archive, ArchiveZip, ArchiveTarGz)
+	}
+
+	if cfg.Edition == "" {
+		cfg.Edition = EditionCountry
+	}
+	if err := validateEdition(cfg.Edition); err != nil {
+		return err
+	}
+	if cfg.Locale == "" {
+		cfg.Locale = DefaultLocale
+	}
+	if err := validateLocale(cfg.Locale); err != nil {
+		return err
+	}
+	if cfg.Edition == EditionASN && cfg.Locale != DefaultLocale {
+		return fmt.Errorf("the %s edition has no locations file to read in another locale", EditionASN)
+	}
+	if cfg.OnlyRegistered {
+		if cfg.MatchFields != "" && cfg.MatchFields != registeredCountryColumn {
+			return fmt.Errorf("only matching the registered country can't be combined with other match fields")
+		}
+		cfg.MatchFields = registeredCountryColumn
+	}
+	if cfg.MatchFields != "" {
+		if cfg.Edition == EditionASN {
+			return fmt.Errorf("match fields can't be used with the %s edition", EditionASN)
+		}
+		if err := validateMatchFields(cfg.matchFields()); err != nil {
+			return err
+		}
+	}
+	if cfg.AnnotateReason && cfg.Edition == EditionASN {
+		return fmt.Errorf("match reasons can't be annotated with the %s edition", EditionASN)
+	}
+	if cfg.NumericCodes && cfg.Edition == EditionASN {
+		return fmt.Errorf("numeric country codes can't be used with the %s edition", EditionASN)
+	}
+	if (len(cfg.BlockedSubdivisions) > 0 || len(cfg.ExcludedSubdivisions) > 0) && cfg.Edition != EditionCity {
+		return fmt.Errorf("subdivision codes can only be used with the %s edition", EditionCity)
+	}
+	if cfg.BlockedASNs == nil {
+		cfg.BlockedASNs = make(map[string]struct{}, len(cfg.BlockedASNsInput))
+	}
+	for _, value := range cfg.BlockedASNsInput {
+		asn, err := parseASN(value)
+		if err != nil {
+			return err
+		}
+		cfg.BlockedASNs[asn] = struct{}{}
+	}
+	if len(cfg.BlockedASNs) > 0 && cfg.Edition != EditionASN {
+		return fmt.Errorf("ASNs can only be used with the %s edition", EditionASN)
+	}
+	if cfg.Edition == EditionASN && (len(cfg.BlockedCountries) > 0 || len(cfg.BlockedContinents) > 0 || len(cfg.ExcludedCountries) > 0) {
+		return fmt.Errorf("the %s edition has no country or continent data, block ASNs instead", EditionASN)
+	}
+
+	if cfg.DBURL == "" {
+		cfg.DBURL = editionDownloadURL(cfg.edition(), cfg.Archive)
+	}
+	if cfg.SHAURL == "" {
+		cfg.SHAURL = editionDownloadURL(cfg.edition(), cfg.Archive) + ".sha256"
+	}
+	if err := validateHTTPURL(cfg.DBURL); err != nil {
+		return fmt.Errorf("invalid database URL: %w", err)
+	}
+	if err := validateHTTPURL(cfg.SHAURL); err != nil {
+		return fmt.Errorf("invalid SHA URL: %w", err)
+	}
+	if cfg.MMDBPath != "" {
+		if cfg.MMDBURL == "" {
+			cfg.MMDBURL = databaseDownloadURL(mmdbEditionID(cfg.edition()), ArchiveTarGz)
+		}
+		if err := validateHTTPURL(cfg.MMDBURL); err != nil {
+			return fmt.Errorf("invalid mmdb URL: %w", err)
+		}
+	}
+	if cfg.NotifyURL != "" {
+		if err := validateHTTPURL(cfg.NotifyURL); err != nil {
+			return fmt.Errorf("invalid notification URL: %w", err)
+		}
+	}
+
+	if cfg.UseCachedCSV && cfg.CSVDir == "" {
+		return fmt.Errorf("cached CSV files can only be used together with a CSV directory")
+	}
+	if cfg.CSVMaxAge == 0 {
+		cfg.CSVMaxAge = DefaultCSVMaxAge
+	}
+
+	if cfg.SkipSHA && cfg.CacheDir != "" {
+		return fmt.Errorf("the SHA256 check can't be skipped with a cache directory, which relies on it to notice a changed archive")
+	}
+
+	if cfg.Stream && (cfg.ZipPath != "" || cfg.CacheDir != "") {
+		return fmt.Errorf("streaming can't be used together with a local archive or a cache directory")
+	}
+
+	if cfg.SHAPath != "" && cfg.ZipPath == "" {
+		return fmt.Errorf("a local SHA file can only be used together with a local archive")
+	}
+
+	// The files are only read when the credentials themselves aren't set.
+	if cfg.AccountID == "" && cfg.AccountIDFile != "" {
+		accountID, err := readCredentialFile("account ID", cfg.AccountIDFile)
+		if err != nil {
+			return err
+		}
+		cfg.AccountID = accountID
+	}
+	if cfg.LicenseKey == "" && cfg.LicenseKeyFile != "" {
+		licenseKey, err := readCredentialFile("license key", cfg.LicenseKeyFile)
+		if err != nil {
+			return err
+		}
+		cfg.LicenseKey = licenseKey
+	}
+	// The netrc file is the last resort, after the credentials and their
+	// files.
+	needsCredentials := cfg.ZipPath == "" || cfg.MMDBPath != ""
+	if needsCredentials && (cfg.AccountID == "" || cfg.LicenseKey == "") && len(cfg.Credentials) == 0 && cfg.NetrcFile != "" {
+		downloadURL := cfg.DBURL
+		if cfg.ZipPath != "" {
+			downloadURL = cfg.MMDBURL
+		}
+		if err := cfg.netrcCredentials(downloadURL); err != nil {
+			return err
+		}
+	}
+	if cfg.credentials == nil {
+		credentials, err := newCredentialPool(cfg)
+		if err != nil {
+			return err
+		}
+		cfg.credentials = credentials
+	}
+	if needsCredentials && len(cfg.credentials.credentials) == 0 {
+		return fmt.Errorf("account ID and license key are needed to download the database")
+	}
+
+	if cfg.HTTPClient == nil {
+		httpClient, err := newHTTPClient(cfg.Proxy, cfg.ConnectTimeout, cfg.HTTP2)
+		if err != nil {
+			return err
+		}
+		cfg.HTTPClient = httpClient
+	}
+
+	return nil
+}
+
+// readCredentialFile reads the account ID or license key from path, trimming
+// surrounding whitespace such as the trailing newline.
+func readCredentialFile(what, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s file: %w", what, err)
+	}
+	credential := strings.TrimSpace(string(data))
+	if credential == "" {
+		return "", fmt.Errorf("%s file %s is empty", what, path)
+	}
+	return credential, nil
+}
+
+// newHTTPClient returns a client that sends requests through the given proxy,
+// or through the proxy from the environment when none is set. The client has
+// no overall timeout, the requests are limited by their context instead.
+func newHTTPClient(proxy string, connectTimeout time.Duration, http2 bool) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyFromEnvironment
+	transport.DialContext = (&net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}).DialContext
+	if http2 {
+		// HTTP/2 is already tried over TLS, this rules out HTTP/1.1 and
+		// speaks HTTP/2 to http:// URLs as well.
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		transport.Protocols = protocols
+	}
+
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL %q: %w", proxy, err)
+		}
+		switch proxyURL.Scheme {
+		case "http", "https", "socks5":
+		default:
+			return nil, fmt.Errorf("unsupported proxy scheme %q, expected http, https or socks5", proxyURL.Scheme)
+		}
+		if proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q: missing host", proxy)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// prefixListed reports whether network is listed: its prefix length is
+// within the configured limits and, with StripBogons, it isn't in a private
+// or reserved range.
+func (cfg *Config) prefixListed(network netip.Prefix) bool {
+	if cfg.StripBogons && isBogon(network) {
+		return false
+	}
+	bits := network.Bits()
+	if network.Addr().Is6() {
+		return bits >= cfg.MinPrefixV6 && (cfg.MaxPrefixV6 == 0 || bits <= cfg.MaxPrefixV6)
+	}
+	return bits >= cfg.MinPrefix && (cfg.MaxPrefix == 0 || bits <= cfg.MaxPrefix)
+}
+
+// headerTimestamp formats the time of the run for the header.
+func (cfg *Config) headerTimestamp(now time.Time) string {
+	if cfg.TimestampUTC {
+		now = now.UTC()
+	}
+	return now.Format(cfg.TimestampFormat)
+}
+
+// verboseHeader describes how the list was generated, one "key: value" per
+// line, for the header of VerboseHeader.
+func (cfg *Config) verboseHeader(now time.Time) string {
+	lines := []string{}
+	add := func(key, value string) {
+		if value != "" {
+			lines = append(lines, key+": "+value)
+		}
+	}
+	codes := func(set map[string]struct{}) string {
+		return strings.Join(slices.Sorted(maps.Keys(set)), " ")
+	}
+	add("generator", cfg.Generator)
+	add("edition", cfg.edition().id())
+	if !cfg.databaseDate.IsZero() {
+		add("database", cfg.databaseDate.Format(time.DateOnly))
+	}
+	add("mode", cfg.Mode)
+	add("countries", codes(cfg.BlockedCountries))
+	add("continents", codes(cfg.BlockedContinents))
+	add("subdivisions", codes(cfg.BlockedSubdivisions))
+	add("asns", strings.Join(cfg.BlockedASNsInput, " "))
+	add("excluded countries", codes(cfg.ExcludedCountries))
+	add("excluded subdivisions", codes(cfg.ExcludedSubdivisions))
+	add("generated", now.UTC().Format(time.RFC3339))
+	return strings.Join(lines, "\n")
+}
+
+// companionFiles returns the files written next to the list filename, which
+// are moved into place right after it.
+func (cfg *Config) companionFiles(filename string) []string {
+	var files []string
+	if cfg.Checksum {
+		files = append(files, filename+checksumSuffix)
+	}
+	if cfg.DiffAgainst != "" {
+		files = append(files, filename+addedSuffix, filename+removedSuffix)
+	}
+	return files
+}
+
+// formats returns the output formats listed in Format.
+func (cfg *Config) formats() []string {
+	formats := strings.Split(cfg.Format, ",")
+	for i, format := range formats {
+		formats[i] = strings.TrimSpace(format)
+	}
+	return formats
+}
+
+// matchFields returns the geoname columns listed in MatchFields, or all of
+// them when it is empty.
+func (cfg *Config) matchFields() []string {
+	if cfg.MatchFields == "" {
+		return geonameColumns
+	}
+	fields := strings.Split(cfg.MatchFields, ",")
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+	}
+	return fields
+}
+
+// outputFilename returns the name of the file the format is written to. A
+// single format is written to OutputFilename, several formats replace its
+// extension with their own, keeping a .gz suffix.
+func (cfg *Config) outputFilename(format string) string {
+	if len(cfg.formats()) == 1 {
+		return cfg.OutputFilename
+	}
+	name, gzipped := strings.CutSuffix(cfg.OutputFilename, ".gz")
+	name = strings.TrimSuffix(name, filepath.Ext(name)) + formatExtensions[format]
+	if gzipped {
+		name += ".gz"
+	}
+	return name
+}
+
+func validateHTTPURL(rawURL string) error {
+	downloadURL, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if downloadURL.Scheme != "http" && downloadURL.Scheme != "https" {
+		return fmt.Errorf("%q must use http or https", rawURL)
+	}
+	if downloadURL.Host == "" {
+		return fmt.Errorf("%q has no host", rawURL)
+	}
+	return nil
+}
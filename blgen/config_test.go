@@ -0,0 +1,119 @@
+package blgen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/netip"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	target, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The proxy stub forwards the requests for download.example to the
+	// test server.
+	var proxied atomic.Int32
+	forward := httputil.NewSingleHostReverseProxy(target)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Host != "download.example" {
+			http.Error(w, "unexpected host "+r.URL.Host, http.StatusBadGateway)
+			return
+		}
+		proxied.Add(1)
+		forward.ServeHTTP(w, r)
+	}))
+	t.Cleanup(proxy.Close)
+
+	cfg := server.config(t)
+	cfg.DBURL = "http://download.example/db.zip"
+	cfg.SHAURL = "http://download.example/db.zip.sha256"
+	cfg.Proxy = proxy.URL
+	result := generate(t, cfg)
+	if result.NetworksWritten != 4 {
+		t.Errorf("%d networks written through the proxy, want 4", result.NetworksWritten)
+	}
+	if proxied.Load() != 2 || len(server.requested()) != 2 {
+		t.Errorf("%d requests proxied and %d served, want the archive and its checksum", proxied.Load(), len(server.requested()))
+	}
+}
+
+func TestProxyValidated(t *testing.T) {
+	tests := []struct {
+		proxy string
+		valid bool
+	}{
+		{"", true},
+		{"http://proxy.example:3128", true},
+		{"https://proxy.example", true},
+		{"socks5://127.0.0.1:1080", true},
+		{"ftp://proxy.example", false},
+		{"http://", false},
+		{"proxy.example:3128", false},
+	}
+	for _, test := range tests {
+		if _, err := newHTTPClient(test.proxy, 0, false); (err == nil) != test.valid {
+			t.Errorf("newHTTPClient(%q): %v", test.proxy, err)
+		}
+	}
+}
+
+func TestPrefixListed(t *testing.T) {
+	cfg := Config{MinPrefix: 16, MaxPrefix: 24, MinPrefixV6: 32, MaxPrefixV6: 48}
+	tests := []struct {
+		network string
+		want    bool
+	}{
+		{"5.0.0.0/8", false},
+		{"5.1.0.0/16", true},
+		{"5.1.2.0/24", true},
+		{"5.1.2.3/32", false},
+		{"2001::/16", false},
+		{"2001:db8::/32", true},
+		{"2001:db8:1::/48", true},
+		{"2001:db8:1:2::/64", false},
+		{"2001:db8::1/128", false},
+	}
+	for _, test := range tests {
+		if got := cfg.prefixListed(netip.MustParsePrefix(test.network)); got != test.want {
+			t.Errorf("prefixListed(%s) = %t, want %t", test.network, got, test.want)
+		}
+	}
+}
+
+func TestPrefixListedNoLimits(t *testing.T) {
+	var cfg Config
+	for _, network := range []string{"0.0.0.0/0", "5.1.2.3/32", "::/0", "2001:db8::1/128"} {
+		if !cfg.prefixListed(netip.MustParsePrefix(network)) {
+			t.Errorf("prefixListed(%s) = false without limits", network)
+		}
+	}
+}
+
+func TestPrefixLimitsValidated(t *testing.T) {
+	tests := []struct {
+		cfg   Config
+		valid bool
+	}{
+		{Config{MinPrefix: 8, MaxPrefix: 24, MinPrefixV6: 19, MaxPrefixV6: 48}, true},
+		{Config{MaxPrefix: 32, MaxPrefixV6: 128}, true},
+		{Config{MaxPrefix: 33}, false},
+		{Config{MinPrefix: 24, MaxPrefix: 16}, false},
+		{Config{MaxPrefixV6: 129}, false},
+		{Config{MinPrefixV6: -1}, false},
+		{Config{MinPrefixV6: 64, MaxPrefixV6: 48}, false},
+	}
+	for _, test := range tests {
+		cfg := test.cfg
+		cfg.BlockedCountries = map[string]struct{}{"RU": {}}
+		cfg.ZipPath = "GeoLite2-Country-CSV.zip"
+		if err := cfg.Prepare(); (err == nil) != test.valid {
+			t.Errorf("Prepare with prefix limits %d-%d and %d-%d: %v", cfg.MinPrefix, cfg.MaxPrefix, cfg.MinPrefixV6, cfg.MaxPrefixV6, err)
+		}
+	}
+}
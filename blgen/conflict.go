@@ -0,0 +1,90 @@
+package blgen
+
+import (
+	"fmt"
+	"net/netip"
+)
+
+// networkConflicts applies the ConflictPolicy to networks listed under more
+// than one label, such as a network located in one country and registered to
+// another appearing twice. It is nil for ConflictFirst, which writes every
+// network as it comes rather than keep the label of each in memory. When the
+// networks are collected before they are written, they are recorded as they
+// are scanned and only those the policy keeps are written.
+type networkConflicts struct {
+	policy string
+	labels map[netip.Prefix]string
+	// pending holds the networks in the order they were listed, for
+	// ConflictLast, which only knows the label to keep once all of them are
+	// in.
+	pending []conflictEntry
+	count   int
+}
+
+type conflictEntry struct {
+	network netip.Prefix
+	country geoname
+}
+
+func newNetworkConflicts(policy string) *networkConflicts {
+	if policy == ConflictFirst {
+		return nil
+	}
+	return &networkConflicts{policy: policy, labels: map[netip.Prefix]string{}}
+}
+
+// record notes that network is listed under country, counting a conflict
+// with the label it was listed under before. With ConflictError the conflict
+// fails the run.
+func (c *networkConflicts) record(network netip.Prefix, country geoname) error {
+	if c == nil {
+		return nil
+	}
+	previous, seen := c.labels[network]
+	if seen && previous != country.label {
+		c.count++
+		if c.policy == ConflictError {
+			return fmt.Errorf("network %s is listed as both %s and %s", network, previous, country.label)
+		}
+	}
+	if !seen || c.policy == ConflictLast {
+		c.labels[network] = country.label
+	}
+	return nil
+}
+
+// add records network under country and reports whether it is written now.
+// With ConflictLast nothing is, flush writes the networks instead.
+func (c *networkConflicts) add(network netip.Prefix, country geoname) (bool, error) {
+	if c == nil {
+		return true, nil
+	}
+	if err := c.record(network, country); err != nil {
+		return false, err
+	}
+	if c.policy == ConflictLast {
+		c.pending = append(c.pending, conflictEntry{network, country})
+		return false, nil
+	}
+	return true, nil
+}
+
+// keeps reports whether network is written under country once every network
+// was recorded. With ConflictLast only the label it was last listed with is.
+func (c *networkConflicts) keeps(network netip.Prefix, country geoname) bool {
+	return c == nil || c.labels[network] == country.label
+}
+
+// flush writes the networks held back for ConflictLast under the label they
+// were last listed with.
+func (c *networkConflicts) flush(write func(network netip.Prefix, country geoname)) {
+	if c == nil {
+		return
+	}
+	for _, entry := range c.pending {
+		if c.keeps(entry.network, entry.country) {
+			write(entry.network, entry.country)
+		}
+	}
+	c.pending = nil
+}
@@ -0,0 +1,89 @@
+package blgen
+
+import (
+	"slices"
+	"testing"
+)
+
+// conflictBlocks lists 5.1.0.0/16 under RU first and DE second.
+const conflictBlocks = testBlocksHeader + `5.1.0.0/16,2017370,2017370,,0,0,
+2.56.8.0/24,2017370,2017370,,0,0,
+5.1.0.0/16,2921044,2921044,,0,0,
+`
+
+func TestConflictPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{ConflictFirst, []string{"5.1.0.0/16 ; RU", "2.56.8.0/24 ; RU", "5.1.0.0/16 ; DE"}},
+		{ConflictLast, []string{"2.56.8.0/24 ; RU", "5.1.0.0/16 ; DE"}},
+	}
+	archive := countryArchive(t, conflictBlocks)
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.BlockedCountries = codes("RU", "DE")
+		cfg.ConflictPolicy = test.policy
+		result := generate(t, cfg)
+		if got := listLines(t, result.OutputPath); !slices.Equal(got, test.want) {
+			t.Errorf("%s: got %q, want %q", test.policy, got, test.want)
+		}
+	}
+
+	cfg := testConfig(t, archive)
+	cfg.BlockedCountries = codes("RU", "DE")
+	cfg.ConflictPolicy = ConflictError
+	if _, err := Generate(t.Context(), cfg); err == nil {
+		t.Errorf("%s: conflicting network accepted", ConflictError)
+	}
+}
+
+func TestConflictFirstTracksNothing(t *testing.T) {
+	if conflicts := newNetworkConflicts(ConflictFirst); conflicts != nil {
+		t.Errorf("%s keeps a tracker", ConflictFirst)
+	}
+	for _, policy := range []string{ConflictLast, ConflictError} {
+		if conflicts := newNetworkConflicts(policy); conflicts == nil || conflicts.labels == nil {
+			t.Errorf("%s doesn't track the labels", policy)
+		}
+	}
+}
+
+// The last label is that of the blocks file, also when the networks are
+// sorted or grouped by label before they are written.
+func TestConflictLastGrouped(t *testing.T) {
+	archive := countryArchive(t, conflictBlocks)
+	for _, lowMemory := range []bool{false, true} {
+		cfg := testConfig(t, archive)
+		cfg.BlockedCountries = codes("RU", "DE")
+		cfg.ConflictPolicy = ConflictLast
+		cfg.Format = FormatCIDR
+		cfg.Grouped = true
+		cfg.LowMemory = lowMemory
+		want := []string{"# --- DE ---", "5.1.0.0/16", "# --- RU ---", "2.56.8.0/24"}
+		if got := sectionLines(t, generate(t, cfg).OutputPath); !slices.Equal(got, want) {
+			t.Errorf("low memory %t: got %q, want %q", lowMemory, got, want)
+		}
+
+		// Each chunk starts with the heading of its first network.
+		cfg.NoHeader = true
+		cfg.MaxLines = 2
+		result := generate(t, cfg)
+		var chunks [][]string
+		for _, path := range result.OutputPaths {
+			chunks = append(chunks, sectionLines(t, path))
+		}
+		wantChunks := [][]string{{"# --- DE ---", "5.1.0.0/16"}, {"# --- RU ---", "2.56.8.0/24"}}
+		if !slices.EqualFunc(chunks, wantChunks, slices.Equal) {
+			t.Errorf("low memory %t: got chunks %q, want %q", lowMemory, chunks, wantChunks)
+		}
+	}
+
+	cfg := testConfig(t, archive)
+	cfg.BlockedCountries = codes("RU", "DE")
+	cfg.ConflictPolicy = ConflictLast
+	cfg.Sort = true
+	if got, want := listLines(t, generate(t, cfg).OutputPath), []string{"5.1.0.0/16 ; DE", "2.56.8.0/24 ; RU"}; !slices.Equal(got, want) {
+		t.Errorf("sorted: got %q, want %q", got, want)
+	}
+}
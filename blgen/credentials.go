@@ -0,0 +1,108 @@
+package blgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// ErrCredentialsRejected is wrapped by the error of a request the server
+// answered with a 401 or 403 status, once there is no other credential left
+// to try.
+var ErrCredentialsRejected = errors.New("the account ID or license key was rejected")
+
+// Credential is a MaxMind account ID and its license key.
+type Credential struct {
+	AccountID  string `yaml:"account_id" json:"account_id" toml:"account_id"`
+	LicenseKey string `yaml:"license_key" json:"license_key" toml:"license_key"`
+}
+
+// CheckCredentials makes sure the server accepts the configured credentials
+// by fetching the SHA256 file of the database, which is a few bytes, without
+// downloading the database itself. With SkipSHA, only the first byte of the
+// database is requested instead.
+func CheckCredentials(ctx context.Context, cfg Config) error {
+	if err := cfg.Prepare(); err != nil {
+		return &StageError{Stage: "config", Err: err}
+	}
+	if len(cfg.credentials.credentials) == 0 {
+		return &StageError{Stage: "config", Err: fmt.Errorf("no credentials to check")}
+	}
+
+	what, url, header := "sha", cfg.SHAURL, http.Header{}
+	if cfg.SkipSHA {
+		what, url = cfg.Archive, cfg.DBURL
+		header.Set("Range", "bytes=0-0")
+	}
+	return cfg.runStage("check", url, func() error {
+		return fetch(ctx, what, url, &cfg, header, shortRequestTimeout, func(*http.Response) error {
+			return nil
+		})
+	})
+}
+
+// credentialFailover is returned by fetchOnce when the server rejected or
+// rate limited the credential and the next one is to be tried right away.
+type credentialFailover struct {
+	err error
+}
+
+func (e *credentialFailover) Error() string {
+	return e.err.Error()
+}
+
+func (e *credentialFailover) Unwrap() error {
+	return e.err
+}
+
+// credentialPool holds the credentials the downloads try in order. Once one
+// is rejected, the rest of the run uses the next, so the downloads of a run
+// share the pool.
+type credentialPool struct {
+	mu          sync.Mutex
+	credentials []Credential
+	current     int
+}
+
+// newCredentialPool returns the pool of AccountID and LicenseKey followed by
+// Credentials. An entry missing either half is an error.
+func newCredentialPool(cfg *Config) (*credentialPool, error) {
+	pool := &credentialPool{}
+	if cfg.AccountID != "" && cfg.LicenseKey != "" {
+		pool.credentials = append(pool.credentials, Credential{cfg.AccountID, cfg.LicenseKey})
+	}
+	for i, credential := range cfg.Credentials {
+		if credential.AccountID == "" || credential.LicenseKey == "" {
+			return nil, fmt.Errorf("credential %d needs both an account ID and a license key", i+1)
+		}
+		pool.credentials = append(pool.credentials, credential)
+	}
+	return pool, nil
+}
+
+// get returns the credential to use and its index in the pool.
+func (p *credentialPool) get() (Credential, int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.credentials) == 0 {
+		return Credential{}, 0
+	}
+	return p.credentials[p.current], p.current
+}
+
+// failover moves on from the credential at index, unless a concurrent
+// download did already, and reports whether there is another one to try.
+func (p *credentialPool) failover(index int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index != p.current {
+		return true
+	}
+	if p.current+1 >= len(p.credentials) {
+		return false
+	}
+	p.current++
+	return true
+}
@@ -0,0 +1,122 @@
+package blgen
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCredentialFiles(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	dir := t.TempDir()
+	idFile, keyFile := filepath.Join(dir, "account_id"), filepath.Join(dir, "license_key")
+	if err := os.WriteFile(idFile, []byte("1234\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, []byte("  key\r\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := server.config(t)
+	cfg.AccountID, cfg.LicenseKey = "", ""
+	cfg.AccountIDFile, cfg.LicenseKeyFile = idFile, keyFile
+	generate(t, cfg)
+	for _, r := range server.requested() {
+		if accountID, licenseKey, _ := r.BasicAuth(); accountID != "1234" || licenseKey != "key" {
+			t.Errorf("%s requested as %q with %q, want 1234 with key", r.URL.Path, accountID, licenseKey)
+		}
+	}
+
+	// A key given directly wins over its file.
+	cfg = server.config(t)
+	cfg.LicenseKeyFile = filepath.Join(dir, "missing")
+	if err := cfg.Prepare(); err != nil || cfg.LicenseKey != "key" {
+		t.Errorf("got license key %q: %v, want the one given", cfg.LicenseKey, err)
+	}
+}
+
+func TestCredentialFailover(t *testing.T) {
+	fastRetries(t)
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	server.accepted["5678"] = "other"
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if accountID, _, _ := r.BasicAuth(); accountID == "1234" {
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return true
+		}
+		return false
+	}
+	cfg := server.config(t)
+	cfg.AccountID, cfg.LicenseKey = "", ""
+	cfg.Credentials = []Credential{{"1234", "key"}, {"5678", "other"}}
+	var log bytes.Buffer
+	cfg.Logger = slog.New(slog.NewTextHandler(&log, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	if result := generate(t, cfg); result.NetworksWritten != 4 {
+		t.Errorf("%d networks written, want 4", result.NetworksWritten)
+	}
+
+	var accounts []string
+	for _, r := range server.requested() {
+		accountID, _, _ := r.BasicAuth()
+		accounts = append(accounts, r.URL.Path+" "+accountID)
+	}
+	want := []string{"/db.zip 1234", "/db.zip 5678", "/db.zip.sha256 5678"}
+	if !slices.Equal(accounts, want) {
+		t.Errorf("requested %q, want %q", accounts, want)
+	}
+	succeeded := func(line string) bool {
+		return strings.Contains(line, "msg=response") && strings.Contains(line, "status=200") && strings.Contains(line, "account_id=5678")
+	}
+	if !slices.ContainsFunc(strings.Split(log.String(), "\n"), succeeded) {
+		t.Errorf("credential that succeeded not logged: %s", log.String())
+	}
+
+	// Once every credential is rejected, the run fails.
+	cfg = server.config(t)
+	cfg.AccountID, cfg.LicenseKey = "", ""
+	cfg.Credentials = []Credential{{"1234", "key"}, {"5678", "wrong"}}
+	if _, err := Generate(t.Context(), cfg); !errors.Is(err, ErrCredentialsRejected) {
+		t.Errorf("got %v, want %v", err, ErrCredentialsRejected)
+	}
+}
+
+func TestCheckCredentials(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	cfg := server.config(t)
+	if err := CheckCredentials(t.Context(), cfg); err != nil {
+		t.Errorf("accepted credentials: %v", err)
+	}
+
+	cfg.LicenseKey = "wrong"
+	err := CheckCredentials(t.Context(), cfg)
+	if !errors.Is(err, ErrCredentialsRejected) {
+		t.Errorf("rejected credentials: got %v, want %v", err, ErrCredentialsRejected)
+	}
+
+	for _, r := range server.requested() {
+		if r.URL.Path != "/db.zip.sha256" {
+			t.Errorf("checking the credentials requested %s", r.URL.Path)
+		}
+	}
+	if n := len(server.requested()); n != 2 {
+		t.Errorf("got %d requests, want one per check", n)
+	}
+}
+
+func TestCheckCredentialsSkipSHA(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	cfg := server.config(t)
+	cfg.SkipSHA = true
+	if err := CheckCredentials(t.Context(), cfg); err != nil {
+		t.Fatal(err)
+	}
+	requests := server.requested()
+	if len(requests) != 1 || requests[0].URL.Path != "/db.zip" || requests[0].Header.Get("Range") != "bytes=0-0" {
+		t.Errorf("checking without the SHA file requested %v", requests)
+	}
+}
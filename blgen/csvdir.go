@@ -0,0 +1,102 @@
+package blgen
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultCSVMaxAge is how long the CSV files in CSVDir are reused when
+// CSVMaxAge is not set. MaxMind publishes new GeoLite2 builds twice a week.
+const DefaultCSVMaxAge = 24 * time.Hour
+
+// csvStampPath is the file recording that the CSV files of the edition were
+// extracted into CSVDir in full. It holds the name of the directory they
+// came from in the archive, which dates the database, and its modification
+// time is when they were extracted.
+func csvStampPath(cfg *Config) string {
+	return filepath.Join(cfg.CSVDir, cfg.edition().id()+".extracted")
+}
+
+// useCachedCSV links the CSV files of the edition into tmpDir from CSVDir
+// when they were extracted there less than CSVMaxAge ago, and reports
+// whether it did. Otherwise the database is downloaded as usual.
+func useCachedCSV(tmpDir string, cfg *Config) (bool, error) {
+	stampPath := csvStampPath(cfg)
+	stampInfo, err := os.Stat(stampPath)
+	if err != nil {
+		cfg.Logger.Info("no CSV files to reuse, downloading the database", "path", cfg.CSVDir)
+		return false, nil
+	}
+	if age := time.Since(stampInfo.ModTime()); age > cfg.CSVMaxAge {
+		cfg.Logger.Info("CSV files are too old to reuse, downloading the database", "path", cfg.CSVDir, "age", age.Round(time.Second))
+		return false, nil
+	}
+	archiveDir, err := os.ReadFile(stampPath)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", stampPath, err)
+	}
+	for _, file := range cfg.edition().csvFiles() {
+		if _, err := os.Stat(filepath.Join(cfg.CSVDir, file.name)); err != nil {
+			cfg.Logger.Info("CSV files to reuse are incomplete, downloading the database", "path", cfg.CSVDir, "missing", file.name)
+			return false, nil
+		}
+	}
+	if err := linkCSVFiles(cfg.CSVDir, tmpDir, cfg.edition().csvFiles()); err != nil {
+		return false, err
+	}
+	cfg.Logger.Info("reusing CSV files", "path", cfg.CSVDir, "extracted", stampInfo.ModTime().Format(time.RFC3339))
+
+	cfg.databaseDate = archiveBuildDate(strings.TrimSpace(string(archiveDir)) + "/")
+	return true, checkDatabaseAge(cfg, time.Now())
+}
+
+// finishCSVDir records the extraction into CSVDir as complete and links the
+// extracted files into tmpDir, where the list is built from.
+func finishCSVDir(tmpDir, archiveDir string, cfg *Config) error {
+	stampPath := csvStampPath(cfg)
+	if err := os.WriteFile(stampPath, []byte(archiveDir+"\n"), 0o644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", stampPath, err)
+	}
+	return linkCSVFiles(cfg.CSVDir, tmpDir, cfg.edition().csvFiles())
+}
+
+// linkCSVFiles hard links the files from csvDir into tmpDir, or copies them
+// when they are on different file systems.
+func linkCSVFiles(csvDir, tmpDir string, files []csvFile) error {
+	for _, file := range files {
+		source := filepath.Join(csvDir, file.name)
+		destination := filepath.Join(tmpDir, file.name)
+		if err := os.Link(source, destination); err == nil {
+			continue
+		}
+		if err := copyFile(source, destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(source, destination string) error {
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", source, err)
+	}
+	defer sourceFile.Close()
+
+	destinationFile, err := os.Create(destination)
+	if err != nil {
+		return fmt.Errorf("failed to create file %s: %w", destination, err)
+	}
+	if _, err := io.Copy(destinationFile, sourceFile); err != nil {
+		destinationFile.Close()
+		return fmt.Errorf("failed to copy %s to %s: %w", source, destination, err)
+	}
+	if err := destinationFile.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package blgen
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestUseCachedCSV(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	csvDir := t.TempDir()
+	want := []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}
+
+	// The first run downloads the database and keeps the CSV files.
+	cfg := server.config(t)
+	cfg.CSVDir = csvDir
+	cfg.UseCachedCSV = true
+	generate(t, cfg)
+	if len(server.requested()) == 0 {
+		t.Fatal("nothing downloaded without CSV files to reuse")
+	}
+
+	// The second run reuses them without a single request.
+	cfg = server.config(t)
+	cfg.CSVDir = csvDir
+	cfg.UseCachedCSV = true
+	cfg.HTTPClient = noHTTPClient(t)
+	result := generate(t, cfg)
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if result.DatabaseDate != time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("database date %v, want that of the archive the files came from", result.DatabaseDate)
+	}
+
+	// Files older than the limit are downloaded again.
+	old := time.Now().Add(-2 * DefaultCSVMaxAge)
+	if err := os.Chtimes(filepath.Join(csvDir, "GeoLite2-Country-CSV.extracted"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	requests := len(server.requested())
+	cfg = server.config(t)
+	cfg.CSVDir = csvDir
+	cfg.UseCachedCSV = true
+	generate(t, cfg)
+	if len(server.requested()) == requests {
+		t.Error("stale CSV files reused")
+	}
+}
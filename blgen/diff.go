@@ -0,0 +1,96 @@
+package blgen
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// addedSuffix and removedSuffix are appended to the output filename to
+	// name the files -diff-against writes.
+	addedSuffix   = ".added"
+	removedSuffix = ".removed"
+)
+
+// writeDiff compares the list written to filename in tmpDir with the
+// previous list at cfg.DiffAgainst, and writes the lines only the new list
+// has and the lines only the previous list has next to it. A missing
+// previous list counts as empty, so on the first run every line is added.
+func writeDiff(tmpDir, filename string, cfg *Config) error {
+	current, err := readListLines(filepath.Join(tmpDir, filename))
+	if err != nil {
+		return err
+	}
+	previous, err := readListLines(cfg.DiffAgainst)
+	if errors.Is(err, os.ErrNotExist) {
+		previous = nil
+	} else if err != nil {
+		return err
+	}
+
+	if err := writeLinesMissingFrom(filepath.Join(tmpDir, filename+addedSuffix), current, previous, cfg); err != nil {
+		return err
+	}
+	return writeLinesMissingFrom(filepath.Join(tmpDir, filename+removedSuffix), previous, current, cfg)
+}
+
+// readListLines returns the lines of a list in order, without the comments.
+func readListLines(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "REM ") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return lines, nil
+}
+
+// writeLinesMissingFrom writes the lines that aren't in other to path, in
+// their order, with the line endings of the list.
+func writeLinesMissingFrom(path string, lines, other []string, cfg *Config) error {
+	otherSet := make(map[string]struct{}, len(other))
+	for _, line := range other {
+		otherSet[line] = struct{}{}
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", path, err)
+	}
+	defer file.Close()
+
+	data := bufio.NewWriter(file)
+	var w io.Writer = data
+	if cfg.Newline == NewlineCRLF {
+		w = &crlfWriter{w: data}
+	}
+	for _, line := range lines {
+		if _, found := otherSet[line]; !found {
+			fmt.Fprintln(w, line)
+		}
+	}
+	if err := data.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", path, err)
+	}
+	return nil
+}
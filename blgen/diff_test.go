@@ -0,0 +1,35 @@
+package blgen
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestDiffAgainst(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	previous := filepath.Join(t.TempDir(), "previous.txt")
+	if err := os.WriteFile(previous, []byte("# list generated 2025/12/01-04:00 in block mode\n2.56.8.0/24 ; RU\n5.5.5.0/24 ; RU\n2.56.9.0/24 ; DE\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		previous       string
+		added, removed []string
+	}{
+		{previous, []string{"2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}, []string{"5.5.5.0/24 ; RU", "2.56.9.0/24 ; DE"}},
+		// On the first run everything is added.
+		{filepath.Join(t.TempDir(), "missing.txt"), []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}, nil},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.DiffAgainst = test.previous
+		result := generate(t, cfg)
+		if got := listLines(t, result.OutputPath+addedSuffix); !slices.Equal(got, test.added) {
+			t.Errorf("against %s: added %q, want %q", test.previous, got, test.added)
+		}
+		if got := listLines(t, result.OutputPath+removedSuffix); !slices.Equal(got, test.removed) {
+			t.Errorf("against %s: removed %q, want %q", test.previous, got, test.removed)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package blgen
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// archiveDownload describes the result of downloadArchive. When the request
+// was conditional and the server answered 304 Not Modified, notModified is set
+// and nothing was written. resumed is set when the archive was completed from
+// a partial download.
+type archiveDownload struct {
+	path         string
+	sha256       string
+	etag         string
+	lastModified string
+	notModified  bool
+	resumed      bool
+}
+
+// downloadArchive downloads the archive into destinationDir. With resume, a
+// partial download left by an earlier attempt or run is continued with a
+// range request instead of starting over, unless the server sends the whole
+// archive anyway.
+func downloadArchive(ctx context.Context, destinationDir string, cfg *Config, header http.Header, resume bool) (*archiveDownload, error) {
+	archiveFilename := editionArchiveFilename(cfg.edition(), cfg.Archive)
+	tmpArchivePath := filepath.Join(destinationDir, archiveFilename+".tmp")
+
+	header = header.Clone()
+	if header == nil {
+		header = http.Header{}
+	}
+	// setRange asks for the rest of the partial download, if there is one.
+	setRange := func() {
+		header.Del("Range")
+		if info, err := os.Stat(tmpArchivePath); resume && err == nil && info.Size() > 0 {
+			header.Set("Range", fmt.Sprintf("bytes=%d-", info.Size()))
+		}
+	}
+	setRange()
+
+	download := &archiveDownload{path: filepath.Join(destinationDir, archiveFilename)}
+	err := fetch(ctx, cfg.Archive, cfg.DBURL, cfg, header, cfg.DownloadTimeout, func(httpResponse *http.Response) error {
+		if httpResponse.StatusCode == http.StatusNotModified {
+			download.notModified = true
+			return nil
+		}
+		if httpResponse.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			// The partial download doesn't fit the archive on the server,
+			// so start over.
+			os.Remove(tmpArchivePath)
+			setRange()
+			return &retryableError{err: fmt.Errorf("%s can't be resumed", cfg.Archive)}
+		}
+
+		flags := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+		var offset int64
+		if httpResponse.StatusCode == http.StatusPartialContent {
+			offset = rangeStart(header.Get("Range"))
+			if start := rangeStart(httpResponse.Header.Get("Content-Range")); start != offset || offset == 0 {
+				os.Remove(tmpArchivePath)
+				setRange()
+				return &retryableError{err: fmt.Errorf("%s resumed at the wrong offset", cfg.Archive)}
+			}
+			flags = os.O_RDWR | os.O_APPEND
+			cfg.Logger.Info("resuming download", "archive", cfg.Archive, "offset", offset)
+		}
+
+		tmpArchiveFile, err := os.OpenFile(tmpArchivePath, flags, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to create temp file: %w", err)
+		}
+
+		// The hash covers the partial download as well.
+		sha256Hash := sha256.New()
+		if _, err := io.CopyN(sha256Hash, tmpArchiveFile, offset); err != nil {
+			tmpArchiveFile.Close()
+			return fmt.Errorf("failed to hash partial download: %w", err)
+		}
+		body := cfg.progress.wrapDownload(httpResponse.Body, cfg.Archive, httpResponse.ContentLength)
+		tee := io.TeeReader(body, sha256Hash)
+		received, err := io.Copy(tmpArchiveFile, tee)
+		if err := checkTruncated(cfg.Archive, httpResponse, received, err); err != nil {
+			tmpArchiveFile.Close()
+			setRange()
+			return err
+		}
+		if err != nil {
+			tmpArchiveFile.Close()
+			setRange()
+			return &retryableError{err: fmt.Errorf("failed to write file: %w", err)}
+		}
+
+		if err := tmpArchiveFile.Close(); err != nil {
+			return fmt.Errorf("failed to close tmp file: %w", err)
+		}
+
+		download.sha256 = hex.EncodeToString(sha256Hash.Sum(nil))
+		download.etag = httpResponse.Header.Get("ETag")
+		download.lastModified = httpResponse.Header.Get("Last-Modified")
+		download.resumed = offset > 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if download.notModified {
+		return download, nil
+	}
+
+	if err := os.Rename(tmpArchivePath, download.path); err != nil {
+		return nil, fmt.Errorf("failed to rename temp file: %w", err)
+	}
+
+	return download, nil
+}
+
+// checkTruncated returns a retryable error when the body of httpResponse
+// ended before the length it announced, after received bytes and with the
+// error the read ended with. The HTTP client usually reports that as an
+// unexpected EOF, which is easily mistaken for a broken archive.
+func checkTruncated(what string, httpResponse *http.Response, received int64, err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) || (err == nil && httpResponse.ContentLength >= 0 && received != httpResponse.ContentLength) {
+		return &retryableError{err: fmt.Errorf("%s download truncated: received %d of %d bytes", what, received, httpResponse.ContentLength)}
+	}
+	return nil
+}
+
+// rangeStart returns the first byte of a Range ("bytes=100-") or
+// Content-Range ("bytes 100-199/200") header, or -1 if it has none.
+func rangeStart(value string) int64 {
+	value, ok := strings.CutPrefix(value, "bytes")
+	if !ok || value == "" || (value[0] != '=' && value[0] != ' ') {
+		return -1
+	}
+	value, _, ok = strings.Cut(value[1:], "-")
+	if !ok {
+		return -1
+	}
+	start, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+// downloadArchiveData downloads the archive into memory and returns it with
+// its SHA256.
+func downloadArchiveData(ctx context.Context, cfg *Config) ([]byte, string, error) {
+	var data []byte
+	var actualSHA string
+	err := fetch(ctx, cfg.Archive, cfg.DBURL, cfg, nil, cfg.DownloadTimeout, func(httpResponse *http.Response) error {
+		sha256Hash := sha256.New()
+		var err error
+		body := cfg.progress.wrapDownload(httpResponse.Body, cfg.Archive, httpResponse.ContentLength)
+		data, err = io.ReadAll(io.TeeReader(body, sha256Hash))
+		if err := checkTruncated(cfg.Archive, httpResponse, int64(len(data)), err); err != nil {
+			return err
+		}
+		if err != nil {
+			return &retryableError{err: fmt.Errorf("failed to read %s: %w", cfg.Archive, err)}
+		}
+		actualSHA = hex.EncodeToString(sha256Hash.Sum(nil))
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return data, actualSHA, nil
+}
+
+func verifySHA256(ctx context.Context, actualSHA string, cfg *Config) error {
+	if cfg.SkipSHA {
+		cfg.Logger.Warn("skipping the SHA256 verification, the downloaded archive is used unchecked", "url", cfg.DBURL, "sha256", actualSHA)
+		return nil
+	}
+	var shaData []byte
+	err := fetch(ctx, "sha", cfg.SHAURL, cfg, nil, shortRequestTimeout, func(httpResponse *http.Response) error {
+		httpResponseBodyMaxRead := io.LimitReader(httpResponse.Body, 1024)
+		var err error
+		shaData, err = io.ReadAll(httpResponseBodyMaxRead)
+		if err != nil {
+			return &retryableError{err: fmt.Errorf("failed to read sha data: %w", err)}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return compareSHA256(actualSHA, shaData)
+}
+
+func compareSHA256(actualSHA string, shaData []byte) error {
+	shaParts := strings.Fields(string(shaData))
+	if len(shaParts) == 0 {
+		return fmt.Errorf("invalid sha file")
+	}
+	expectedSHA := shaParts[0]
+	// A server answering with an error page and status 200 would otherwise
+	// show up as a confusing mismatch.
+	if _, err := hex.DecodeString(expectedSHA); err != nil || len(expectedSHA) != sha256.Size*2 {
+		if len(expectedSHA) > 40 {
+			expectedSHA = expectedSHA[:40] + "..."
+		}
+		return fmt.Errorf("malformed SHA response: expected 64 hex characters, got %q", expectedSHA)
+	}
+
+	if !strings.EqualFold(actualSHA, expectedSHA) {
+		return fmt.Errorf("sha256 mismatch: got %s, expected %s", actualSHA, expectedSHA)
+	}
+
+	return nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	sha256Hash := sha256.New()
+	if _, err := io.Copy(sha256Hash, file); err != nil {
+		return "", fmt.Errorf("failed to hash %s: %w", path, err)
+	}
+
+	return hex.EncodeToString(sha256Hash.Sum(nil)), nil
+}
+
+func useLocalArchive(tmpDir string, cfg *Config) error {
+	if cfg.SHAPath != "" {
+		actualSHA, err := hashFile(cfg.ZipPath)
+		if err != nil {
+			return err
+		}
+
+		shaFile, err := os.Open(cfg.SHAPath)
+		if err != nil {
+			return fmt.Errorf("failed to open sha file %s: %w", cfg.SHAPath, err)
+		}
+		defer shaFile.Close()
+
+		shaData, err := io.ReadAll(io.LimitReader(shaFile, 1024))
+		if err != nil {
+			return fmt.Errorf("failed to read sha file %s: %w", cfg.SHAPath, err)
+		}
+
+		if err := compareSHA256(actualSHA, shaData); err != nil {
+			return err
+		}
+	}
+
+	return extractArchive(cfg.ZipPath, tmpDir, cfg)
+}
+
+func downloadGeolite2(ctx context.Context, tmpDir string, cfg *Config) error {
+	if cfg.UseCachedCSV {
+		cached, err := useCachedCSV(tmpDir, cfg)
+		if cached || err != nil {
+			return err
+		}
+	}
+
+	if cfg.ZipPath != "" {
+		return useLocalArchive(tmpDir, cfg)
+	}
+
+	if cfg.CacheDir != "" {
+		archivePath, err := downloadCachedArchive(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		return extractArchive(archivePath, tmpDir, cfg)
+	}
+
+	if cfg.Stream {
+		data, actualSHA, err := downloadArchiveData(ctx, cfg)
+		if err != nil {
+			return err
+		}
+		if err := verifySHA256(ctx, actualSHA, cfg); err != nil {
+			return err
+		}
+		return extractArchiveData(data, tmpDir, cfg)
+	}
+
+	download, err := downloadArchive(ctx, tmpDir, cfg, nil, true)
+	if err != nil {
+		return err
+	}
+
+	if err := verifySHA256(ctx, download.sha256, cfg); err != nil {
+		return err
+	}
+
+	if err := extractArchive(download.path, tmpDir, cfg); err != nil {
+		return err
+	}
+
+	return nil
+}
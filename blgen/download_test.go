@@ -0,0 +1,371 @@
+package blgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCancelDownload(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	// The server sends half of the archive and then stalls until the
+	// download is canceled.
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/db.zip" {
+			return false
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(server.archive)))
+		w.Write(server.archive[:len(server.archive)/2])
+		w.(http.Flusher).Flush()
+		cancel()
+		<-r.Context().Done()
+		return true
+	}
+
+	start := time.Now()
+	_, err := Generate(ctx, server.config(t))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want the context error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("canceled download returned after %v", elapsed)
+	}
+	if n := len(server.requested()); n != 1 {
+		t.Errorf("%d requests, want the canceled download only", n)
+	}
+}
+
+func TestMirrorURLs(t *testing.T) {
+	mirror := newTestServer(t, countryArchive(t, testBlocks))
+	cfg := mirror.config(t)
+	var hosts []string
+	cfg.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		hosts = append(hosts, r.URL.Host)
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	generate(t, cfg)
+
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+	if len(hosts) != 2 || hosts[0] != mirrorHost || hosts[1] != mirrorHost {
+		t.Errorf("requests sent to %q, want the archive and its checksum from %s", hosts, mirrorHost)
+	}
+	var paths []string
+	for _, r := range mirror.requested() {
+		paths = append(paths, r.URL.Path)
+	}
+	if want := []string{"/db.zip", "/db.zip.sha256"}; !slices.Equal(paths, want) {
+		t.Errorf("mirror served %q, want %q", paths, want)
+	}
+}
+
+func TestMirrorURLsValidated(t *testing.T) {
+	for _, rawURL := range []string{"ftp://mirror.example/db.zip", "mirror.example/db.zip", "https:///db.zip", "http://[::1"} {
+		cfg := testConfig(t, "")
+		cfg.AccountID, cfg.LicenseKey = "1234", "key"
+		cfg.DBURL = rawURL
+		if err := cfg.Prepare(); err == nil {
+			t.Errorf("database URL %q accepted", rawURL)
+		}
+		cfg = testConfig(t, "")
+		cfg.AccountID, cfg.LicenseKey = "1234", "key"
+		cfg.SHAURL = rawURL
+		if err := cfg.Prepare(); err == nil {
+			t.Errorf("SHA URL %q accepted", rawURL)
+		}
+	}
+}
+
+func TestStreamWritesNoArchive(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	for _, stream := range []bool{false, true} {
+		cfg := server.config(t)
+		cfg.Stream = stream
+		cfg.TempDir = t.TempDir()
+		cfg.KeepTemp = true
+		if result := generate(t, cfg); result.NetworksWritten != 4 {
+			t.Errorf("stream %t: %d networks written, want 4", stream, result.NetworksWritten)
+		}
+		archives, err := filepath.Glob(filepath.Join(cfg.TempDir, tmpDirPattern, "*.zip*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stream && len(archives) != 0 {
+			t.Errorf("streamed archive written to %q", archives)
+		}
+		if !stream && len(archives) != 1 {
+			t.Errorf("downloaded archive written to %q, want a single file", archives)
+		}
+	}
+}
+
+// recordingTransport records the requests it passes on to the default
+// transport.
+type recordingTransport struct {
+	mu       sync.Mutex
+	requests []*http.Request
+}
+
+func (rt *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	rt.mu.Lock()
+	rt.requests = append(rt.requests, r)
+	rt.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+func TestHTTPClientRecordsRequests(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	cfg := server.config(t)
+	transport := &recordingTransport{}
+	cfg.HTTPClient = &http.Client{Transport: transport}
+	generate(t, cfg)
+
+	want := []string{server.URL + "/db.zip", server.URL + "/db.zip.sha256"}
+	var got []string
+	for _, r := range transport.requests {
+		got = append(got, r.URL.String())
+		if accountID, licenseKey, _ := r.BasicAuth(); r.Method != http.MethodGet || accountID != "1234" || licenseKey != "key" {
+			t.Errorf("%s %s sent with the credentials %q and %q", r.Method, r.URL, accountID, licenseKey)
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("client sent %q, want %q", got, want)
+	}
+}
+
+// slowDownloads makes the server send the archive in pieces over about
+// duration.
+func slowDownloads(server *testServer, duration time.Duration) {
+	const pieces = 10
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/db.zip" {
+			return false
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(server.archive)))
+		size := len(server.archive)/pieces + 1
+		for data := server.archive; len(data) > 0; data = data[min(size, len(data)):] {
+			w.Write(data[:min(size, len(data))])
+			w.(http.Flusher).Flush()
+			time.Sleep(duration / pieces)
+		}
+		return true
+	}
+}
+
+// A download outlasting the connect timeout succeeds, only the download
+// timeout limits the whole transfer.
+func TestSlowDownload(t *testing.T) {
+	fastRetries(t)
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	slowDownloads(server, 500*time.Millisecond)
+
+	cfg := server.config(t)
+	cfg.ConnectTimeout = 50 * time.Millisecond
+	cfg.DownloadTimeout = 10 * time.Second
+	if result := generate(t, cfg); result.NetworksWritten != 4 {
+		t.Errorf("%d networks written, want 4", result.NetworksWritten)
+	}
+	if cfg.HTTPClient != nil && cfg.HTTPClient.Timeout != 0 {
+		t.Errorf("client limits every request to %v", cfg.HTTPClient.Timeout)
+	}
+
+	cfg = server.config(t)
+	cfg.DownloadTimeout = 100 * time.Millisecond
+	cfg.Retries = 1
+	if _, err := Generate(t.Context(), cfg); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want the download timed out", err)
+	}
+}
+
+func TestTruncatedDownload(t *testing.T) {
+	fastRetries(t)
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	var truncated atomic.Int32
+	truncated.Store(1)
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/db.zip" || truncated.Load() == 0 {
+			return false
+		}
+		truncated.Add(-1)
+		w.Header().Set("Content-Length", strconv.Itoa(len(server.archive)))
+		w.Write(server.archive[:len(server.archive)/2])
+		return true
+	}
+
+	// A truncated download is retried.
+	if result := generate(t, server.config(t)); result.NetworksWritten != 4 {
+		t.Errorf("%d networks written after the retry, want 4", result.NetworksWritten)
+	}
+
+	// The truncation is reported before the archive is verified.
+	truncated.Store(2)
+	requests := len(server.requested())
+	cfg := server.config(t)
+	cfg.Retries = 2
+	if _, err := Generate(t.Context(), cfg); err == nil || !strings.Contains(err.Error(), "download truncated") {
+		t.Errorf("got %v, want the download reported truncated", err)
+	}
+	for _, r := range server.requested()[requests:] {
+		if r.URL.Path != "/db.zip" {
+			t.Errorf("%s requested after the truncated download", r.URL.Path)
+		}
+	}
+}
+
+// responseLogs returns the protocol and connection reuse of the responses
+// logged in log, a JSON debug log.
+func responseLogs(t *testing.T, log string) []string {
+	t.Helper()
+	var responses []string
+	for line := range strings.Lines(log) {
+		var record struct {
+			Msg      string
+			What     string
+			Protocol string
+			Reused   bool `json:"reused_connection"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if record.Msg == "response" {
+			responses = append(responses, fmt.Sprintf("%s %s reused=%t", record.What, record.Protocol, record.Reused))
+		}
+	}
+	return responses
+}
+
+// The SHA256 request after the archive reuses its connection.
+func TestConnectionReuse(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	h2 := httptest.NewUnstartedServer(http.HandlerFunc(server.serve))
+	h2.Config.Protocols = new(http.Protocols)
+	h2.Config.Protocols.SetUnencryptedHTTP2(true)
+	h2.Start()
+	t.Cleanup(h2.Close)
+
+	tests := []struct {
+		http2 bool
+		url   string
+		want  []string
+	}{
+		{false, server.URL, []string{"zip HTTP/1.1 reused=false", "sha HTTP/1.1 reused=true"}},
+		{true, h2.URL, []string{"zip HTTP/2.0 reused=false", "sha HTTP/2.0 reused=true"}},
+	}
+	for _, test := range tests {
+		cfg := server.config(t)
+		cfg.DBURL, cfg.SHAURL = test.url+"/db.zip", test.url+"/db.zip.sha256"
+		cfg.HTTP2 = test.http2
+		var log bytes.Buffer
+		cfg.Logger = slog.New(slog.NewJSONHandler(&log, &slog.HandlerOptions{Level: slog.LevelDebug}))
+		generate(t, cfg)
+		if got := responseLogs(t, log.String()); !slices.Equal(got, test.want) {
+			t.Errorf("http2 %t: got %q, want %q", test.http2, got, test.want)
+		}
+	}
+}
+
+func TestCompareSHA256(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		data, err string
+	}{
+		{sum + "  GeoLite2-Country-CSV_20260101.zip\n", ""},
+		{strings.ToUpper(sum) + "\n", ""},
+		{strings.Replace(sum, "9", "8", 1), "sha256 mismatch"},
+		{"", "invalid sha file"},
+		{"<!DOCTYPE html><html><body>Sign in</body></html>", "malformed SHA response"},
+		{sum[:63], "malformed SHA response"},
+		{sum + "0", "malformed SHA response"},
+		{strings.Replace(sum, "9", "g", 1), "malformed SHA response"},
+	}
+	for _, test := range tests {
+		err := compareSHA256(sum, []byte(test.data))
+		if (test.err == "") != (err == nil) || err != nil && !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%.30q: got %v, want %q", test.data, err, test.err)
+		}
+	}
+}
+
+func TestSHAErrorPage(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/db.zip.sha256" {
+			return false
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte("<html>\n<head><title>Maintenance</title></head>\n</html>\n"))
+		return true
+	}
+	cfg := server.config(t)
+	_, err := Generate(t.Context(), cfg)
+	if err == nil || !strings.Contains(err.Error(), `malformed SHA response: expected 64 hex characters, got "<html>"`) {
+		t.Errorf("got %v, want the SHA response reported malformed", err)
+	}
+}
+
+func TestUserAgent(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	for _, userAgent := range []string{"", "blocklist-builder/2.1 (ops@example.com)"} {
+		cfg := server.config(t)
+		cfg.UserAgent = userAgent
+		requests := len(server.requested())
+		generate(t, cfg)
+		want := userAgent
+		if want == "" {
+			want = DefaultUserAgent
+		}
+		for _, r := range server.requested()[requests:] {
+			if got := r.Header.Get("User-Agent"); got != want {
+				t.Errorf("%s requested as %q, want %q", r.URL.Path, got, want)
+			}
+		}
+	}
+}
+
+func TestSkipSHA(t *testing.T) {
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/db.zip.sha256" {
+			http.NotFound(w, r)
+			return true
+		}
+		return false
+	}
+	// Without SkipSHA the missing SHA256 fails the run.
+	if _, err := Generate(t.Context(), server.config(t)); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want the missing SHA256 to fail the run", err)
+	}
+
+	cfg := server.config(t)
+	cfg.SkipSHA = true
+	var log bytes.Buffer
+	cfg.Logger = slog.New(slog.NewTextHandler(&log, nil))
+	if result := generate(t, cfg); result.NetworksWritten != 4 {
+		t.Errorf("%d networks written, want 4", result.NetworksWritten)
+	}
+	if !strings.Contains(log.String(), "level=WARN msg=\"skipping the SHA256 verification") {
+		t.Errorf("no warning about the unchecked archive: %s", log.String())
+	}
+
+	// A cache relies on the SHA256 to notice a changed archive.
+	cfg = server.config(t)
+	cfg.SkipSHA = true
+	cfg.CacheDir = t.TempDir()
+	if err := cfg.Prepare(); err == nil {
+		t.Error("skipping the SHA256 accepted with a cache")
+	}
+}
@@ -0,0 +1,446 @@
+package blgen
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	EditionCountry = "country"
+	EditionCity    = "city"
+	EditionASN     = "asn"
+)
+
+// edition describes one of the GeoLite2 CSV databases the list can be built
+// from. Downloading and extracting is shared, the edition only decides which
+// files are needed and which rows of its blocks file are written.
+type edition interface {
+	// id is MaxMind's edition ID, used in the download URL.
+	id() string
+	// csvFiles lists the files extracted from the archive.
+	csvFiles() []csvFile
+	blocksCSV() string
+	// labelLegend describes the label written after each network in the
+	// plain format.
+	labelLegend() string
+	// labelColumn names the label column of the csv format.
+	labelColumn() string
+	// newMatcher prepares the filter for the blocks file from the
+	// extracted files in tmpDir.
+	newMatcher(ctx context.Context, tmpDir string, cfg *Config, result *Result) (blockMatcher, error)
+	// newReportMatcher prepares a filter for Report that matches every row
+	// under the label it is counted for.
+	newReportMatcher(ctx context.Context, tmpDir string, cfg *Config) (blockMatcher, error)
+}
+
+// blockMatcher selects the rows of a blocks file that go into the list.
+type blockMatcher interface {
+	// columns lists the blocks file columns match reads.
+	columns() []string
+	// match reports whether a row is listed, and under which label. It is
+	// called concurrently when the blocks file is scanned by several
+	// workers.
+	match(line []string, columns map[string]int) (geoname, bool)
+	// finish is called once the whole blocks file was matched.
+	finish(cfg *Config) error
+}
+
+// csvFile is a CSV file of an edition. It is extracted under name from the
+// archive file whose name matches pattern, so a renamed blocks file in a new
+// build of the database is still found.
+type csvFile struct {
+	name    string
+	pattern string
+	// localized marks the locations file, which only exists in the
+	// locales MaxMind translates the names to.
+	localized bool
+	// columns is the header the file is known to have, which StrictSchema
+	// holds it to.
+	columns []string
+}
+
+var editions = map[string]edition{
+	EditionCountry: geonameEdition{
+		editionID:     "GeoLite2-Country-CSV",
+		locations:     "GeoLite2-Country-Locations-",
+		blocks:        "GeoLite2-Country-Blocks-IPv4.csv",
+		blocksPattern: "GeoLite2-Country-Blocks-IPv4*.csv",
+		locationsColumns: []string{
+			"geoname_id", "locale_code", "continent_code", "continent_name", "country_iso_code", "country_name",
+			"is_in_european_union",
+		},
+		blocksColumns: []string{
+			"network", "geoname_id", "registered_country_geoname_id", "represented_country_geoname_id",
+			"is_anonymous_proxy", "is_satellite_provider", "is_anycast",
+		},
+	},
+	EditionCity: geonameEdition{
+		editionID:     "GeoLite2-City-CSV",
+		locations:     "GeoLite2-City-Locations-",
+		blocks:        "GeoLite2-City-Blocks-IPv4.csv",
+		blocksPattern: "GeoLite2-City-Blocks-IPv4*.csv",
+		locationsColumns: []string{
+			"geoname_id", "locale_code", "continent_code", "continent_name", "country_iso_code", "country_name",
+			"subdivision_1_iso_code", "subdivision_1_name", "subdivision_2_iso_code", "subdivision_2_name",
+			"city_name", "metro_code", "time_zone", "is_in_european_union",
+		},
+		blocksColumns: []string{
+			"network", "geoname_id", "registered_country_geoname_id", "represented_country_geoname_id",
+			"is_anonymous_proxy", "is_satellite_provider", "postal_code", "latitude", "longitude",
+			"accuracy_radius", "is_anycast",
+		},
+	},
+	EditionASN: asnEdition{},
+}
+
+func validateEdition(name string) error {
+	if _, ok := editions[name]; !ok {
+		return fmt.Errorf("unknown edition %q, expected %q, %q or %q", name, EditionCountry, EditionCity, EditionASN)
+	}
+	return nil
+}
+
+// editionDownloadURL returns MaxMind's download URL for the edition in the
+// given archive format.
+func editionDownloadURL(ed edition, archive string) string {
+	return databaseDownloadURL(ed.id(), archive)
+}
+
+// databaseDownloadURL returns MaxMind's download URL for the edition ID in the
+// given archive format.
+func databaseDownloadURL(id, archive string) string {
+	return "https://download.maxmind.com/geoip/databases/" + id + "/download?suffix=" + archive
+}
+
+// editionArchiveFilename is the name the downloaded archive is stored under.
+func editionArchiveFilename(ed edition, archive string) string {
+	return ed.id() + "." + archive
+}
+
+// edition returns the configured edition, reading the locations file of the
+// configured locale.
+func (cfg *Config) edition() edition {
+	if ed, ok := editions[cfg.Edition].(geonameEdition); ok {
+		ed.locale = cfg.Locale
+		return ed
+	}
+	return editions[cfg.Edition]
+}
+
+var localePattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]+)*$`)
+
+func validateLocale(locale string) error {
+	if !localePattern.MatchString(locale) {
+		return fmt.Errorf("invalid locale %q, expected a code such as %q or %q", locale, DefaultLocale, "pt-BR")
+	}
+	return nil
+}
+
+// geonameEdition is an edition whose blocks refer to the geonames in a
+// separate locations file, which is where the codes are matched.
+type geonameEdition struct {
+	editionID string
+	// locations is the name of the locations file up to the locale.
+	locations        string
+	locale           string
+	blocks           string
+	blocksPattern    string
+	locationsColumns []string
+	blocksColumns    []string
+}
+
+// locationsCSV is the locations file of the locale, such as
+// GeoLite2-Country-Locations-en.csv.
+func (e geonameEdition) locationsCSV() string {
+	locale := e.locale
+	if locale == "" {
+		locale = DefaultLocale
+	}
+	return e.locations + locale + ".csv"
+}
+
+func (e geonameEdition) id() string { return e.editionID }
+func (e geonameEdition) csvFiles() []csvFile {
+	return []csvFile{
+		{name: e.locationsCSV(), pattern: e.locationsCSV(), localized: true, columns: e.locationsColumns},
+		{name: e.blocks, pattern: e.blocksPattern, columns: e.blocksColumns},
+	}
+}
+func (e geonameEdition) blocksCSV() string   { return e.blocks }
+func (e geonameEdition) labelLegend() string { return "Country Continent*" }
+
+func (e geonameEdition) labelColumn() string { return "country" }
+
+func (e geonameEdition) newMatcher(ctx context.Context, tmpDir string, cfg *Config, result *Result) (blockMatcher, error) {
+	geonameIDsSet, excludedIDs, err := getGeonameIDs(ctx, tmpDir, e.locationsCSV(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	result.GeonamesMatched = len(geonameIDsSet)
+	return geonameMatcher{
+		geonames:  geonameIDsSet,
+		excluded:  excludedIDs,
+		fields:    cfg.matchFields(),
+		reasons:   cfg.AnnotateReason,
+		allowMode: cfg.Mode == ModeAllow,
+	}, nil
+}
+
+type geonameMatcher struct {
+	geonames map[string]geoname
+	// fields are the geoname columns the network is matched on.
+	fields []string
+	// reasons records which of the fields matched.
+	reasons bool
+	// excluded holds the geonames of excluded countries. A network with
+	// any of them is never listed, even when another of its geonames
+	// matches.
+	excluded  map[string]struct{}
+	allowMode bool
+}
+
+var geonameColumns = []string{"geoname_id", registeredCountryColumn, "represented_country_geoname_id"}
+
+// registeredCountryColumn is the geoname of the country a network is
+// registered to, by the regional Internet registry that allocated it.
+const registeredCountryColumn = "registered_country_geoname_id"
+
+// matchReasons are the tokens the geoname columns are annotated as.
+var matchReasons = map[string]string{
+	"geoname_id":                     "geo",
+	"registered_country_geoname_id":  "registered",
+	"represented_country_geoname_id": "represented",
+}
+
+// addReason adds the token of column to the reasons of match.
+func addReason(match geoname, column string) geoname {
+	if match.reason == "" {
+		match.reason = matchReasons[column]
+	} else {
+		match.reason += "+" + matchReasons[column]
+	}
+	return match
+}
+
+func validateMatchFields(fields []string) error {
+	seen := map[string]struct{}{}
+	for _, field := range fields {
+		if !slices.Contains(geonameColumns, field) {
+			return fmt.Errorf("unknown match field %q, expected %s", field, strings.Join(geonameColumns, ", "))
+		}
+		if _, duplicate := seen[field]; duplicate {
+			return fmt.Errorf("match field %q is listed more than once", field)
+		}
+		seen[field] = struct{}{}
+	}
+	return nil
+}
+
+func (m geonameMatcher) columns() []string { return m.fields }
+
+func (m geonameMatcher) match(line []string, columns map[string]int) (geoname, bool) {
+	for _, column := range m.fields {
+		if _, excluded := m.excluded[line[columns[column]]]; excluded {
+			return geoname{}, false
+		}
+	}
+
+	if !m.allowMode {
+		var match geoname
+		matched := false
+		for _, column := range m.fields {
+			country, found := m.geonames[line[columns[column]]]
+			if !found {
+				continue
+			}
+			if !m.reasons {
+				return country, true
+			}
+			// The first matching field decides the label, the
+			// others only add to the reasons.
+			if !matched {
+				match, matched = country, true
+			}
+			match = addReason(match, column)
+		}
+		return match, matched
+	}
+
+	// In allow mode the set holds every geoname outside the allowlist, so a
+	// network is only emitted when none of its geonames is allowed.
+	var match geoname
+	for _, column := range m.fields {
+		id := line[columns[column]]
+		if id == "" {
+			continue
+		}
+		country, found := m.geonames[id]
+		if !found {
+			return geoname{}, false
+		}
+		if match.label == "" {
+			match = country
+		}
+		if m.reasons {
+			match = addReason(match, column)
+		}
+	}
+	return match, match.label != ""
+}
+
+// finish has nothing to do, unmatched codes were already reported while
+// reading the locations file.
+func (geonameMatcher) finish(*Config) error { return nil }
+
+func (e geonameEdition) newReportMatcher(ctx context.Context, tmpDir string, cfg *Config) (blockMatcher, error) {
+	geonames, err := readGeonames(ctx, tmpDir, e.locationsCSV(), cfg)
+	if err != nil {
+		return nil, err
+	}
+	return geonameReportMatcher{geonames: geonames}, nil
+}
+
+// geonameReportMatcher counts each network for the geoname it is located in,
+// or else for the one it is registered to. Networks with neither are counted
+// under an empty label.
+type geonameReportMatcher struct {
+	geonames map[string]geoname
+}
+
+func (geonameReportMatcher) columns() []string { return geonameColumns[:2] }
+
+func (m geonameReportMatcher) match(line []string, columns map[string]int) (geoname, bool) {
+	for _, column := range geonameColumns[:2] {
+		if country, found := m.geonames[line[columns[column]]]; found {
+			return country, true
+		}
+	}
+	return geoname{}, true
+}
+
+func (geonameReportMatcher) finish(*Config) error { return nil }
+
+// asnEdition matches autonomous system numbers, which its blocks file
+// carries directly.
+type asnEdition struct{}
+
+func (asnEdition) id() string { return "GeoLite2-ASN-CSV" }
+func (asnEdition) csvFiles() []csvFile {
+	return []csvFile{{
+		name:    "GeoLite2-ASN-Blocks-IPv4.csv",
+		pattern: "GeoLite2-ASN-Blocks-IPv4*.csv",
+		columns: []string{"network", "autonomous_system_number", "autonomous_system_organization"},
+	}}
+}
+func (asnEdition) blocksCSV() string   { return "GeoLite2-ASN-Blocks-IPv4.csv" }
+func (asnEdition) labelLegend() string { return "ASN" }
+
+func (asnEdition) labelColumn() string { return "asn" }
+
+func (asnEdition) newMatcher(_ context.Context, _ string, cfg *Config, _ *Result) (blockMatcher, error) {
+	return &asnMatcher{
+		blocked:   cfg.BlockedASNs,
+		allowMode: cfg.Mode == ModeAllow,
+		seen:      map[string]struct{}{},
+	}, nil
+}
+
+func (asnEdition) newReportMatcher(context.Context, string, *Config) (blockMatcher, error) {
+	return asnReportMatcher{}, nil
+}
+
+// asnReportMatcher counts each network for its autonomous system.
+type asnReportMatcher struct{}
+
+func (asnReportMatcher) columns() []string { return asnColumns }
+
+func (asnReportMatcher) match(line []string, columns map[string]int) (geoname, bool) {
+	return geoname{label: "AS" + line[columns["autonomous_system_number"]], countryName: line[columns["autonomous_system_organization"]]}, true
+}
+
+func (asnReportMatcher) finish(*Config) error { return nil }
+
+type asnMatcher struct {
+	blocked   map[string]struct{}
+	allowMode bool
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+var asnColumns = []string{"autonomous_system_number", "autonomous_system_organization"}
+
+func (*asnMatcher) columns() []string { return asnColumns }
+
+func (m *asnMatcher) match(line []string, columns map[string]int) (geoname, bool) {
+	asn := line[columns["autonomous_system_number"]]
+	_, isBlocked := m.blocked[asn]
+	if isBlocked {
+		m.mu.Lock()
+		m.seen[asn] = struct{}{}
+		m.mu.Unlock()
+	}
+	if m.allowMode {
+		// An empty allowlist produces a header-only list, as it does for
+		// the other editions.
+		if isBlocked || len(m.blocked) == 0 {
+			return geoname{}, false
+		}
+	} else if !isBlocked {
+		return geoname{}, false
+	}
+	return geoname{label: "AS" + asn, countryName: line[columns["autonomous_system_organization"]]}, true
+}
+
+// finish reports configured ASNs that no network belongs to.
+func (m *asnMatcher) finish(cfg *Config) error {
+	var unmatched []string
+	for asn := range m.blocked {
+		if _, seen := m.seen[asn]; !seen {
+			unmatched = append(unmatched, "AS"+asn)
+		}
+	}
+	if len(unmatched) == 0 {
+		return nil
+	}
+
+	slices.Sort(unmatched)
+	if cfg.Strict {
+		return fmt.Errorf("configured ASNs not found in %s: %s", asnEdition{}.blocksCSV(), strings.Join(unmatched, ", "))
+	}
+	for _, asn := range unmatched {
+		cfg.Logger.Warn("configured ASN not found", "asn", asn, "path", asnEdition{}.blocksCSV())
+	}
+	return nil
+}
+
+// checkSchema fails, with StrictSchema, when the header of the CSV file name
+// isn't the one the file is known to have, with the same columns in the same
+// order. Otherwise only the columns that are read have to be there.
+func (cfg *Config) checkSchema(name string, header []string) error {
+	if !cfg.StrictSchema {
+		return nil
+	}
+	for _, file := range cfg.edition().csvFiles() {
+		if file.name == name && !slices.Equal(header, file.columns) {
+			return fmt.Errorf("unexpected columns in %s: %s, expected %s", name, strings.Join(header, ","), strings.Join(file.columns, ","))
+		}
+	}
+	return nil
+}
+
+// parseASN accepts an autonomous system number with or without the AS
+// prefix and returns it in the form used by the ASN blocks file.
+func parseASN(value string) (string, error) {
+	digits := strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(value)), "AS")
+	asn, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid ASN %q", value)
+	}
+	return strconv.FormatUint(asn, 10), nil
+}
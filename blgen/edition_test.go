@@ -0,0 +1,224 @@
+package blgen
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+// cityArchive returns the path of a City edition archive with a few cities in
+// California, New York, Moscow and Berlin.
+func cityArchive(t testing.TB) string {
+	t.Helper()
+	const dir = "GeoLite2-City-CSV_20260101/"
+	return writeZip(t, map[string]string{
+		dir + "GeoLite2-City-Locations-en.csv": `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,subdivision_1_iso_code,subdivision_1_name,subdivision_2_iso_code,subdivision_2_name,city_name,metro_code,time_zone,is_in_european_union
+5391959,en,NA,"North America",US,"United States",CA,California,,,"San Francisco",807,America/Los_Angeles,0
+5368361,en,NA,"North America",US,"United States",CA,California,,,"Los Angeles",803,America/Los_Angeles,0
+5128581,en,NA,"North America",US,"United States",NY,"New York",,,"New York",501,America/New_York,0
+524901,en,EU,Europe,RU,Russia,MOW,Moscow,,,Moscow,,Europe/Moscow,0
+2950159,en,EU,Europe,DE,Germany,BE,"Land Berlin",,,Berlin,,Europe/Berlin,0
+`,
+		dir + "GeoLite2-City-Blocks-IPv4.csv": `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,postal_code,latitude,longitude,accuracy_radius,is_anycast
+1.0.0.0/24,5391959,6252001,,0,0,94107,37.7697,-122.3933,20,
+1.0.1.0/24,5368361,6252001,,0,0,90014,34.0440,-118.2510,20,
+1.0.2.0/24,5128581,6252001,,0,0,10001,40.7484,-73.9967,20,
+2.0.0.0/24,524901,2017370,,0,0,,55.7522,37.6156,50,
+3.0.0.0/24,2950159,2921044,,0,0,10117,52.5200,13.4050,50,
+`,
+	})
+}
+
+func TestCityEdition(t *testing.T) {
+	archive := cityArchive(t)
+	tests := []struct {
+		countries, subdivisions []string
+		want                    []string
+	}{
+		{nil, []string{"US-CA"}, []string{"1.0.0.0/24 ; US-CA", "1.0.1.0/24 ; US-CA"}},
+		{[]string{"RU"}, []string{"US-NY", "DE-BE"}, []string{"1.0.2.0/24 ; US-NY", "2.0.0.0/24 ; RU", "3.0.0.0/24 ; DE-BE"}},
+		{[]string{"DE"}, nil, []string{"3.0.0.0/24 ; DE"}},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.Edition = EditionCity
+		cfg.BlockedCountries = codes(test.countries...)
+		cfg.BlockedSubdivisions = codes(test.subdivisions...)
+		result := generate(t, cfg)
+		if got := listLines(t, result.OutputPath); !slices.Equal(got, test.want) {
+			t.Errorf("%q and %q: got %q, want %q", test.countries, test.subdivisions, got, test.want)
+		}
+	}
+}
+
+func TestExcludedSubdivision(t *testing.T) {
+	archive := cityArchive(t)
+	tests := []struct {
+		countries, excluded []string
+		want                []string
+	}{
+		{[]string{"US"}, []string{"US-CA"}, []string{"1.0.2.0/24 ; US"}},
+		{[]string{"US", "RU"}, []string{"US-NY", "RU-MOW"}, []string{"1.0.0.0/24 ; US", "1.0.1.0/24 ; US"}},
+		// Excluding a subdivision of a country that isn't blocked changes
+		// nothing.
+		{[]string{"DE"}, []string{"US-CA"}, []string{"3.0.0.0/24 ; DE"}},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.Edition = EditionCity
+		cfg.BlockedCountries = codes(test.countries...)
+		cfg.ExcludedSubdivisions = codes(test.excluded...)
+		result := generate(t, cfg)
+		if got := listLines(t, result.OutputPath); !slices.Equal(got, test.want) {
+			t.Errorf("%q excluding %q: got %q, want %q", test.countries, test.excluded, got, test.want)
+		}
+	}
+
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.ExcludedSubdivisions = codes("RU-MOW")
+	if err := cfg.Prepare(); err == nil {
+		t.Error("subdivisions excluded from the country edition")
+	}
+}
+
+func TestASNEdition(t *testing.T) {
+	archive := writeZip(t, map[string]string{
+		"GeoLite2-ASN-CSV_20260101/GeoLite2-ASN-Blocks-IPv4.csv": `network,autonomous_system_number,autonomous_system_organization
+1.0.0.0/24,13335,CLOUDFLARENET
+1.0.4.0/22,38803,"Wirefreebroadband Pty Ltd"
+8.8.8.0/24,15169,GOOGLE
+104.16.0.0/13,13335,CLOUDFLARENET
+`,
+	})
+	cfg := testConfig(t, archive)
+	cfg.Edition = EditionASN
+	cfg.BlockedCountries = nil
+	cfg.BlockedASNsInput = []string{"AS13335"}
+	result := generate(t, cfg)
+	want := []string{"1.0.0.0/24 ; AS13335", "104.16.0.0/13 ; AS13335"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestMatchFields(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	ru := []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU"}
+	tests := []struct {
+		fields string
+		want   []string
+	}{
+		{"", append(slices.Clone(ru), "185.1.1.0/24 ; RU")},
+		// 185.1.1.0/24 is located in the US and only registered to RU.
+		{"geoname_id,represented_country_geoname_id", ru},
+		{"geoname_id", ru},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.MatchFields = test.fields
+		result := generate(t, cfg)
+		if got := listLines(t, result.OutputPath); !slices.Equal(got, test.want) {
+			t.Errorf("%q: got %q, want %q", test.fields, got, test.want)
+		}
+	}
+
+	for _, fields := range []string{"country_iso_code", "geoname_id,", "geoname_id,geoname_id"} {
+		cfg := testConfig(t, archive)
+		cfg.MatchFields = fields
+		if err := cfg.Prepare(); err == nil {
+			t.Errorf("match fields %q accepted", fields)
+		}
+	}
+}
+
+// Matching on the registered country only leaves out the networks located in
+// a country but registered elsewhere.
+func TestOnlyRegistered(t *testing.T) {
+	blocks := testBlocks + `2.57.0.0/24,2017370,2921044,,0,0,
+`
+	archive := countryArchive(t, blocks)
+	tests := []struct {
+		onlyRegistered bool
+		want           []string
+	}{
+		{false, []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU", "2.57.0.0/24 ; RU"}},
+		// 2.57.0.0/24 is located in RU and registered to DE.
+		{true, []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.OnlyRegistered = test.onlyRegistered
+		if got := listLines(t, generate(t, cfg).OutputPath); !slices.Equal(got, test.want) {
+			t.Errorf("only registered %t: got %q, want %q", test.onlyRegistered, got, test.want)
+		}
+	}
+
+	cfg := testConfig(t, archive)
+	cfg.OnlyRegistered = true
+	cfg.MatchFields = "geoname_id"
+	if err := cfg.Prepare(); err == nil {
+		t.Error("only registered accepted with other match fields")
+	}
+}
+
+func TestAnnotateReason(t *testing.T) {
+	blocks := testBlocksHeader + `2.56.8.0/24,2017370,2017370,,0,0,
+185.1.1.0/24,6252001,2017370,,0,0,
+10.0.0.0/24,6252001,6252001,2017370,0,0,
+`
+	archive := countryArchive(t, blocks)
+	want := []string{"2.56.8.0/24 ; RU ; geo+registered", "185.1.1.0/24 ; RU ; registered", "10.0.0.0/24 ; RU ; represented"}
+	cfg := testConfig(t, archive)
+	cfg.AnnotateReason = true
+	if got := listLines(t, generate(t, cfg).OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	cfg = testConfig(t, archive)
+	cfg.AnnotateReason = true
+	cfg.Format = FormatCSV
+	want = []string{"network,country,reason", "2.56.8.0/24,RU,geo+registered", "185.1.1.0/24,RU,registered", "10.0.0.0/24,RU,represented"}
+	if got := listLines(t, generate(t, cfg).OutputPath); !slices.Equal(got, want) {
+		t.Errorf("csv: got %q, want %q", got, want)
+	}
+}
+
+func TestStrictSchema(t *testing.T) {
+	tests := []struct {
+		name, header string
+		reorder      bool
+	}{
+		{"extra column", testBlocksHeader[:len(testBlocksHeader)-1] + ",is_hosting_provider\n", false},
+		{"columns reordered", "geoname_id,network,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,is_anycast\n", true},
+	}
+	for _, test := range tests {
+		var blocks strings.Builder
+		blocks.WriteString(test.header)
+		for row := range strings.Lines(testBlocks[len(testBlocksHeader):]) {
+			fields := strings.Split(strings.TrimSuffix(row, "\n"), ",")
+			if test.reorder {
+				fields[0], fields[1] = fields[1], fields[0]
+			} else {
+				fields = append(fields, "0")
+			}
+			blocks.WriteString(strings.Join(fields, ",") + "\n")
+		}
+		archive := countryArchive(t, blocks.String())
+
+		// Only the columns that are read are checked by default.
+		if result := generate(t, testConfig(t, archive)); result.NetworksWritten != 4 {
+			t.Errorf("%s: %d networks written, want 4", test.name, result.NetworksWritten)
+		}
+		cfg := testConfig(t, archive)
+		cfg.StrictSchema = true
+		_, err := Generate(t.Context(), cfg)
+		if err == nil || !strings.Contains(err.Error(), "unexpected columns in GeoLite2-Country-Blocks-IPv4.csv: "+strings.TrimSpace(test.header)) {
+			t.Errorf("%s: got %v, want the header reported", test.name, err)
+		}
+	}
+
+	// The known layout passes.
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.StrictSchema = true
+	generate(t, cfg)
+}
@@ -0,0 +1,443 @@
+package blgen
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"maps"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+const (
+	FormatPlain    = "plain"
+	FormatIPSet    = "ipset"
+	FormatIPTables = "iptables"
+	FormatCIDR     = "cidr"
+	FormatNginx    = "nginx"
+	FormatRange    = "range"
+	FormatCSV      = "csv"
+	FormatNetsh    = "netsh"
+)
+
+// blockFormatter renders the header and the matched networks of the
+// generated list in one output format.
+type blockFormatter interface {
+	writeHeader(w io.Writer, comment string)
+	writeBlock(w io.Writer, entry blockEntry)
+}
+
+// blockEncloser is implemented by formatters whose blocks have to be wrapped
+// in an enclosing structure. Unlike the header, the structure is always
+// written.
+type blockEncloser interface {
+	writeStart(w io.Writer)
+	writeEnd(w io.Writer)
+}
+
+var blockFormatters = map[string]func(cfg *Config) blockFormatter{
+	FormatPlain: func(cfg *Config) blockFormatter {
+		return plainFormatter{names: cfg.Names, legend: cfg.legend()}
+	},
+	FormatIPSet:    func(cfg *Config) blockFormatter { return ipsetFormatter{setName: cfg.SetName} },
+	FormatIPTables: func(*Config) blockFormatter { return iptablesFormatter{} },
+	FormatCIDR:     func(*Config) blockFormatter { return cidrFormatter{} },
+	FormatNginx:    func(cfg *Config) blockFormatter { return nginxFormatter{variable: cfg.NginxVar} },
+	FormatRange:    func(cfg *Config) blockFormatter { return rangeFormatter{legend: cfg.legend()} },
+	FormatCSV: func(cfg *Config) blockFormatter {
+		return csvFormatter{names: cfg.Names, reasons: cfg.AnnotateReason, labelColumn: cfg.edition().labelColumn()}
+	},
+	FormatNetsh: func(cfg *Config) blockFormatter {
+		return &netshFormatter{rulePrefix: cfg.NetshRulePrefix, networks: map[string][]string{}}
+	},
+}
+
+// formatExtensions replace the extension of the output filename when several
+// formats are written in one run, so each format gets a file of its own.
+var formatExtensions = map[string]string{
+	FormatPlain:    ".txt",
+	FormatIPSet:    ".ipset",
+	FormatIPTables: ".rules",
+	FormatCIDR:     ".cidr",
+	FormatNginx:    ".conf",
+	FormatRange:    ".range",
+	FormatCSV:      ".csv",
+	FormatNetsh:    ".cmd",
+}
+
+// legend describes what follows the network on each line of the plain and
+// range formats.
+func (cfg *Config) legend() string {
+	if cfg.AnnotateReason {
+		return cfg.edition().labelLegend() + " ; reason"
+	}
+	return cfg.edition().labelLegend()
+}
+
+// writeComment writes the header comment, which may span several lines, as
+// # comment lines.
+func writeComment(w io.Writer, comment string) {
+	for line := range strings.SplitSeq(comment, "\n") {
+		fmt.Fprintf(w, "# %s\n", line)
+	}
+}
+
+// labelAndReason is the label of entry, followed by its reasons when they are
+// annotated.
+func labelAndReason(entry blockEntry) string {
+	if entry.reason == "" {
+		return entry.label
+	}
+	return entry.label + " ; " + entry.reason
+}
+
+func validateFormat(format string) error {
+	if _, ok := blockFormatters[format]; !ok {
+		formats := slices.Sorted(maps.Keys(blockFormatters))
+		return fmt.Errorf("unknown output format %q, expected one of: %s", format, strings.Join(formats, ", "))
+	}
+	return nil
+}
+
+// validateFormats checks a comma-separated list of output formats.
+func validateFormats(formats []string) error {
+	seen := map[string]struct{}{}
+	for _, format := range formats {
+		if err := validateFormat(format); err != nil {
+			return err
+		}
+		if _, duplicate := seen[format]; duplicate {
+			return fmt.Errorf("output format %q is listed more than once", format)
+		}
+		seen[format] = struct{}{}
+	}
+	return nil
+}
+
+func newBlockFormatter(cfg *Config, format string) (blockFormatter, error) {
+	if err := validateFormat(format); err != nil {
+		return nil, err
+	}
+	return blockFormatters[format](cfg), nil
+}
+
+// blockWriter writes blocks through a formatter and counts them. Unless
+// duplicates are allowed it drops blocks whose formatted line was already
+// written: a network can be matched by several rows, and formats that leave
+// out the country turn different matches into identical lines.
+type blockWriter struct {
+	w         io.Writer
+	formatter blockFormatter
+	// seen holds the lines written so far, to leave out duplicates.
+	seen map[string]struct{}
+	// sorted is set with LowMemory, whose networks come sorted so that a
+	// duplicate follows the line it repeats. Only the previous line is
+	// kept then, and seen holds just the lines of an appended list.
+	sorted   bool
+	previous string
+	line     bytes.Buffer
+	written  int
+	// labels counts the written blocks by label.
+	labels map[string]int
+	// reserve, when set, is called with the number of lines of each block
+	// before it is written.
+	reserve func(lines int)
+}
+
+func newBlockWriter(w io.Writer, formatter blockFormatter, cfg *Config) *blockWriter {
+	blockWriter := &blockWriter{w: w, formatter: formatter, labels: map[string]int{}}
+	if !cfg.AllowDuplicates {
+		blockWriter.sorted = cfg.LowMemory
+		if !cfg.LowMemory || cfg.Append {
+			blockWriter.seen = map[string]struct{}{}
+		}
+	}
+	return blockWriter
+}
+
+func (bw *blockWriter) writeBlock(entry blockEntry) {
+	// netsh collects the networks into rules written at the end, so what
+	// repeats is the network rather than the line, and it is left out
+	// before the formatter collects it.
+	_, batched := bw.formatter.(*netshFormatter)
+	if batched && bw.duplicate(entry.network) {
+		return
+	}
+	bw.line.Reset()
+	bw.formatter.writeBlock(&bw.line, entry)
+	if !batched && bw.duplicate(bw.line.String()) {
+		return
+	}
+	if bw.reserve != nil {
+		bw.reserve(bytes.Count(bw.line.Bytes(), []byte("\n")))
+	}
+	bw.w.Write(bw.line.Bytes())
+	bw.written++
+	bw.labels[entry.label]++
+}
+
+// duplicate reports whether line was written already, and remembers it
+// otherwise, in seen or, when sorted, as the previous line.
+func (bw *blockWriter) duplicate(line string) bool {
+	if _, duplicate := bw.seen[line]; duplicate {
+		return true
+	}
+	if bw.sorted {
+		if line == bw.previous {
+			return true
+		}
+		bw.previous = line
+	} else if bw.seen != nil {
+		bw.seen[line] = struct{}{}
+	}
+	return false
+}
+
+type plainFormatter struct {
+	names  bool
+	legend string
+}
+
+func (f plainFormatter) writeHeader(w io.Writer, comment string) {
+	writeComment(w, comment)
+	fmt.Fprintf(w, "# cidr ; %s\n", f.legend)
+}
+
+func (f plainFormatter) writeBlock(w io.Writer, entry blockEntry) {
+	if f.names && entry.countryName != "" {
+		fmt.Fprintf(w, "%s ; %s # %s\n", entry.network, labelAndReason(entry), entry.countryName)
+		return
+	}
+	fmt.Fprintf(w, "%s ; %s\n", entry.network, labelAndReason(entry))
+}
+
+// ipsetFormatter writes commands suitable for `ipset restore`.
+type ipsetFormatter struct {
+	setName string
+}
+
+func (ipsetFormatter) writeHeader(w io.Writer, comment string) {
+	writeComment(w, comment)
+}
+
+func (f ipsetFormatter) writeBlock(w io.Writer, entry blockEntry) {
+	fmt.Fprintf(w, "add %s %s\n", f.setName, entry.network)
+}
+
+// iptablesFormatter writes rules suitable for `iptables-restore`.
+type iptablesFormatter struct{}
+
+func (iptablesFormatter) writeHeader(w io.Writer, comment string) {
+	writeComment(w, comment)
+}
+
+func (iptablesFormatter) writeBlock(w io.Writer, entry blockEntry) {
+	fmt.Fprintf(w, "-A INPUT -s %s -j DROP\n", entry.network)
+}
+
+// cidrFormatter writes one bare network per line, for loaders that expect
+// nothing else on the line.
+type cidrFormatter struct{}
+
+func (cidrFormatter) writeHeader(w io.Writer, comment string) {
+	writeComment(w, comment)
+}
+
+func (cidrFormatter) writeBlock(w io.Writer, entry blockEntry) {
+	fmt.Fprintf(w, "%s\n", entry.network)
+}
+
+// rangeFormatter writes each network as the range from its first to its last
+// address, for loaders that don't understand CIDR notation.
+type rangeFormatter struct {
+	legend string
+}
+
+func (f rangeFormatter) writeHeader(w io.Writer, comment string) {
+	writeComment(w, comment)
+	fmt.Fprintf(w, "# start-end ; %s\n", f.legend)
+}
+
+func (rangeFormatter) writeBlock(w io.Writer, entry blockEntry) {
+	prefix, err := netip.ParsePrefix(entry.network)
+	if err != nil {
+		// Left as it is, like every format does with a network it can't
+		// parse.
+		fmt.Fprintf(w, "%s ; %s\n", entry.network, labelAndReason(entry))
+		return
+	}
+	fmt.Fprintf(w, "%s-%s ; %s\n", prefix.Masked().Addr(), lastAddr(prefix), labelAndReason(entry))
+}
+
+// csvFormatter writes CSV with a row naming the columns, for spreadsheets and
+// database imports. CSV has no comments, so it leaves out the header, and the
+// column row is written as the start of the file instead.
+type csvFormatter struct {
+	names       bool
+	reasons     bool
+	labelColumn string
+}
+
+func (csvFormatter) writeHeader(io.Writer, string) {}
+
+func (f csvFormatter) writeStart(w io.Writer) {
+	writeCSVRecord(w, f.record("network", f.labelColumn, "reason", "name")...)
+}
+
+func (f csvFormatter) writeBlock(w io.Writer, entry blockEntry) {
+	writeCSVRecord(w, f.record(entry.network, entry.label, entry.reason, entry.countryName)...)
+}
+
+// record leaves the reason and name fields out unless they are written.
+func (f csvFormatter) record(network, label, reason, name string) []string {
+	record := []string{network, label}
+	if f.reasons {
+		record = append(record, reason)
+	}
+	if f.names {
+		record = append(record, name)
+	}
+	return record
+}
+
+func (csvFormatter) writeEnd(io.Writer) {}
+
+// crlfWriter ends the lines written through it with CRLF instead of LF,
+// leaving the ones that end with CRLF already alone.
+type crlfWriter struct {
+	w io.Writer
+	// last is the last byte written, which a CR may be.
+	last byte
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	start := 0
+	for i, b := range p {
+		if b != '\n' {
+			continue
+		}
+		previous := c.last
+		if i > 0 {
+			previous = p[i-1]
+		}
+		if previous == '\r' {
+			continue
+		}
+		if _, err := c.w.Write(p[start:i]); err != nil {
+			return start, err
+		}
+		if _, err := io.WriteString(c.w, "\r\n"); err != nil {
+			return i, err
+		}
+		start = i + 1
+	}
+	if _, err := c.w.Write(p[start:]); err != nil {
+		return start, err
+	}
+	if len(p) > 0 {
+		c.last = p[len(p)-1]
+	}
+	return len(p), nil
+}
+
+// writeCSVRecord writes one row, quoting the fields that need it.
+func writeCSVRecord(w io.Writer, fields ...string) {
+	csvWriter := csv.NewWriter(w)
+	csvWriter.Write(fields)
+	csvWriter.Flush()
+}
+
+// nginxFormatter writes an nginx geo block that sets the variable to 1 for
+// the listed networks and to 0 for every other address.
+type nginxFormatter struct {
+	variable string
+}
+
+func (nginxFormatter) writeHeader(w io.Writer, comment string) {
+	writeComment(w, comment)
+}
+
+func (f nginxFormatter) writeStart(w io.Writer) {
+	fmt.Fprintf(w, "geo $%s {\n", f.variable)
+	fmt.Fprintf(w, "    default 0;\n")
+}
+
+func (nginxFormatter) writeBlock(w io.Writer, entry blockEntry) {
+	fmt.Fprintf(w, "    %s 1;\n", entry.network)
+}
+
+func (nginxFormatter) writeEnd(w io.Writer) {
+	fmt.Fprintf(w, "}\n")
+}
+
+// netshMaxLine is the longest command line cmd.exe runs.
+const netshMaxLine = 8191
+
+// netshFormatter writes a batch file of netsh commands adding Windows
+// Firewall rules that block the networks. A rule takes its networks as one
+// comma-separated remoteip list, so the networks are collected per label and
+// written at the end, in as many rules as it takes to keep every command
+// within netshMaxLine.
+type netshFormatter struct {
+	rulePrefix string
+	labels     []string
+	networks   map[string][]string
+}
+
+func (*netshFormatter) writeHeader(w io.Writer, comment string) {
+	for line := range strings.SplitSeq(comment, "\n") {
+		fmt.Fprintf(w, "REM %s\r\n", line)
+	}
+}
+
+func (*netshFormatter) writeStart(io.Writer) {}
+
+func (f *netshFormatter) writeBlock(_ io.Writer, entry blockEntry) {
+	if _, seen := f.networks[entry.label]; !seen {
+		f.labels = append(f.labels, entry.label)
+	}
+	f.networks[entry.label] = append(f.networks[entry.label], entry.network)
+}
+
+func (f *netshFormatter) writeEnd(w io.Writer) {
+	for _, label := range f.labels {
+		rule := 0
+		var line strings.Builder
+		for _, network := range f.networks[label] {
+			if line.Len() > 0 && line.Len()+len(",")+len(network) > netshMaxLine {
+				fmt.Fprintf(w, "%s\r\n", line.String())
+				line.Reset()
+			}
+			if line.Len() == 0 {
+				rule++
+				fmt.Fprintf(&line, "netsh advfirewall firewall add rule name=\"%s %s %d\" dir=in action=block remoteip=%s", f.rulePrefix, label, rule, network)
+				continue
+			}
+			fmt.Fprintf(&line, ",%s", network)
+		}
+		if line.Len() > 0 {
+			fmt.Fprintf(w, "%s\r\n", line.String())
+		}
+	}
+	f.labels = nil
+	clear(f.networks)
+}
+
+func validateNetshRulePrefix(prefix string) error {
+	if strings.ContainsAny(prefix, "\"%\r\n") {
+		return fmt.Errorf("invalid netsh rule name prefix %q", prefix)
+	}
+	return nil
+}
+
+var nginxVariablePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+func validateNginxVariable(variable string) error {
+	if !nginxVariablePattern.MatchString(variable) {
+		return fmt.Errorf("invalid nginx variable name %q", variable)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package blgen
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNames(t *testing.T) {
+	blocks := testBlocksHeader + `2.56.8.0/24,2017370,2017370,,0,0,
+8.8.8.0/24,6252001,6252001,,0,0,
+9.9.9.0/24,6255148,6255148,,0,0,
+`
+	cfg := testConfig(t, countryArchive(t, blocks))
+	cfg.BlockedCountries = codes("RU", "US")
+	cfg.BlockedContinents = codes("EU")
+	cfg.Names = true
+	result := generate(t, cfg)
+	want := []string{"2.56.8.0/24 ; RU, EU* # Russia", "8.8.8.0/24 ; US # United States", "9.9.9.0/24 ; EU*"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// A row matching on all three geoname columns, and a row repeated, each give
+// a single line unless duplicates are allowed.
+func TestDuplicateLines(t *testing.T) {
+	blocks := testBlocksHeader + `10.0.0.0/24,2017370,2921044,2963597,0,0,
+10.0.1.0/24,2017370,2017370,2017370,0,0,
+10.0.1.0/24,2017370,2017370,2017370,0,0,
+`
+	archive := countryArchive(t, blocks)
+	tests := []struct {
+		allowDuplicates bool
+		want            []string
+	}{
+		{false, []string{"10.0.0.0/24 ; RU", "10.0.1.0/24 ; RU"}},
+		{true, []string{"10.0.0.0/24 ; RU", "10.0.1.0/24 ; RU", "10.0.1.0/24 ; RU"}},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.BlockedCountries = codes("RU", "DE", "IE")
+		cfg.AllowDuplicates = test.allowDuplicates
+		result := generate(t, cfg)
+		if got := listLines(t, result.OutputPath); !slices.Equal(got, test.want) {
+			t.Errorf("allow duplicates %t: got %q, want %q", test.allowDuplicates, got, test.want)
+		}
+	}
+}
+
+func TestCIDRLines(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	tests := []struct {
+		sort, aggregate bool
+		want            []string
+	}{
+		{false, false, []string{"2.56.8.0/24", "2.56.9.0/24", "2.56.10.0/23", "185.1.1.0/24"}},
+		{true, false, []string{"2.56.8.0/24", "2.56.9.0/24", "2.56.10.0/23", "185.1.1.0/24"}},
+		{false, true, []string{"2.56.8.0/22", "185.1.1.0/24"}},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.Format = FormatCIDR
+		cfg.Sort = test.sort
+		cfg.Aggregate = test.aggregate
+		result := generate(t, cfg)
+		lines := listLines(t, result.OutputPath)
+		for _, line := range lines {
+			if network, err := netip.ParsePrefix(line); err != nil || network != network.Masked() {
+				t.Errorf("line %q isn't a network in CIDR notation", line)
+			}
+		}
+		if !slices.Equal(lines, test.want) {
+			t.Errorf("sort %t, aggregate %t: got %q, want %q", test.sort, test.aggregate, lines, test.want)
+		}
+	}
+}
+
+// parseNginxGeo parses a geo block the way nginx reads it, returning its
+// variable, default value and networks.
+func parseNginxGeo(t *testing.T, config string) (variable, defaultValue string, networks []netip.Prefix) {
+	t.Helper()
+	var statements []string
+	for line := range strings.Lines(config) {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			statements = append(statements, line)
+		}
+	}
+	if len(statements) < 3 {
+		t.Fatalf("no geo block in %q", config)
+	}
+	if _, err := fmt.Sscanf(statements[0], "geo $%s {", &variable); err != nil {
+		t.Fatalf("block opened with %q: %v", statements[0], err)
+	}
+	if statements[len(statements)-1] != "}" {
+		t.Fatalf("block closed with %q", statements[len(statements)-1])
+	}
+	for i, statement := range statements[1 : len(statements)-1] {
+		key, value, found := strings.Cut(strings.TrimSuffix(statement, ";"), " ")
+		if !found || !strings.HasSuffix(statement, ";") {
+			t.Fatalf("malformed statement %q", statement)
+		}
+		if key == "default" {
+			if i != 0 {
+				t.Errorf("default set after the networks")
+			}
+			defaultValue = value
+			continue
+		}
+		network, err := netip.ParsePrefix(key)
+		if err != nil || value != "1" {
+			t.Errorf("statement %q doesn't set a network to 1", statement)
+		}
+		networks = append(networks, network)
+	}
+	return variable, defaultValue, networks
+}
+
+func TestNginxGeoBlock(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	tests := []struct {
+		variable, want string
+		countries      []string
+		networks       int
+	}{
+		{"", "blocked", []string{"RU"}, 4},
+		{"$geo_blocked", "geo_blocked", []string{"RU", "DE"}, 5},
+		{"", "blocked", []string{"UX"}, 0},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.Format = FormatNginx
+		cfg.NginxVar = test.variable
+		cfg.BlockedCountries = codes(test.countries...)
+		cfg.AllowEmptyOutput = true
+		variable, defaultValue, networks := parseNginxGeo(t, readFile(t, generate(t, cfg).OutputPath))
+		if variable != test.want || defaultValue != "0" || len(networks) != test.networks {
+			t.Errorf("%q: got geo $%s with default %s and %d networks, want $%s with default 0 and %d networks",
+				test.countries, variable, defaultValue, len(networks), test.want, test.networks)
+		}
+	}
+}
+
+func TestRangeFormat(t *testing.T) {
+	tests := []struct {
+		network, want string
+	}{
+		{"1.2.3.0/24", "1.2.3.0-1.2.3.255"},
+		{"2.56.10.0/23", "2.56.10.0-2.56.11.255"},
+		{"5.1.0.0/16", "5.1.0.0-5.1.255.255"},
+		{"8.8.8.8/32", "8.8.8.8-8.8.8.8"},
+		{"0.0.0.0/0", "0.0.0.0-255.255.255.255"},
+		{"2001:db8::/32", "2001:db8::-2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+		{"2001:db8:1:2::/64", "2001:db8:1:2::-2001:db8:1:2:ffff:ffff:ffff:ffff"},
+		{"2001:db8::1/128", "2001:db8::1-2001:db8::1"},
+		{"::ffff:1.2.3.0/120", "::ffff:1.2.3.0-::ffff:1.2.3.255"},
+	}
+	for _, test := range tests {
+		var line strings.Builder
+		rangeFormatter{}.writeBlock(&line, blockEntry{network: test.network, geoname: geoname{label: "RU"}})
+		if want := test.want + " ; RU\n"; line.String() != want {
+			t.Errorf("%s written as %q, want %q", test.network, line.String(), want)
+		}
+	}
+
+	// An aggregated network spans the whole supernet.
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Format = FormatRange
+	cfg.Aggregate = true
+	result := generate(t, cfg)
+	want := []string{"2.56.8.0-2.56.11.255 ; RU", "185.1.1.0-185.1.1.255 ; RU"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSeveralFormats(t *testing.T) {
+	// The malformed row is logged once for every scan of the blocks file.
+	cfg := testConfig(t, countryArchive(t, testBlocks+"2.56.300.0/24,2017370,2017370,,0,0,\n"))
+	cfg.Format = "plain,ipset,cidr"
+	cfg.OutputFilename = "blocked.txt"
+	cfg.MaxErrors = 1
+	log := captureLog(&cfg)
+	result := generate(t, cfg)
+
+	want := map[string][]string{
+		"blocked.txt":   {"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"},
+		"blocked.ipset": {"add blocked 2.56.8.0/24", "add blocked 2.56.9.0/24", "add blocked 2.56.10.0/23", "add blocked 185.1.1.0/24"},
+		"blocked.cidr":  {"2.56.8.0/24", "2.56.9.0/24", "2.56.10.0/23", "185.1.1.0/24"},
+	}
+	var names []string
+	for _, path := range result.OutputPaths {
+		name := filepath.Base(path)
+		names = append(names, name)
+		if got := listLines(t, path); !slices.Equal(got, want[name]) {
+			t.Errorf("%s holds %q, want %q", name, got, want[name])
+		}
+	}
+	if want := []string{"blocked.txt", "blocked.ipset", "blocked.cidr"}; !slices.Equal(names, want) {
+		t.Errorf("wrote %q, want %q", names, want)
+	}
+	if scans := strings.Count(log.String(), "skipping malformed row"); scans != 1 {
+		t.Errorf("blocks file scanned %d times, want once", scans)
+	}
+}
+
+func TestCSVFormat(t *testing.T) {
+	locations := testLocations + `1835841,en,AS,Asia,KR,"Korea, Republic of",0
+2635167,en,EU,Europe,GB,"United Kingdom of ""Great"" Britain",0
+`
+	blocks := testBlocksHeader + `10.0.2.0/24,2635167,2635167,,0,0,
+10.0.1.0/24,1835841,1835841,,0,0,
+10.0.0.0/24,1835841,1835841,,0,0,
+10.0.1.0/24,1835841,1835841,,0,0,
+`
+	cfg := testConfig(t, writeZip(t, map[string]string{
+		testArchiveDir + "GeoLite2-Country-Locations-en.csv": locations,
+		testArchiveDir + "GeoLite2-Country-Blocks-IPv4.csv":  blocks,
+	}))
+	cfg.BlockedCountries = codes("KR", "GB")
+	cfg.Format = FormatCSV
+	cfg.Names = true
+	cfg.Sort = true
+	records, err := csv.NewReader(strings.NewReader(readFile(t, generate(t, cfg).OutputPath))).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"network", "country", "name"},
+		{"10.0.2.0/24", "GB", `United Kingdom of "Great" Britain`},
+		{"10.0.0.0/24", "KR", "Korea, Republic of"},
+		{"10.0.1.0/24", "KR", "Korea, Republic of"},
+	}
+	if !slices.EqualFunc(records, want, slices.Equal) {
+		t.Errorf("got %q, want %q", records, want)
+	}
+}
+
+// sectionLines returns the section headings and the networks of the list at
+// path, leaving out its header.
+func sectionLines(t *testing.T, path string) []string {
+	t.Helper()
+	var lines []string
+	for line := range strings.Lines(readFile(t, path)) {
+		line = strings.TrimSuffix(line, "\n")
+		if !strings.HasPrefix(line, "# ") || strings.HasPrefix(line, "# --- ") {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestGrouped(t *testing.T) {
+	blocks := testBlocksHeader + `185.1.1.0/24,6252001,2017370,,0,0,
+5.1.0.0/16,2921044,2921044,,0,0,
+2.56.10.0/23,2017370,2017370,,0,0,
+36.0.0.0/12,1814991,1814991,,0,0,
+2.56.9.0/24,2017370,2017370,,0,0,
+2.56.8.0/24,2017370,2017370,,0,0,
+`
+	archive := countryArchive(t, blocks)
+	want := []string{
+		"# --- CN ---", "36.0.0.0/12",
+		"# --- DE ---", "5.1.0.0/16",
+		"# --- RU ---", "2.56.8.0/24", "2.56.9.0/24", "2.56.10.0/23", "185.1.1.0/24",
+	}
+	for _, lowMemory := range []bool{false, true} {
+		cfg := testConfig(t, archive)
+		cfg.BlockedCountries = codes("RU", "DE", "CN")
+		cfg.Format = FormatCIDR
+		cfg.Grouped = true
+		cfg.LowMemory = lowMemory
+		if got := sectionLines(t, generate(t, cfg).OutputPath); !slices.Equal(got, want) {
+			t.Errorf("low memory %t: got %q, want %q", lowMemory, got, want)
+		}
+	}
+
+	// A chunk starting within a section repeats its heading.
+	cfg := testConfig(t, archive)
+	cfg.BlockedCountries = codes("RU", "DE", "CN")
+	cfg.Format = FormatCIDR
+	cfg.Grouped = true
+	cfg.MaxLines = 6
+	result := generate(t, cfg)
+	if len(result.OutputPaths) != 2 {
+		t.Fatalf("got %d chunks, want 2", len(result.OutputPaths))
+	}
+	if got := sectionLines(t, result.OutputPaths[1]); len(got) == 0 || got[0] != "# --- RU ---" {
+		t.Errorf("second chunk starts with %q, want the heading of RU", got)
+	}
+}
+
+func TestNetshChunksRules(t *testing.T) {
+	var blocks strings.Builder
+	blocks.WriteString(testBlocksHeader)
+	for i := range 2000 {
+		fmt.Fprintf(&blocks, "10.%d.%d.0/24,2017370,2017370,,0,0,\n", i/256, i%256)
+	}
+	for i := range 10 {
+		fmt.Fprintf(&blocks, "5.%d.0.0/16,2921044,2921044,,0,0,\n", i)
+	}
+	cfg := testConfig(t, countryArchive(t, blocks.String()))
+	cfg.BlockedCountries = codes("RU", "DE")
+	cfg.Format = FormatNetsh
+	cfg.NetshRulePrefix = "geo"
+	result := generate(t, cfg)
+
+	rules := map[string]int{}
+	networks := 0
+	for _, line := range listLines(t, result.OutputPath) {
+		if strings.HasPrefix(line, "REM ") {
+			continue
+		}
+		if !strings.HasSuffix(line, "\r") {
+			t.Errorf("rule %.60q doesn't end in CRLF", line)
+		}
+		line = strings.TrimSuffix(line, "\r")
+		if len(line) > netshMaxLine {
+			t.Errorf("rule of %d characters", len(line))
+		}
+		var label string
+		var rule int
+		if _, err := fmt.Sscanf(line, "netsh advfirewall firewall add rule name=\"geo %s %d\"", &label, &rule); err != nil {
+			t.Fatalf("%.80q: %v", line, err)
+		}
+		rules[label]++
+		if rule != rules[label] {
+			t.Errorf("rule %d of %s numbered %d", rules[label], label, rule)
+		}
+		_, remote, _ := strings.Cut(line, " remoteip=")
+		networks += len(strings.Split(remote, ","))
+	}
+	if rules["RU"] < 2 || rules["DE"] != 1 {
+		t.Errorf("got %v rules, want several of RU and one of DE", rules)
+	}
+	if networks != 2010 {
+		t.Errorf("rules list %d networks, want 2010", networks)
+	}
+}
+
+func TestNetshLeavesOutRepeatedNetworks(t *testing.T) {
+	blocks := testBlocksHeader + `10.0.10.0/24,2017370,2017370,,0,0,
+10.0.11.0/24,2017370,2017370,,0,0,
+10.0.10.0/24,2017370,2017370,,0,0,
+`
+	cfg := testConfig(t, countryArchive(t, blocks))
+	cfg.Format = FormatNetsh
+	cfg.NoHeader = true
+	result := generate(t, cfg)
+	want := `netsh advfirewall firewall add rule name="blgen RU 1" dir=in action=block remoteip=10.0.10.0/24,10.0.11.0/24` + "\r"
+	if got := listLines(t, result.OutputPath); len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
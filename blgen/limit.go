@@ -0,0 +1,52 @@
+package blgen
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// requestLimiter spaces out the requests to the download server, so retries
+// and extra downloads don't trip its rate limit.
+type requestLimiter struct {
+	mu    sync.Mutex
+	delay time.Duration
+	last  time.Time
+}
+
+func newRequestLimiter(delay time.Duration) *requestLimiter {
+	return &requestLimiter{delay: delay}
+}
+
+// wait blocks until at least the delay has passed since the previous request.
+func (l *requestLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+	next := l.last.Add(l.delay)
+	now := time.Now()
+	if next.Before(now) {
+		next = now
+	}
+	// The slot is taken before waiting, so concurrent requests queue up
+	// behind each other.
+	l.last = next
+	l.mu.Unlock()
+
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttled doubles the delay after the server answered 429 Too Many
+// Requests, to at least retryBaseDelay and at most retryMaxDelay, and returns
+// the new delay.
+func (l *requestLimiter) throttled() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.delay = min(max(2*l.delay, retryBaseDelay), retryMaxDelay)
+	return l.delay
+}
@@ -0,0 +1,62 @@
+package blgen
+
+import (
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// requestTimes makes cfg send its requests through a client recording when
+// each request is sent.
+func requestTimes(cfg *Config) func() []time.Time {
+	var mu sync.Mutex
+	var times []time.Time
+	cfg.HTTPClient = &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		times = append(times, time.Now())
+		mu.Unlock()
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	return func() []time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return times
+	}
+}
+
+// checkSpacing reports requests closer together than delay.
+func checkSpacing(t *testing.T, times []time.Time, delay time.Duration) {
+	t.Helper()
+	if len(times) < 2 {
+		t.Fatalf("%d requests, want at least two", len(times))
+	}
+	for i := 1; i < len(times); i++ {
+		if spacing := times[i].Sub(times[i-1]); spacing < delay {
+			t.Errorf("request %d came %v after the one before, want at least %v", i+1, spacing, delay)
+		}
+	}
+}
+
+func TestRequestDelay(t *testing.T) {
+	const delay = 100 * time.Millisecond
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	cfg := server.config(t)
+	cfg.RequestDelay = delay
+	times := requestTimes(&cfg)
+	generate(t, cfg)
+	checkSpacing(t, times(), delay)
+}
+
+// A 429 answer widens the delay of the requests after it, without a delay
+// configured.
+func TestTooManyRequestsWidensDelay(t *testing.T) {
+	defer func(delay time.Duration) { retryBaseDelay = delay }(retryBaseDelay)
+	retryBaseDelay = 50 * time.Millisecond
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	failDownloads(server, 1, http.StatusTooManyRequests)
+	cfg := server.config(t)
+	times := requestTimes(&cfg)
+	generate(t, cfg)
+	checkSpacing(t, times(), retryBaseDelay)
+}
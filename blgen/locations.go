@@ -0,0 +1,277 @@
+package blgen
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// geoname is what the list records about a matched location.
+type geoname struct {
+	// label is the country code, the continent code marked with a *, or
+	// both when the location matched on both.
+	label       string
+	countryName string
+	// country is the code of the country the location is in, if any.
+	country string
+	// reason lists the match fields the network matched on, when they are
+	// annotated.
+	reason string
+}
+
+// blockEntry is a single network written to the list.
+type blockEntry struct {
+	network string
+	geoname
+}
+
+// getGeonameIDs returns the geonames networks are listed for, and the IDs of
+// the geonames in excluded countries and subdivisions, whose networks are
+// never listed.
+func getGeonameIDs(ctx context.Context, tmpDir, locationsCSV string, cfg *Config) (map[string]geoname, map[string]struct{}, error) {
+	allowMode := cfg.Mode == ModeAllow
+	if allowMode && len(cfg.BlockedCountries) == 0 && len(cfg.BlockedContinents) == 0 && len(cfg.BlockedSubdivisions) == 0 {
+		// An empty allowlist is treated as "nothing configured" rather than
+		// "block everything", so it produces a header-only list.
+		return map[string]geoname{}, nil, nil
+	}
+
+	locationsCSVPath := filepath.Join(tmpDir, locationsCSV)
+	locationsCSVFile, err := os.Open(locationsCSVPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open %s: %w", locationsCSV, err)
+	}
+	defer locationsCSVFile.Close()
+
+	csvData := csv.NewReader(locationsCSVFile)
+	csvData.ReuseRecord = true
+	csvHeader, err := csvData.Read()
+	if err != nil {
+		if err == io.EOF {
+			return map[string]geoname{}, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read %s CSV header: %w", locationsCSV, err)
+	}
+	if err := cfg.checkSchema(locationsCSV, csvHeader); err != nil {
+		return nil, nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range csvHeader {
+		columns[name] = i
+	}
+	neededFields := []string{"geoname_id", "country_iso_code", "continent_code"}
+	if len(cfg.BlockedSubdivisions) > 0 || len(cfg.ExcludedSubdivisions) > 0 {
+		neededFields = append(neededFields, "subdivision_1_iso_code")
+	}
+	for _, column := range neededFields {
+		if _, ok := columns[column]; !ok {
+			return nil, nil, fmt.Errorf("missing needed column: %s", column)
+		}
+	}
+
+	countryNameIdx, hasCountryName := columns["country_name"]
+
+	geonameIDsSet := make(map[string]geoname, 75000)
+	excludedIDs := map[string]struct{}{}
+	seenCountries := map[string]struct{}{}
+	seenContinents := map[string]struct{}{}
+	seenSubdivisions := map[string]struct{}{}
+	seenExcluded := map[string]struct{}{}
+	seenExcludedSubdivisions := map[string]struct{}{}
+
+	start := time.Now()
+	rows := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		line, err := csvData.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, nil, fmt.Errorf("failed to read %s CSV line: %w", locationsCSV, err)
+		}
+		rows++
+		geonameID := line[columns["geoname_id"]]
+		countryISOCode := strings.ToUpper(line[columns["country_iso_code"]])
+		continentMMCode := strings.ToUpper(line[columns["continent_code"]])
+		countryName := ""
+		if hasCountryName {
+			countryName = line[countryNameIdx]
+		}
+		_, isCountryBlocked := cfg.BlockedCountries[countryISOCode]
+		_, isContinentBlocked := cfg.BlockedContinents[continentMMCode]
+		subdivisionCode := ""
+		isSubdivisionBlocked := false
+		isSubdivisionExcluded := false
+		if len(cfg.BlockedSubdivisions) > 0 || len(cfg.ExcludedSubdivisions) > 0 {
+			// Subdivisions are matched in ISO 3166-2 form, since the
+			// subdivision code alone is only unique within its country.
+			if code := line[columns["subdivision_1_iso_code"]]; code != "" && countryISOCode != "" {
+				subdivisionCode = countryISOCode + "-" + strings.ToUpper(code)
+				_, isSubdivisionBlocked = cfg.BlockedSubdivisions[subdivisionCode]
+				_, isSubdivisionExcluded = cfg.ExcludedSubdivisions[subdivisionCode]
+			}
+		}
+		if isCountryBlocked {
+			seenCountries[countryISOCode] = struct{}{}
+		}
+		if isContinentBlocked {
+			seenContinents[continentMMCode] = struct{}{}
+		}
+		if isSubdivisionBlocked {
+			seenSubdivisions[subdivisionCode] = struct{}{}
+		}
+		if _, isExcluded := cfg.ExcludedCountries[countryISOCode]; isExcluded {
+			// Excludes win over every include, so the geoname is never
+			// listed.
+			seenExcluded[countryISOCode] = struct{}{}
+			excludedIDs[geonameID] = struct{}{}
+			continue
+		}
+		if isSubdivisionExcluded {
+			seenExcludedSubdivisions[subdivisionCode] = struct{}{}
+			excludedIDs[geonameID] = struct{}{}
+			continue
+		}
+		if allowMode {
+			// In allow mode the configured codes are the ones to keep, so the
+			// set is built from every other geoname instead.
+			if isCountryBlocked || isContinentBlocked || isSubdivisionBlocked {
+				continue
+			}
+			if countryISOCode != "" {
+				geonameIDsSet[geonameID] = geoname{label: cfg.countryLabel(countryISOCode), countryName: countryName, country: countryISOCode}
+			} else {
+				geonameIDsSet[geonameID] = geoname{label: continentMMCode + "*", countryName: countryName}
+			}
+			continue
+		}
+		var labels []string
+		if isCountryBlocked {
+			labels = append(labels, cfg.countryLabel(countryISOCode))
+		}
+		if isSubdivisionBlocked {
+			labels = append(labels, subdivisionCode)
+		}
+		if isContinentBlocked {
+			labels = append(labels, continentMMCode+"*")
+		}
+		if len(labels) > 0 {
+			geonameIDsSet[geonameID] = geoname{label: strings.Join(labels, ", "), countryName: countryName, country: countryISOCode}
+		}
+	}
+
+	cfg.logThroughput("locations", locationsCSV, rows, csvData.InputOffset(), time.Since(start))
+
+	if err := checkUnmatchedCodes(cfg, locationsCSV, seenCountries, seenContinents, seenSubdivisions, seenExcluded, seenExcludedSubdivisions); err != nil {
+		return nil, nil, err
+	}
+	return geonameIDsSet, excludedIDs, nil
+}
+
+// readGeonames returns every geoname of the locations file, labelled with
+// its country code, or with its continent code marked with a * when it has
+// no country.
+func readGeonames(ctx context.Context, tmpDir, locationsCSV string, cfg *Config) (map[string]geoname, error) {
+	locationsCSVFile, err := os.Open(filepath.Join(tmpDir, locationsCSV))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", locationsCSV, err)
+	}
+	defer locationsCSVFile.Close()
+
+	csvData := csv.NewReader(locationsCSVFile)
+	csvData.ReuseRecord = true
+	csvHeader, err := csvData.Read()
+	if err != nil {
+		if err == io.EOF {
+			return map[string]geoname{}, nil
+		}
+		return nil, fmt.Errorf("failed to read %s CSV header: %w", locationsCSV, err)
+	}
+	if err := cfg.checkSchema(locationsCSV, csvHeader); err != nil {
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range csvHeader {
+		columns[name] = i
+	}
+	for _, column := range []string{"geoname_id", "country_iso_code", "continent_code"} {
+		if _, ok := columns[column]; !ok {
+			return nil, fmt.Errorf("missing needed column: %s", column)
+		}
+	}
+	countryNameIdx, hasCountryName := columns["country_name"]
+
+	geonames := make(map[string]geoname, 75000)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		line, err := csvData.Read()
+		if err != nil {
+			if err == io.EOF {
+				return geonames, nil
+			}
+			return nil, fmt.Errorf("failed to read %s CSV line: %w", locationsCSV, err)
+		}
+		country := geoname{label: strings.ToUpper(line[columns["country_iso_code"]])}
+		if country.label == "" {
+			country.label = strings.ToUpper(line[columns["continent_code"]]) + "*"
+		}
+		if hasCountryName {
+			country.countryName = line[countryNameIdx]
+		}
+		geonames[line[columns["geoname_id"]]] = country
+	}
+}
+
+// checkUnmatchedCodes warns about configured codes that never appeared in the
+// locations file, which usually means a typo. In strict mode it fails instead.
+func checkUnmatchedCodes(cfg *Config, locationsCSV string, seenCountries, seenContinents, seenSubdivisions, seenExcluded, seenExcludedSubdivisions map[string]struct{}) error {
+	var unmatched []string
+	for code := range cfg.BlockedCountries {
+		if _, seen := seenCountries[code]; !seen {
+			unmatched = append(unmatched, "country code "+code)
+		}
+	}
+	for code := range cfg.BlockedContinents {
+		if _, seen := seenContinents[code]; !seen {
+			unmatched = append(unmatched, "continent code "+code)
+		}
+	}
+	for code := range cfg.BlockedSubdivisions {
+		if _, seen := seenSubdivisions[code]; !seen {
+			unmatched = append(unmatched, "subdivision code "+code)
+		}
+	}
+	for code := range cfg.ExcludedCountries {
+		if _, seen := seenExcluded[code]; !seen {
+			unmatched = append(unmatched, "excluded country code "+code)
+		}
+	}
+	for code := range cfg.ExcludedSubdivisions {
+		if _, seen := seenExcludedSubdivisions[code]; !seen {
+			unmatched = append(unmatched, "excluded subdivision code "+code)
+		}
+	}
+	if len(unmatched) == 0 {
+		return nil
+	}
+
+	slices.Sort(unmatched)
+	if cfg.Strict {
+		return fmt.Errorf("configured codes not found in %s: %s", locationsCSV, strings.Join(unmatched, ", "))
+	}
+	for _, code := range unmatched {
+		cfg.Logger.Warn("configured code not found", "code", code, "path", locationsCSV)
+	}
+	return nil
+}
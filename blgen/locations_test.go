@@ -0,0 +1,172 @@
+package blgen
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestModes(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	tests := []struct {
+		mode string
+		want []string
+	}{
+		{ModeBlock, []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}},
+		{ModeAllow, []string{"5.1.0.0/16 ; DE", "5.2.0.0/16 ; IE", "8.8.8.0/24 ; US", "9.9.9.0/24 ; EU*", "36.0.0.0/12 ; CN"}},
+	}
+	var networks []string
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.Mode = test.mode
+		result := generate(t, cfg)
+		lines := listLines(t, result.OutputPath)
+		if !slices.Equal(lines, test.want) {
+			t.Errorf("%s: got %q, want %q", test.mode, lines, test.want)
+		}
+		header := readFile(t, result.OutputPath)
+		if !strings.Contains(header, "in "+test.mode+" mode") {
+			t.Errorf("%s: header doesn't name the mode: %q", test.mode, header)
+		}
+		for _, line := range lines {
+			network, _, _ := strings.Cut(line, " ; ")
+			networks = append(networks, network)
+		}
+	}
+
+	// Between them, the two modes list every network exactly once.
+	var all []string
+	for _, row := range strings.Split(strings.TrimSpace(testBlocks), "\n")[1:] {
+		network, _, _ := strings.Cut(row, ",")
+		all = append(all, network)
+	}
+	slices.Sort(networks)
+	slices.Sort(all)
+	if !slices.Equal(networks, all) {
+		t.Errorf("the modes list %q, want every network once: %q", networks, all)
+	}
+}
+
+func TestAllowModeWithoutCodes(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Mode = ModeAllow
+	cfg.BlockedCountries = nil
+	result := generate(t, cfg)
+	if lines := listLines(t, result.OutputPath); len(lines) != 0 || result.NetworksWritten != 0 {
+		t.Errorf("empty allowlist listed %q", lines)
+	}
+}
+
+func TestBlockedContinent(t *testing.T) {
+	cfg := testConfig(t, "")
+	cfg.BlockedCountries = nil
+	cfg.BlockedContinents = codes("EU")
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "locations.csv"), []byte(testLocations), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	geonames, _, err := getGeonameIDs(t.Context(), dir, "locations.csv", &cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := slices.Sorted(maps.Keys(geonames))
+	want := []string{"2017370", "2921044", "2963597", "6255148"}
+	if !slices.Equal(got, want) {
+		t.Errorf("EU matched the geonames %q, want the European ones %q", got, want)
+	}
+}
+
+func TestBlockedContinentAndCountry(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.BlockedCountries = codes("CN")
+	cfg.BlockedContinents = codes("EU")
+	result := generate(t, cfg)
+	want := []string{"2.56.8.0/24 ; EU*", "2.56.9.0/24 ; EU*", "2.56.10.0/23 ; EU*", "5.1.0.0/16 ; EU*", "5.2.0.0/16 ; EU*", "9.9.9.0/24 ; EU*", "36.0.0.0/12 ; CN", "185.1.1.0/24 ; EU*"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUnmatchedCodes(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+
+	cfg := testConfig(t, archive)
+	cfg.BlockedCountries = codes("RU", "UX")
+	log := captureLog(&cfg)
+	result := generate(t, cfg)
+	if !strings.Contains(log.String(), `code="country code UX"`) {
+		t.Errorf("no warning about UX logged: %s", log.String())
+	}
+	if result.NetworksWritten != 4 {
+		t.Errorf("%d networks written for RU, want 4", result.NetworksWritten)
+	}
+
+	cfg = testConfig(t, archive)
+	cfg.BlockedCountries = codes("RU", "UX")
+	cfg.Strict = true
+	_, err := Generate(t.Context(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "country code UX") || strings.Contains(err.Error(), "RU") {
+		t.Errorf("got %v, want only UX reported", err)
+	}
+	if _, err := os.Stat(filepath.Join(cfg.OutputFilePath, DefaultOutputFilename)); !os.IsNotExist(err) {
+		t.Errorf("list written in spite of the unknown code: %v", err)
+	}
+}
+
+func TestExcludedCountry(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	// The exclude wins whether the country is blocked through its continent
+	// or by its own code.
+	for _, blocked := range [][]string{nil, {"IE"}} {
+		cfg := testConfig(t, archive)
+		cfg.BlockedCountries = codes(blocked...)
+		cfg.BlockedContinents = codes("EU")
+		cfg.ExcludedCountries = codes("IE")
+		result := generate(t, cfg)
+		lines := listLines(t, result.OutputPath)
+		if slices.ContainsFunc(lines, func(line string) bool { return strings.HasPrefix(line, "5.2.") }) {
+			t.Errorf("blocking %q: Irish network listed in %q", blocked, lines)
+		}
+		if !slices.Contains(lines, "5.1.0.0/16 ; EU*") || result.NetworksWritten != 6 {
+			t.Errorf("blocking %q: got %q, want every other European network", blocked, lines)
+		}
+	}
+}
+
+func TestLocale(t *testing.T) {
+	archive := writeZip(t, map[string]string{
+		testArchiveDir + "GeoLite2-Country-Locations-de.csv": `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union
+2017370,de,EU,Europa,RU,Russland,0
+2921044,de,EU,Europa,DE,Deutschland,1
+`,
+		// The blocks file is found by its pattern.
+		testArchiveDir + "GeoLite2-Country-Blocks-IPv4-Renamed.csv": testBlocksHeader + `2.56.8.0/24,2017370,2017370,,0,0,
+5.1.0.0/16,2921044,2921044,,0,0,
+`,
+	})
+	cfg := testConfig(t, archive)
+	cfg.BlockedCountries = codes("RU", "DE")
+	cfg.Locale = "de"
+	cfg.Names = true
+	want := []string{"2.56.8.0/24 ; RU # Russland", "5.1.0.0/16 ; DE # Deutschland"}
+	if got := listLines(t, generate(t, cfg).OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	for _, locale := range []string{"", "fr"} {
+		cfg := testConfig(t, archive)
+		cfg.Locale = locale
+		_, err := Generate(t.Context(), cfg)
+		if err == nil || !strings.Contains(err.Error(), "missing GeoLite2-Country-Locations-") || !strings.Contains(err.Error(), "locale") {
+			t.Errorf("locale %q: got %v, want the locations file reported missing", locale, err)
+		}
+	}
+	cfg = testConfig(t, archive)
+	cfg.Locale = "../de"
+	if err := cfg.Prepare(); err == nil {
+		t.Error("invalid locale accepted")
+	}
+}
@@ -0,0 +1,31 @@
+package blgen
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrLocked is returned by Generate when another run holds the lock file.
+var ErrLocked = errors.New("another run holds the lock file")
+
+// acquireLock locks path without waiting and returns a function releasing
+// the lock. The lock is released by the OS as well when the process exits,
+// so a crashed run never leaves it behind.
+func acquireLock(path string) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("%w %s", ErrLocked, path)
+		}
+		return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
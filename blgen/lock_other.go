@@ -0,0 +1,14 @@
+//go:build !unix
+
+package blgen
+
+import (
+	"errors"
+	"os"
+)
+
+func lockFile(*os.File) error {
+	return errors.New("lock files are only supported on Unix")
+}
+
+func unlockFile(*os.File) {}
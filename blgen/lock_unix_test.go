@@ -0,0 +1,34 @@
+//go:build unix
+
+package blgen
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestLockHeld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blgen.lock")
+	unlock, err := acquireLock(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLock(path); !errors.Is(err, ErrLocked) {
+		t.Errorf("second lock: got %v, want ErrLocked", err)
+	}
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.LockFile = path
+	if _, err := Generate(t.Context(), cfg); !errors.Is(err, ErrLocked) {
+		t.Errorf("run while locked: got %v, want ErrLocked", err)
+	}
+
+	unlock()
+	generate(t, cfg)
+	// The run released the lock again.
+	unlock, err = acquireLock(path)
+	if err != nil {
+		t.Fatalf("lock after the run: %v", err)
+	}
+	unlock()
+}
@@ -0,0 +1,85 @@
+package blgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// mmdbDir is the directory below the temp directory the binary database is
+// downloaded and extracted to, apart from the CSV archive.
+const mmdbDir = "mmdb"
+
+// mmdbEditionID returns MaxMind's ID of the binary edition holding the same
+// data as the CSV edition ed, such as GeoLite2-Country for
+// GeoLite2-Country-CSV.
+func mmdbEditionID(ed edition) string {
+	return strings.TrimSuffix(ed.id(), "-CSV")
+}
+
+// mmdbConfig returns the configuration the binary database is downloaded
+// with. It is a copy, taken before the downloads start, so the CSV download
+// can go on updating cfg.
+func mmdbConfig(cfg *Config) *Config {
+	mmdbCfg := *cfg
+	mmdbCfg.DBURL = cfg.MMDBURL
+	mmdbCfg.SHAURL = cfg.MMDBURL + ".sha256"
+	mmdbCfg.Archive = ArchiveTarGz
+	return &mmdbCfg
+}
+
+// downloadMMDB downloads and verifies the binary database, which MaxMind only
+// ships as tar.gz, and extracts the .mmdb file into the mmdb directory of
+// tmpDir. The download reuses the CSV archive's retries and verification,
+// with the configuration returned by mmdbConfig.
+func downloadMMDB(ctx context.Context, tmpDir string, mmdbCfg *Config) error {
+	dir := filepath.Join(tmpDir, mmdbDir)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return fmt.Errorf("failed to create mmdb directory: %w", err)
+	}
+	download, err := downloadArchive(ctx, dir, mmdbCfg, nil, true)
+	if err != nil {
+		return err
+	}
+	if err := verifySHA256(ctx, download.sha256, mmdbCfg); err != nil {
+		return err
+	}
+
+	archive, err := openArchive(download.path, ArchiveTarGz)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	mmdbFile := mmdbEditionID(mmdbCfg.edition()) + ".mmdb"
+	for {
+		name, open, err := archive.next()
+		if err == io.EOF {
+			return fmt.Errorf("missing %s in mmdb archive", mmdbFile)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read mmdb archive: %w", err)
+		}
+		if _, match := archivePathMatch(name, []string{mmdbFile}); match {
+			return extractAndWriteFile(name, open, filepath.Join(dir, mmdbFile))
+		}
+	}
+}
+
+// moveMMDB moves the extracted binary database to cfg.MMDBPath.
+func moveMMDB(tmpDir string, cfg *Config) error {
+	oldPath := filepath.Join(tmpDir, mmdbDir, mmdbEditionID(cfg.edition())+".mmdb")
+	err := os.Rename(oldPath, cfg.MMDBPath)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("failed to move mmdb file: %w", err)
+	}
+	return moveFileFallback(oldPath, cfg.MMDBPath)
+}
@@ -0,0 +1,145 @@
+package blgen
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testDatabase is the content of the binary database mmdbServer serves.
+const testDatabase = "MaxMind.com binary database"
+
+// mmdbServer returns a test server serving the binary database at
+// /mmdb.tar.gz next to the CSV archive, with handle called first for every
+// request.
+func mmdbServer(t *testing.T, handle func(w http.ResponseWriter, r *http.Request) bool) *testServer {
+	t.Helper()
+	mmdbArchive, err := os.ReadFile(writeTarGz(t, map[string]string{"GeoLite2-Country.mmdb": testDatabase}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if handle != nil && handle(w, r) {
+			return true
+		}
+		switch r.URL.Path {
+		case "/mmdb.tar.gz":
+			w.Write(mmdbArchive)
+		case "/mmdb.tar.gz.sha256":
+			sum := sha256.Sum256(mmdbArchive)
+			w.Write([]byte(hex.EncodeToString(sum[:]) + "  GeoLite2-Country_20260101.tar.gz\n"))
+		default:
+			return false
+		}
+		return true
+	}
+	return server
+}
+
+// mmdbTestConfig returns the config of server writing the binary database next
+// to the list.
+func mmdbTestConfig(t *testing.T, server *testServer) Config {
+	cfg := server.config(t)
+	cfg.MMDBURL = server.URL + "/mmdb.tar.gz"
+	cfg.MMDBPath = filepath.Join(t.TempDir(), "country.mmdb")
+	return cfg
+}
+
+func TestMMDBNextToList(t *testing.T) {
+	cfg := mmdbTestConfig(t, mmdbServer(t, nil))
+	result := generate(t, cfg)
+	if got := readFile(t, cfg.MMDBPath); got != testDatabase {
+		t.Errorf("mmdb file holds %q, want %q", got, testDatabase)
+	}
+	if result.NetworksWritten != 4 || len(listLines(t, result.OutputPath)) != 4 {
+		t.Errorf("%d networks written next to the mmdb file, want 4", result.NetworksWritten)
+	}
+}
+
+// isArchive reports whether r requests one of the two archives.
+func isArchive(r *http.Request) bool {
+	return r.URL.Path == "/db.zip" || r.URL.Path == "/mmdb.tar.gz"
+}
+
+func TestConcurrentDownloads(t *testing.T) {
+	// Each archive is only served once both were requested, which they
+	// only are when downloaded at the same time.
+	var both sync.WaitGroup
+	both.Add(2)
+	server := mmdbServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if !isArchive(r) {
+			return false
+		}
+		both.Done()
+		done := make(chan struct{})
+		go func() { both.Wait(); close(done) }()
+		select {
+		case <-done:
+			return false
+		case <-time.After(5 * time.Second):
+			http.Error(w, "archives downloaded one after the other", http.StatusBadRequest)
+			return true
+		}
+	})
+	cfg := mmdbTestConfig(t, server)
+	if result := generate(t, cfg); result.NetworksWritten != 4 || readFile(t, cfg.MMDBPath) != testDatabase {
+		t.Errorf("%d networks written and the mmdb file holding %q", result.NetworksWritten, readFile(t, cfg.MMDBPath))
+	}
+
+	// One at a time with a concurrency of one.
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	server = mmdbServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		if isArchive(r) {
+			mu.Lock()
+			inFlight++
+			most = max(most, inFlight)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}
+		return false
+	})
+	cfg = mmdbTestConfig(t, server)
+	cfg.DownloadConcurrency = 1
+	generate(t, cfg)
+	if most != 1 {
+		t.Errorf("%d archives downloaded at the same time, want 1", most)
+	}
+}
+
+// A failed download cancels the others.
+func TestConcurrentDownloadFailure(t *testing.T) {
+	server := mmdbServer(t, func(w http.ResponseWriter, r *http.Request) bool {
+		switch r.URL.Path {
+		case "/db.zip":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return true
+		case "/mmdb.tar.gz":
+			http.NotFound(w, r)
+			return true
+		}
+		return false
+	})
+	start := time.Now()
+	_, err := Generate(t.Context(), mmdbTestConfig(t, server))
+	var stageErr *StageError
+	if !errors.As(err, &stageErr) || stageErr.Stage != "mmdb" {
+		t.Errorf("got %v, want the mmdb download failed", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("the archive download went on for %v after the mmdb download failed", elapsed)
+	}
+}
@@ -0,0 +1,118 @@
+package blgen
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// netrcEntry is the login and password of a machine in a .netrc file.
+type netrcEntry struct {
+	login    string
+	password string
+}
+
+// readNetrc returns the entry of host in the .netrc file at path, or of the
+// default entry when the file has none for host. found is false when it has
+// neither.
+func readNetrc(path, host string) (entry netrcEntry, found bool, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return netrcEntry{}, false, fmt.Errorf("failed to read netrc file: %w", err)
+	}
+	defer file.Close()
+
+	var machine, fallback *netrcEntry
+	// current is the entry the login and password tokens belong to, nil
+	// before the first machine and within entries of other hosts.
+	var current *netrcEntry
+	inMacro := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		// A macro definition runs until the next empty line.
+		if inMacro {
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		tokens := strings.Fields(line)
+		for i := 0; i < len(tokens); i++ {
+			value := func() string {
+				if i+1 < len(tokens) {
+					i++
+					return tokens[i]
+				}
+				return ""
+			}
+			switch tokens[i] {
+			case "machine":
+				current = nil
+				if value() == host && machine == nil {
+					machine = &netrcEntry{}
+					current = machine
+				}
+			case "default":
+				current = nil
+				if fallback == nil {
+					fallback = &netrcEntry{}
+					current = fallback
+				}
+			case "login":
+				if login := value(); current != nil {
+					current.login = login
+				}
+			case "password":
+				if password := value(); current != nil {
+					current.password = password
+				}
+			case "account":
+				value()
+			case "macdef":
+				value()
+				inMacro = true
+				i = len(tokens)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return netrcEntry{}, false, fmt.Errorf("failed to read netrc file: %w", err)
+	}
+
+	if machine != nil {
+		return *machine, true, nil
+	}
+	if fallback != nil {
+		return *fallback, true, nil
+	}
+	return netrcEntry{}, false, nil
+}
+
+// netrcCredentials fills in the account ID and license key from the login
+// and password that NetrcFile has for the host of downloadURL, leaving the
+// credentials that are already set alone.
+func (cfg *Config) netrcCredentials(downloadURL string) error {
+	parsedURL, err := url.Parse(downloadURL)
+	if err != nil {
+		return fmt.Errorf("invalid download URL: %w", err)
+	}
+	host := parsedURL.Hostname()
+	entry, found, err := readNetrc(cfg.NetrcFile, host)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("netrc file %s has no entry for %s", cfg.NetrcFile, host)
+	}
+	if cfg.AccountID == "" {
+		cfg.AccountID = entry.login
+	}
+	if cfg.LicenseKey == "" {
+		cfg.LicenseKey = entry.password
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package blgen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testNetrc = `# MaxMind and the mirror
+machine example.com login other password secret
+machine download.maxmind.com
+	login 1234
+	password key
+
+macdef init
+	machine download.maxmind.com login macro password macro
+
+default login anonymous password guest
+`
+
+func TestReadNetrc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(path, []byte(testNetrc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		want netrcEntry
+	}{
+		{"download.maxmind.com", netrcEntry{"1234", "key"}},
+		{"example.com", netrcEntry{"other", "secret"}},
+		{"mirror.example.org", netrcEntry{"anonymous", "guest"}},
+	}
+	for _, test := range tests {
+		entry, found, err := readNetrc(path, test.host)
+		if err != nil || !found || entry != test.want {
+			t.Errorf("%s: got %+v, %t, %v, want %+v", test.host, entry, found, err, test.want)
+		}
+	}
+}
+
+func TestNetrcCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(path, []byte(testNetrc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(t, "")
+	cfg.NetrcFile = path
+	if err := cfg.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AccountID != "1234" || cfg.LicenseKey != "key" {
+		t.Errorf("got %q and %q, want the credentials of download.maxmind.com", cfg.AccountID, cfg.LicenseKey)
+	}
+
+	// Credentials already given are kept.
+	cfg = testConfig(t, "")
+	cfg.NetrcFile = path
+	cfg.LicenseKey = "given"
+	if err := cfg.Prepare(); err != nil || cfg.AccountID != "1234" || cfg.LicenseKey != "given" {
+		t.Errorf("got %q and %q: %v, want the license key given", cfg.AccountID, cfg.LicenseKey, err)
+	}
+
+	// The download server gets them.
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	netrc := filepath.Join(t.TempDir(), "netrc")
+	if err := os.WriteFile(netrc, []byte("machine 127.0.0.1 login 1234 password key\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cfg = server.config(t)
+	cfg.AccountID, cfg.LicenseKey = "", ""
+	cfg.NetrcFile = netrc
+	if result := generate(t, cfg); result.NetworksWritten != 4 {
+		t.Errorf("%d networks written, want 4", result.NetworksWritten)
+	}
+}
@@ -0,0 +1,70 @@
+package blgen
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// notification is the JSON body posted to NotifyURL for each written file.
+type notification struct {
+	Timestamp time.Time `json:"timestamp"`
+	Countries int       `json:"countries"`
+	Networks  int       `json:"networks"`
+	Path      string    `json:"path"`
+	SHA256    string    `json:"sha256"`
+}
+
+// notify posts a notification about every written file to cfg.NotifyURL.
+// Failures are only logged, since the list is already in place by then.
+func notify(ctx context.Context, cfg *Config, result *Result) {
+	for _, path := range result.OutputPaths {
+		if err := postNotification(ctx, cfg, result, path); err != nil {
+			cfg.Logger.Warn("failed to send notification", "url", cfg.NotifyURL, "path", path, "error", err)
+			continue
+		}
+		cfg.Logger.Debug("notification sent", "url", cfg.NotifyURL, "path", path)
+	}
+}
+
+func postNotification(ctx context.Context, cfg *Config, result *Result, path string) error {
+	sha256, err := hashFile(path)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(notification{
+		Timestamp: time.Now().UTC(),
+		Countries: result.CountriesRequested,
+		Networks:  result.NetworksWritten,
+		Path:      path,
+		SHA256:    sha256,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, shortRequestTimeout)
+	defer cancel()
+	httpRequest, err := http.NewRequestWithContext(ctx, "POST", cfg.NotifyURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create notification request: %w", err)
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("User-Agent", cfg.UserAgent)
+
+	httpResponse, err := cfg.HTTPClient.Do(httpRequest)
+	if err != nil {
+		return fmt.Errorf("notification failed: %w", err)
+	}
+	defer httpResponse.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(httpResponse.Body, 1024))
+
+	if httpResponse.StatusCode < 200 || httpResponse.StatusCode > 299 {
+		return fmt.Errorf("notification bad status: %s", httpResponse.Status)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package blgen
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	var payloads []map[string]any
+	var contentType string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil || r.Method != http.MethodPost {
+			t.Errorf("%s with an undecodable body: %v", r.Method, err)
+		}
+		contentType = r.Header.Get("Content-Type")
+		payloads = append(payloads, payload)
+	}))
+	defer receiver.Close()
+
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.NotifyURL = receiver.URL
+	cfg.BlockedCountries = codes("RU", "DE")
+	result := generate(t, cfg)
+
+	if len(payloads) != 1 || contentType != "application/json" {
+		t.Fatalf("got %d notifications of type %q, want one of JSON", len(payloads), contentType)
+	}
+	payload := payloads[0]
+	sha256, err := hashFile(result.OutputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload["countries"] != 2.0 || payload["networks"] != 5.0 || payload["path"] != result.OutputPath || payload["sha256"] != sha256 {
+		t.Errorf("got %v", payload)
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, payload["timestamp"].(string))
+	if err != nil || time.Since(timestamp) > time.Minute {
+		t.Errorf("timestamp %v: %v", payload["timestamp"], err)
+	}
+	if len(payload) != 5 {
+		t.Errorf("payload has %d fields, want 5", len(payload))
+	}
+}
+
+func TestNotifyFailureLogged(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.NotifyURL = receiver.URL
+	var log bytes.Buffer
+	cfg.Logger = slog.New(slog.NewTextHandler(&log, nil))
+	if result := generate(t, cfg); result.NetworksWritten != 4 {
+		t.Errorf("%d networks written, want 4", result.NetworksWritten)
+	}
+	if !strings.Contains(log.String(), "level=WARN msg=\"failed to send notification\"") {
+		t.Errorf("failure not logged: %s", log.String())
+	}
+}
@@ -0,0 +1,38 @@
+package blgen
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCountryLabel(t *testing.T) {
+	tests := []struct {
+		code, want string
+	}{
+		{"RU", "643"},
+		{"DE", "276"},
+		{"US", "840"},
+		{"AF", "004"},
+		{"XK", "XK"},
+	}
+	cfg := &Config{NumericCodes: true}
+	for _, test := range tests {
+		if got := cfg.countryLabel(test.code); got != test.want {
+			t.Errorf("countryLabel(%s) = %s, want %s", test.code, got, test.want)
+		}
+	}
+	if got := (&Config{}).countryLabel("RU"); got != "RU" {
+		t.Errorf("countryLabel(RU) = %s without numeric codes", got)
+	}
+}
+
+func TestNumericCodes(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.BlockedCountries = codes("RU", "DE", "US")
+	cfg.NumericCodes = true
+	result := generate(t, cfg)
+	want := []string{"2.56.8.0/24 ; 643", "2.56.9.0/24 ; 643", "2.56.10.0/23 ; 643", "5.1.0.0/16 ; 276", "8.8.8.0/24 ; 840", "185.1.1.0/24 ; 840"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
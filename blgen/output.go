@@ -0,0 +1,801 @@
+package blgen
+
+import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// listOutput is one of the files the list is written to, in one format.
+type listOutput struct {
+	name string
+	// file is nil for stdout.
+	file    io.Closer
+	counted *countingWriter
+	// checksum hashes the written bytes, after compression. It is nil
+	// unless a checksum file is written.
+	checksum  hash.Hash
+	gzip      *gzip.Writer
+	data      *bufio.Writer
+	formatter blockFormatter
+	blocks    *blockWriter
+	// w is where the list is written to: data, through the conversion to
+	// CRLF with NewlineCRLF and a count of the lines of the current chunk
+	// with chunks.
+	w io.Writer
+	// appended is set when the output starts with the lines of an
+	// existing list, which has its header already.
+	appended bool
+	// chunks is nil unless the list is split into files of MaxLines.
+	chunks *listChunks
+	// written counts the bytes written to the closed files of the output.
+	written int64
+}
+
+func newListOutput(output io.Writer, name, format string, cfg *Config) (*listOutput, error) {
+	formatter, err := newBlockFormatter(cfg, format)
+	if err != nil {
+		return nil, err
+	}
+	out := &listOutput{name: name, formatter: formatter}
+	out.blocks = newBlockWriter(nil, formatter, cfg)
+	out.attach(output, cfg)
+	return out, nil
+}
+
+// attach makes output the file the list is written to, through the checksum,
+// the byte count and the compression.
+func (out *listOutput) attach(output io.Writer, cfg *Config) {
+	out.checksum = nil
+	if cfg.Checksum {
+		out.checksum = sha256.New()
+		output = io.MultiWriter(output, out.checksum)
+	}
+	out.counted = &countingWriter{w: output}
+	output = out.counted
+	out.gzip = nil
+	if cfg.Gzip {
+		out.gzip = gzip.NewWriter(output)
+		output = out.gzip
+	}
+	out.data = bufio.NewWriter(output)
+	out.w = out.data
+	if cfg.Newline == NewlineCRLF {
+		out.w = &crlfWriter{w: out.w}
+	}
+	if out.chunks != nil {
+		out.w = &lineCountingWriter{w: out.w, lines: &out.chunks.lines}
+	}
+	out.blocks.w = out.w
+}
+
+// close flushes and closes in order so the gzip footer is written before the
+// file is moved into place.
+func (out *listOutput) close() error {
+	if err := out.data.Flush(); err != nil {
+		return fmt.Errorf("failed to write output to %s: %w", out.name, err)
+	}
+	if out.gzip != nil {
+		if err := out.gzip.Close(); err != nil {
+			return fmt.Errorf("failed to compress output to %s: %w", out.name, err)
+		}
+	}
+	if out.file != nil {
+		if err := out.file.Close(); err != nil {
+			return fmt.Errorf("failed to close output file %s: %w", out.name, err)
+		}
+	}
+	return nil
+}
+
+// finish closes the output and writes its checksum file.
+func (out *listOutput) finish(cfg *Config) error {
+	if err := out.close(); err != nil {
+		return err
+	}
+	out.file = nil
+	out.written += out.counted.n
+	if out.checksum != nil {
+		if err := writeChecksumFile(out.name, out.checksum.Sum(nil), cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createOutputFile creates a file of the list, with FileMode if it is set.
+func createOutputFile(outputPath string, cfg *Config) (*os.File, error) {
+	outputFile, err := os.Create(outputPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file %s: %w", outputPath, err)
+	}
+	// Chmod isn't filtered by the umask, unlike the mode of a new file.
+	if cfg.FileMode != 0 {
+		if err := outputFile.Chmod(cfg.FileMode); err != nil {
+			outputFile.Close()
+			return nil, fmt.Errorf("failed to set file mode of %s: %w", outputPath, err)
+		}
+	}
+	return outputFile, nil
+}
+
+// createListOutput creates the file the list is written to in one format.
+// With MaxLines, it is the first chunk of the list.
+func createListOutput(outputPath, format string, cfg *Config) (*listOutput, error) {
+	var chunks *listChunks
+	if cfg.MaxLines > 0 {
+		chunks = &listChunks{path: outputPath, chunk: 1, cfg: cfg}
+		outputPath = chunks.chunkPath()
+	}
+	outputFile, err := createOutputFile(outputPath, cfg)
+	if err != nil {
+		return nil, err
+	}
+	out, err := newListOutput(outputFile, outputPath, format, cfg)
+	if err != nil {
+		outputFile.Close()
+		return nil, err
+	}
+	out.file = outputFile
+	if chunks != nil {
+		out.chunks = chunks
+		out.attach(outputFile, cfg)
+		out.blocks.reserve = out.reserve
+	}
+	return out, nil
+}
+
+// getAndWriteBlocks writes the list in every configured format. The blocks
+// file is scanned once and each matched network goes to all of them, and to
+// the per-country files when the list is split.
+func getAndWriteBlocks(ctx context.Context, tmpDir string, matcher blockMatcher, cfg *Config, result *Result) error {
+	start := time.Now()
+	var outputs []*listOutput
+	var split *countrySplit
+	defer func() {
+		if split != nil {
+			outputs = append(outputs, split.all()...)
+		}
+		for _, out := range outputs {
+			if out.file != nil {
+				out.file.Close()
+			}
+		}
+	}()
+
+	for _, format := range cfg.formats() {
+		if cfg.SplitByCountry && !cfg.SplitCombined {
+			break
+		}
+		if cfg.OutputFilename == StdoutFilename {
+			output, name := io.Writer(os.Stdout), "stdout"
+			if cfg.Output != nil {
+				output, name = cfg.Output, "output writer"
+			}
+			out, err := newListOutput(output, name, format, cfg)
+			if err != nil {
+				return err
+			}
+			outputs = append(outputs, out)
+			continue
+		}
+
+		out, err := createListOutput(filepath.Join(tmpDir, cfg.outputFilename(format)), format, cfg)
+		if err != nil {
+			return err
+		}
+		outputs = append(outputs, out)
+		if cfg.Append {
+			if err := copyExistingList(out, filepath.Join(cfg.OutputFilePath, cfg.outputFilename(format))); err != nil {
+				return err
+			}
+		}
+	}
+	if cfg.SplitByCountry {
+		var err error
+		split, err = newCountrySplit(tmpDir, cfg)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeBlocks(ctx, outputs, split, tmpDir, matcher, cfg, result); err != nil {
+		return err
+	}
+	for _, out := range outputs {
+		if out.chunks != nil && out.chunks.err != nil {
+			return out.chunks.err
+		}
+	}
+
+	// The formats can differ in how many lines duplicates collapse into, so
+	// the first one is the one counted. Without a combined list, the
+	// per-country files of the first format are.
+	counted := outputs[:min(len(outputs), 1)]
+	if split != nil {
+		if len(outputs) == 0 {
+			for _, name := range split.order {
+				counted = append(counted, split.outputs[name][0])
+			}
+		}
+		outputs = append(outputs, split.all()...)
+		split = nil
+	}
+	for _, out := range outputs {
+		if err := out.finish(cfg); err != nil {
+			return err
+		}
+		result.BytesWritten += out.written
+	}
+	result.NetworksByLabel = map[string]int{}
+	for _, out := range counted {
+		result.NetworksWritten += out.blocks.written
+		for label, count := range out.blocks.labels {
+			result.NetworksByLabel[label] += count
+		}
+	}
+	cfg.logThroughput("write", cfg.OutputFilename, result.NetworksWritten, result.BytesWritten, time.Since(start))
+	return nil
+}
+
+// blocksFile is an opened blocks file whose header was read.
+type blocksFile struct {
+	file *os.File
+	data *bufio.Reader
+	scan blockScan
+	size int64
+}
+
+// openBlocksFile opens the blocks file of the configured edition and checks
+// that it has the columns matcher reads. It returns nil for an empty file.
+func openBlocksFile(tmpDir string, matcher blockMatcher, cfg *Config) (*blocksFile, error) {
+	blocksCSV := cfg.edition().blocksCSV()
+	blocksCSVPath := filepath.Join(tmpDir, blocksCSV)
+	blocksCSVFile, err := os.Open(blocksCSVPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", blocksCSV, err)
+	}
+
+	// The header is read on its own, so the rest of the file can be handed
+	// to the workers unparsed.
+	blocksData := bufio.NewReader(blocksCSVFile)
+	headerLine, err := blocksData.ReadString('\n')
+	if err == io.EOF && headerLine == "" {
+		blocksCSVFile.Close()
+		return nil, nil
+	}
+	if err != nil && err != io.EOF {
+		blocksCSVFile.Close()
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	csvHeader, err := csv.NewReader(strings.NewReader(headerLine)).Read()
+	if err != nil {
+		blocksCSVFile.Close()
+		return nil, fmt.Errorf("failed to read CSV header: %w", err)
+	}
+	if err := cfg.checkSchema(blocksCSV, csvHeader); err != nil {
+		blocksCSVFile.Close()
+		return nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range csvHeader {
+		columns[name] = i
+	}
+	neededFields := append([]string{"network"}, matcher.columns()...)
+	for _, column := range neededFields {
+		if _, ok := columns[column]; !ok {
+			blocksCSVFile.Close()
+			return nil, fmt.Errorf("missing needed column: %s", column)
+		}
+	}
+
+	var size int64
+	if info, err := blocksCSVFile.Stat(); err == nil {
+		size = info.Size()
+	}
+	scan := blockScan{name: blocksCSV, fields: len(csvHeader), columns: columns, matcher: matcher, progress: cfg.progress, maxMalformed: cfg.MaxErrors, sample: cfg.Sample, logger: cfg.Logger, rows: &atomic.Int64{}}
+	return &blocksFile{file: blocksCSVFile, data: blocksData, scan: scan, size: size}, nil
+}
+
+// scanRows calls emit for every matched row and returns the number of
+// malformed rows skipped, see scanBlocks.
+func (b *blocksFile) scanRows(ctx context.Context, cfg *Config, emit emitFunc) (int, error) {
+	start := time.Now()
+	malformed, err := scanBlocks(ctx, b.data, b.scan, cfg.Workers, emit)
+	if err != nil {
+		return malformed, err
+	}
+	cfg.progress.scanDone()
+	cfg.logThroughput("scan", b.scan.name, int(b.scan.rows.Load()), b.size, time.Since(start))
+	return malformed, nil
+}
+
+func (b *blocksFile) Close() error {
+	return b.file.Close()
+}
+
+// copyExistingList starts out with the lines of the list at path, and marks
+// them as written so they aren't written again. Without a list at path, out
+// starts empty.
+func copyExistingList(out *listOutput, path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s to append to: %w", path, err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadString('\n')
+		if line != "" {
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			out.data.WriteString(line)
+			// The new lines are compared before their newline is
+			// converted to CRLF.
+			key := strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r") + "\n"
+			out.blocks.seen[key] = struct{}{}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s to append to: %w", path, err)
+		}
+	}
+	out.appended = true
+	return nil
+}
+
+// startListOutput writes the header and the start of the enclosing
+// structure, if the format has one. An appended output has both already.
+func startListOutput(out *listOutput, header string, cfg *Config) {
+	if out.appended {
+		return
+	}
+	if out.chunks != nil {
+		out.chunks.header = header
+	}
+	if !cfg.NoHeader {
+		out.formatter.writeHeader(out.w, header)
+	}
+	if encloser, enclosed := out.formatter.(blockEncloser); enclosed {
+		encloser.writeStart(out.w)
+	}
+	if out.chunks != nil {
+		out.chunks.startLines = out.chunks.lines
+	}
+}
+
+// endListOutput writes the end of the enclosing structure, if the format has
+// one.
+func endListOutput(out *listOutput) {
+	if encloser, enclosed := out.formatter.(blockEncloser); enclosed {
+		encloser.writeEnd(out.w)
+	}
+}
+
+// writeBlocks writes the list to every output, and to the per-country files
+// of split unless it is nil.
+func writeBlocks(ctx context.Context, outputs []*listOutput, split *countrySplit, tmpDir string, matcher blockMatcher, cfg *Config, result *Result) error {
+	blocks, err := openBlocksFile(tmpDir, matcher, cfg)
+	if err != nil || blocks == nil {
+		return err
+	}
+	defer blocks.Close()
+
+	header := fmt.Sprintf("list generated %s in %s mode", cfg.headerTimestamp(time.Now()), cfg.Mode)
+	if cfg.Sample > 1 {
+		header += fmt.Sprintf(", from a sample of 1 in %d rows", cfg.Sample)
+		cfg.Logger.Warn("writing a sample of the list", "sample", fmt.Sprintf("1/%d", cfg.Sample))
+	}
+	if cfg.VerboseHeader {
+		header += "\n" + cfg.verboseHeader(time.Now())
+	}
+	for _, out := range outputs {
+		startListOutput(out, header, cfg)
+	}
+	if split != nil {
+		split.header = header
+	}
+	writeBlock := func(entry blockEntry) {
+		for _, out := range outputs {
+			out.blocks.writeBlock(entry)
+		}
+		if split != nil {
+			split.writeBlock(entry)
+		}
+	}
+	mapNetwork := func(network netip.Prefix, country geoname) {
+		mapped := cfg.MapV4ToV6 != "" && network.Addr().Is4()
+		if !mapped || cfg.MapV4ToV6 == MapV4ToV6Also {
+			writeBlock(blockEntry{network.String(), country})
+		}
+		if mapped {
+			writeBlock(blockEntry{mapV4ToV6(network).String(), country})
+		}
+	}
+	conflicts := newNetworkConflicts(cfg.ConflictPolicy)
+	var conflictErr error
+	writeNetwork := func(network netip.Prefix, country geoname) {
+		if conflictErr != nil {
+			return
+		}
+		write, err := conflicts.add(network, country)
+		if err != nil {
+			conflictErr = err
+			return
+		}
+		if write {
+			mapNetwork(network, country)
+		}
+	}
+
+	// Aggregation and sorting collect the networks per country first, so
+	// only networks sharing a country are ever merged.
+	buffered := cfg.Aggregate || cfg.Sort || cfg.Grouped
+	var countryOrder []geoname
+	countryNetworks := map[geoname][]netip.Prefix{}
+	// The low memory mode sorts on disk instead.
+	var sorter *spillSorter
+	var sortErr error
+	if cfg.LowMemory {
+		sorter = &spillSorter{dir: tmpDir}
+		defer sorter.close()
+	}
+
+	result.MalformedRows, err = blocks.scanRows(ctx, cfg, func(network netip.Prefix, country geoname) {
+		if !cfg.prefixListed(network) {
+			return
+		}
+		if !buffered {
+			writeNetwork(network, country)
+			return
+		}
+		// The labels are resolved in the order of the blocks file, before
+		// the networks are sorted and sectioned.
+		if conflictErr == nil {
+			conflictErr = conflicts.record(network, country)
+		}
+		if sorter != nil {
+			if sortErr == nil {
+				sortErr = sorter.add(network, country)
+			}
+			return
+		}
+		if _, seen := countryNetworks[country]; !seen {
+			countryOrder = append(countryOrder, country)
+		}
+		countryNetworks[country] = append(countryNetworks[country], network)
+	})
+	if err != nil {
+		return err
+	}
+	if sortErr != nil {
+		return sortErr
+	}
+	if conflictErr != nil {
+		return conflictErr
+	}
+
+	if cfg.Sort || cfg.Grouped {
+		slices.SortFunc(countryOrder, compareGeonames)
+	}
+	section := ""
+	writeCountry := func(country geoname, networks []netip.Prefix) {
+		networks = slices.DeleteFunc(networks, func(network netip.Prefix) bool {
+			return !conflicts.keeps(network, country)
+		})
+		if len(networks) == 0 {
+			return
+		}
+		if cfg.Grouped && country.label != section {
+			section = country.label
+			for _, out := range outputs {
+				writeSection(out, section)
+			}
+		}
+		if cfg.Aggregate {
+			networks = aggregatePrefixes(networks)
+		} else {
+			slices.SortFunc(networks, compareByAddr)
+		}
+		for _, network := range networks {
+			mapNetwork(network, country)
+		}
+	}
+	for _, country := range countryOrder {
+		writeCountry(country, countryNetworks[country])
+	}
+	if sorter != nil {
+		// The merged networks come sorted and grouped by geoname. Only
+		// aggregation needs all of a geoname's networks at once, the
+		// others are written as they come. A repeated network is left
+		// out here, as the lines of IPv4-mapped networks written in
+		// between would keep the outputs from seeing it repeat.
+		var current geoname
+		var previous netip.Prefix
+		var networks []netip.Prefix
+		err := sorter.merge(func(network netip.Prefix, country geoname) {
+			if country == current && network == previous && !cfg.AllowDuplicates {
+				return
+			}
+			previous = network
+			if country != current && len(networks) > 0 {
+				writeCountry(current, networks)
+				networks = networks[:0]
+			}
+			current = country
+			networks = append(networks, network)
+			if !cfg.Aggregate {
+				writeCountry(current, networks)
+				networks = networks[:0]
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if len(networks) > 0 {
+			writeCountry(current, networks)
+		}
+	}
+
+	conflicts.flush(mapNetwork)
+	if conflicts != nil && conflicts.count > 0 {
+		cfg.Logger.Warn("networks listed under more than one label", "count", conflicts.count, "policy", cfg.ConflictPolicy)
+	}
+
+	if err := matcher.finish(cfg); err != nil {
+		return err
+	}
+	if split != nil {
+		if split.err != nil {
+			return split.err
+		}
+		outputs = append(outputs, split.all()...)
+	}
+	for _, out := range outputs {
+		endListOutput(out)
+	}
+	return nil
+}
+
+// compareGeonames orders geonames by label and country name. The rest of the
+// fields only break ties, so the order doesn't depend on the blocks file.
+func compareGeonames(a, b geoname) int {
+	return cmp.Or(
+		strings.Compare(a.label, b.label),
+		strings.Compare(a.countryName, b.countryName),
+		strings.Compare(a.country, b.country),
+		strings.Compare(a.reason, b.reason),
+	)
+}
+
+// writeSection writes the comment heading the section of a label. The csv
+// format has no comments, so it goes without, and so does netsh, which writes
+// a rule per label anyway. A chunk of the list doesn't end with a heading,
+// and repeats the one its first networks belong to.
+func writeSection(out *listOutput, label string) {
+	switch out.formatter.(type) {
+	case csvFormatter, *netshFormatter:
+		return
+	}
+	if out.chunks != nil {
+		// Room for the heading and the first network of the section.
+		out.chunks.section = ""
+		out.reserve(2)
+		out.chunks.section = label
+	}
+	writeSectionHeading(out.w, label)
+}
+
+func writeSectionHeading(w io.Writer, label string) {
+	fmt.Fprintf(w, "# --- %s ---\n", label)
+}
+
+// checksumSuffix is appended to the output filename to name its checksum
+// file.
+const checksumSuffix = ".sha256"
+
+// writeChecksumFile writes the checksum of path next to it, in the format
+// of sha256sum, so `sha256sum -c` verifies the file in its directory.
+func writeChecksumFile(path string, sum []byte, cfg *Config) error {
+	checksumPath := path + checksumSuffix
+	line := fmt.Sprintf("%x  %s\n", sum, filepath.Base(path))
+	if err := os.WriteFile(checksumPath, []byte(line), 0o644); err != nil {
+		return fmt.Errorf("failed to write checksum file %s: %w", checksumPath, err)
+	}
+	if cfg.FileMode != 0 {
+		if err := os.Chmod(checksumPath, cfg.FileMode); err != nil {
+			return fmt.Errorf("failed to set file mode of %s: %w", checksumPath, err)
+		}
+	}
+	return nil
+}
+
+// checkOutputDir checks that the output directory exists, creating it when
+// it may, and that files can be created in it.
+func checkOutputDir(cfg *Config) error {
+	if cfg.OutputFilename == StdoutFilename {
+		return nil
+	}
+	dir := cfg.OutputFilePath
+	if dir == "" {
+		dir = "."
+	}
+	// The per-country files go to a directory of their own, which is
+	// always created.
+	if cfg.MkdirOutput || cfg.SplitByCountry {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	info, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("output directory %s doesn't exist", dir)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check output directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("output directory %s is not a directory", dir)
+	}
+	probe, err := os.CreateTemp(dir, ".blgen-*")
+	if err != nil {
+		return fmt.Errorf("output directory %s is not writable: %w", dir, err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+func moveFile(tmpDir, filename string, cfg *Config) error {
+	oldPath := filepath.Join(tmpDir, filename)
+	newPath := filepath.Join(cfg.OutputFilePath, filename)
+
+	// Keep the permissions of a previously generated list so replacing it
+	// doesn't change who can read it, unless they were set explicitly.
+	if info, err := os.Stat(newPath); err == nil {
+		if cfg.FileMode == 0 {
+			if err := os.Chmod(oldPath, info.Mode().Perm()); err != nil {
+				return fmt.Errorf("failed to set file mode: %w", err)
+			}
+		}
+		if cfg.Backup || cfg.BackupTimestamped {
+			if err := backupFile(newPath, backupPath(newPath, cfg)); err != nil {
+				return err
+			}
+		}
+	}
+
+	err := os.Rename(oldPath, newPath)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return fmt.Errorf("failed to move output file: %w", err)
+	}
+	return moveFileFallback(oldPath, newPath)
+}
+
+func backupPath(path string, cfg *Config) string {
+	if cfg.BackupTimestamped {
+		return path + "." + time.Now().Format("20060102-150405") + ".bak"
+	}
+	return path + ".bak"
+}
+
+// backupFile makes backupPath a copy of path that stays in place while path
+// is replaced. A hard link is used where possible, so the backup costs
+// nothing and the destination never goes missing.
+func backupFile(path, backupPath string) error {
+	if err := os.Remove(backupPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove old backup: %w", err)
+	}
+	if err := os.Link(path, backupPath); err == nil {
+		return nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open %s for backup: %w", path, err)
+	}
+	defer file.Close()
+
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat %s for backup: %w", path, err)
+	}
+
+	backup, err := os.OpenFile(backupPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileInfo.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create backup: %w", err)
+	}
+	if err := copyToFile(backup, file, fileInfo.Mode().Perm()); err != nil {
+		backup.Close()
+		os.Remove(backupPath)
+		return err
+	}
+	if err := backup.Close(); err != nil {
+		os.Remove(backupPath)
+		return fmt.Errorf("failed to close backup: %w", err)
+	}
+	return nil
+}
+
+// moveFileFallback moves a file across filesystems. The content is copied to
+// a temporary sibling of newPath and then renamed into place, so readers never
+// see a partially written file.
+func moveFileFallback(oldPath, newPath string) error {
+	oldFile, err := os.Open(oldPath)
+	if err != nil {
+		return fmt.Errorf("failed to open source: %w", err)
+	}
+	defer oldFile.Close()
+
+	oldFileInfo, err := oldFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat source: %w", err)
+	}
+
+	tmpPath := newPath + ".tmp"
+	newFile, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, oldFileInfo.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("failed to create destination: %w", err)
+	}
+
+	if err := copyToFile(newFile, oldFile, oldFileInfo.Mode().Perm()); err != nil {
+		newFile.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	if err := newFile.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close destination: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, newPath); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to rename destination: %w", err)
+	}
+
+	return os.Remove(oldPath)
+}
+
+func copyToFile(newFile *os.File, oldFile io.Reader, mode os.FileMode) error {
+	if _, err := io.Copy(newFile, oldFile); err != nil {
+		return fmt.Errorf("copy failed: %w", err)
+	}
+
+	// The mode passed to OpenFile is filtered by the umask, so set it
+	// explicitly to match the source.
+	if err := newFile.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set file mode: %w", err)
+	}
+
+	if err := newFile.Sync(); err != nil {
+		return fmt.Errorf("failed to sync destination: %w", err)
+	}
+
+	return nil
+}
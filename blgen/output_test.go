@@ -0,0 +1,560 @@
+package blgen
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readFile returns the content of the file at path.
+func readFile(t testing.TB, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// The copy moveFile falls back to when the rename crosses filesystems.
+func TestMoveFileFallback(t *testing.T) {
+	oldPath := filepath.Join(t.TempDir(), "list.txt")
+	if err := os.WriteFile(oldPath, []byte("2.56.8.0/24 ; RU\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(oldPath, 0o640); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	newPath := filepath.Join(dir, "list.txt")
+	if err := os.WriteFile(newPath, []byte("5.1.0.0/16 ; DE\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := moveFileFallback(oldPath, newPath); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, newPath); got != "2.56.8.0/24 ; RU\n" {
+		t.Errorf("destination holds %q", got)
+	}
+	info, err := os.Stat(newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("destination mode %v, want 0640", info.Mode().Perm())
+	}
+	if _, err := os.Stat(oldPath); !os.IsNotExist(err) {
+		t.Errorf("source left in place: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("destination directory holds %d files, want only the list", len(entries))
+	}
+}
+
+func TestGzipMatchesPlain(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	cfg := testConfig(t, archive)
+	cfg.NoHeader = true
+	plain := readFile(t, generate(t, cfg).OutputPath)
+
+	for _, gzipped := range []Config{{Gzip: true}, {OutputFilename: "list.txt.gz"}} {
+		cfg := testConfig(t, archive)
+		cfg.NoHeader = true
+		cfg.Gzip = gzipped.Gzip
+		cfg.OutputFilename = gzipped.OutputFilename
+		result := generate(t, cfg)
+		if got := readGzip(t, result.OutputPath); got != plain {
+			t.Errorf("%s decompresses to %q, want %q", result.OutputPath, got, plain)
+		}
+	}
+}
+
+func TestStdout(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.OutputFilename = StdoutFilename
+	// The warning about UX goes to the log, not into the list.
+	cfg.BlockedCountries = codes("RU", "UX")
+	log := captureLog(&cfg)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+	result := generate(t, cfg)
+	w.Close()
+	got := string(<-output)
+
+	if result.OutputPath != StdoutFilename {
+		t.Errorf("list written to %s", result.OutputPath)
+	}
+	var networks []string
+	for line := range strings.Lines(got) {
+		if !strings.HasPrefix(line, "#") {
+			networks = append(networks, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	want := []string{"2.56.8.0/24 ; RU", "2.56.9.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}
+	if !slices.Equal(networks, want) {
+		t.Errorf("stdout holds %q, want the header and %q", got, want)
+	}
+	if log.Len() == 0 || strings.Contains(got, "level=") {
+		t.Errorf("log messages went to stdout: %q", got)
+	}
+	if entries, _ := os.ReadDir(cfg.OutputFilePath); len(entries) != 0 {
+		t.Errorf("%d files written next to stdout", len(entries))
+	}
+}
+
+// The networks sort numerically within each country, and with both address
+// families listed each IPv4-mapped network follows the network it maps.
+func TestSort(t *testing.T) {
+	rows := []string{"10.0.0.0/8,2017370", "5.1.0.0/16,2921044", "9.0.0.0/8,2017370", "2.56.8.0/24,2017370"}
+	want := []string{
+		"5.1.0.0/16 ; DE", "::ffff:5.1.0.0/112 ; DE",
+		"2.56.8.0/24 ; RU", "::ffff:2.56.8.0/120 ; RU",
+		"9.0.0.0/8 ; RU", "::ffff:9.0.0.0/104 ; RU",
+		"10.0.0.0/8 ; RU", "::ffff:10.0.0.0/104 ; RU",
+	}
+	// The rows come in a different order every run, the list doesn't.
+	for range 2 {
+		var blocks strings.Builder
+		blocks.WriteString(testBlocksHeader)
+		for _, row := range rows {
+			network, id, _ := strings.Cut(row, ",")
+			blocks.WriteString(network + "," + id + "," + id + ",,0,0,\n")
+		}
+		cfg := testConfig(t, countryArchive(t, blocks.String()))
+		cfg.BlockedCountries = codes("RU", "DE")
+		cfg.MapV4ToV6 = MapV4ToV6Also
+		cfg.Sort = true
+		result := generate(t, cfg)
+		if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+			t.Errorf("got %q, want %q", got, want)
+		}
+		slices.Reverse(rows)
+	}
+}
+
+func TestNoHeaderRunsIdentical(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	var lists []string
+	for range 2 {
+		cfg := testConfig(t, archive)
+		cfg.NoHeader = true
+		cfg.TimestampFormat = time.RFC3339Nano
+		lists = append(lists, readFile(t, generate(t, cfg).OutputPath))
+	}
+	if lists[0] != lists[1] {
+		t.Errorf("headerless runs differ: %q and %q", lists[0], lists[1])
+	}
+	if strings.Contains(lists[0], "#") {
+		t.Errorf("headerless list has comments: %q", lists[0])
+	}
+}
+
+func TestBackup(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	outputPath := t.TempDir()
+	run := func(country string, configure func(cfg *Config)) (string, error) {
+		cfg := testConfig(t, archive)
+		cfg.OutputFilePath = outputPath
+		cfg.BlockedCountries = codes(country)
+		cfg.Backup = true
+		configure(&cfg)
+		result, err := Generate(t.Context(), cfg)
+		if err != nil {
+			return "", err
+		}
+		return readFile(t, result.OutputPath), nil
+	}
+	first, err := run("RU", func(*Config) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := run("DE", func(*Config) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(outputPath, DefaultOutputFilename)
+	if got := readFile(t, path+".bak"); got != first {
+		t.Errorf("backup holds %q, want the first list %q", got, first)
+	}
+
+	// A failing run leaves the list and its backup alone.
+	if _, err := run("UX", func(cfg *Config) { cfg.Strict = true }); err == nil {
+		t.Fatal("unknown code accepted")
+	}
+	if readFile(t, path) != second || readFile(t, path+".bak") != first {
+		t.Error("failed run replaced the list or its backup")
+	}
+
+	third, err := run("IE", func(cfg *Config) { cfg.Backup, cfg.BackupTimestamped = false, true })
+	if err != nil {
+		t.Fatal(err)
+	}
+	backups, err := filepath.Glob(path + ".*-*.bak")
+	if err != nil || len(backups) != 1 {
+		t.Fatalf("timestamped backups %q, want one", backups)
+	}
+	if got := readFile(t, backups[0]); got != second || third == second {
+		t.Errorf("timestamped backup holds %q, want the second list %q", got, second)
+	}
+}
+
+// readGzip returns the decompressed content of the file at path.
+func readGzip(t testing.TB, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	r, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	return string(data)
+}
+
+func TestFileMode(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	outputPath := t.TempDir()
+	tests := []struct {
+		input string
+		want  os.FileMode
+	}{
+		{"0640", 0o640},
+		{"0600", 0o600},
+		{"604", 0o604},
+	}
+	// Each run replaces the list of the one before with another mode.
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.OutputFilePath = outputPath
+		cfg.FileModeInput = test.input
+		result := generate(t, cfg)
+		info, err := os.Stat(result.OutputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != test.want {
+			t.Errorf("file mode %q: got %v, want %v", test.input, info.Mode().Perm(), test.want)
+		}
+	}
+
+	for _, mode := range []string{"rw-r-----", "0999", "01777", "-1"} {
+		cfg := testConfig(t, archive)
+		cfg.FileModeInput = mode
+		if err := cfg.Prepare(); err == nil {
+			t.Errorf("file mode %q accepted", mode)
+		}
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	for _, name := range []string{"list.txt", "list.txt.gz"} {
+		cfg := testConfig(t, archive)
+		cfg.OutputFilename = name
+		cfg.Checksum = true
+		result := generate(t, cfg)
+		data, err := os.ReadFile(result.OutputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		// What sha256sum writes, so sha256sum -c checks the list.
+		want := hex.EncodeToString(sum[:]) + "  " + name + "\n"
+		if got := readFile(t, result.OutputPath+".sha256"); got != want {
+			t.Errorf("%s.sha256 holds %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestHeaderTimestamp(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.TimestampFormat = time.RFC3339
+	cfg.TimestampUTC = true
+	before := time.Now().Truncate(time.Second)
+	result := generate(t, cfg)
+	first, _, _ := strings.Cut(readFile(t, result.OutputPath), "\n")
+	var stamp, mode string
+	if _, err := fmt.Sscanf(first, "# list generated %s in %s mode", &stamp, &mode); err != nil {
+		t.Fatalf("header %q: %v", first, err)
+	}
+	generated, err := time.Parse(time.RFC3339, stamp)
+	if err != nil || !strings.HasSuffix(stamp, "Z") || generated.Before(before) || generated.After(time.Now()) {
+		t.Errorf("header time %q isn't the time of the run in RFC 3339 UTC: %v", stamp, err)
+	}
+
+	// The default stays the local time in the old layout.
+	cfg = testConfig(t, countryArchive(t, testBlocks))
+	if err := cfg.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2026, 3, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))
+	if got := cfg.headerTimestamp(now); got != "2026/03/04-05:06" {
+		t.Errorf("default header time %q, want 2026/03/04-05:06", got)
+	}
+	cfg.TimestampUTC = true
+	if got := cfg.headerTimestamp(now); got != "2026/03/04-04:06" {
+		t.Errorf("header time in UTC %q, want 2026/03/04-04:06", got)
+	}
+}
+
+// Appending the same networks again adds nothing.
+func TestAppendTwice(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Append = true
+	existing := filepath.Join(cfg.OutputFilePath, DefaultOutputFilename)
+	if err := os.WriteFile(existing, []byte("# the master list\n10.0.0.0/8 ; XX\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	first := readFile(t, generate(t, cfg).OutputPath)
+	result := generate(t, cfg)
+	if got := readFile(t, result.OutputPath); got != first || result.NetworksWritten != 0 {
+		t.Errorf("second run wrote %d networks: got %q, want %q", result.NetworksWritten, got, first)
+	}
+	lines := listLines(t, result.OutputPath)
+	if len(lines) != 5 || len(slices.Compact(slices.Sorted(slices.Values(lines)))) != len(lines) {
+		t.Errorf("got %q, want the earlier network and the 4 of RU once each", lines)
+	}
+}
+
+// An output directory the list can't be written to fails the run before
+// anything is downloaded.
+func TestOutputDirChecked(t *testing.T) {
+	readOnly := t.TempDir()
+	if err := os.Chmod(readOnly, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(readOnly, 0o755) })
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		dir, err string
+	}{
+		{filepath.Join(t.TempDir(), "missing"), "doesn't exist"},
+		{file, "is not a directory"},
+		{readOnly, "is not writable"},
+	}
+	for _, test := range tests {
+		if test.dir == readOnly && os.Geteuid() == 0 {
+			// root writes to read-only directories.
+			continue
+		}
+		cfg := testConfig(t, "")
+		cfg.DBURL = "http://download.invalid/db.zip"
+		cfg.AccountID, cfg.LicenseKey = "1234", "key"
+		cfg.HTTPClient = noHTTPClient(t)
+		cfg.OutputFilePath = test.dir
+		_, err := Generate(t.Context(), cfg)
+		var stageErr *StageError
+		if !errors.As(err, &stageErr) || stageErr.Stage != "config" || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want the config stage failing with %q", test.dir, err, test.err)
+		}
+	}
+
+	// With MkdirOutput the directory is created.
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.OutputFilePath = filepath.Join(t.TempDir(), "lists", "geo")
+	cfg.MkdirOutput = true
+	if result := generate(t, cfg); filepath.Dir(result.OutputPath) != cfg.OutputFilePath {
+		t.Errorf("list written to %s, want it in %s", result.OutputPath, cfg.OutputFilePath)
+	}
+}
+
+func TestVerboseHeader(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.BlockedCountries = codes("RU", "CN")
+	cfg.BlockedContinents = codes("EU")
+	cfg.ExcludedCountries = codes("IE")
+	cfg.Generator = "blgen v1.2.3"
+	cfg.VerboseHeader = true
+	before := time.Now().Truncate(time.Second)
+	result := generate(t, cfg)
+
+	header := map[string]string{}
+	for line := range strings.Lines(readFile(t, result.OutputPath)) {
+		comment, found := strings.CutPrefix(strings.TrimSuffix(line, "\n"), "# ")
+		if !found {
+			break
+		}
+		if key, value, found := strings.Cut(comment, ": "); found {
+			header[key] = value
+		}
+	}
+	want := map[string]string{
+		"generator":          "blgen v1.2.3",
+		"edition":            "GeoLite2-Country-CSV",
+		"database":           "2026-01-01",
+		"mode":               ModeBlock,
+		"countries":          "CN RU",
+		"continents":         "EU",
+		"excluded countries": "IE",
+	}
+	for key, value := range want {
+		if header[key] != value {
+			t.Errorf("header records %s as %q, want %q", key, header[key], value)
+		}
+	}
+	generated, err := time.Parse(time.RFC3339, header["generated"])
+	if err != nil || generated.Location() != time.UTC || generated.Before(before) {
+		t.Errorf("header records the time as %q, want the time of the run in UTC: %v", header["generated"], err)
+	}
+
+	cfg.NoHeader = true
+	if err := cfg.Prepare(); err == nil {
+		t.Error("verbose header accepted without a header")
+	}
+}
+
+// checkCRLF fails the test unless every line of the file at path ends in
+// CRLF.
+func checkCRLF(t testing.TB, path string) {
+	t.Helper()
+	data := readFile(t, path)
+	if data == "" || strings.Count(data, "\r\n") != strings.Count(data, "\n") {
+		t.Errorf("%s doesn't end every line in CRLF: %q", path, data)
+	}
+}
+
+func TestNewlineCRLF(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Newline = NewlineCRLF
+	result := generate(t, cfg)
+	checkCRLF(t, result.OutputPath)
+}
+
+func TestAppendLeavesOutExistingLines(t *testing.T) {
+	for _, newline := range []string{NewlineLF, NewlineCRLF} {
+		cfg := testConfig(t, countryArchive(t, testBlocks))
+		cfg.Append = true
+		cfg.Newline = newline
+		eol := "\n"
+		if newline == NewlineCRLF {
+			eol = "\r\n"
+		}
+		existing := filepath.Join(cfg.OutputFilePath, DefaultOutputFilename)
+		list := "# an earlier list" + eol + "2.56.9.0/24 ; RU" + eol + "5.1.0.0/16 ; DE" + eol
+		if err := os.WriteFile(existing, []byte(list), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		result := generate(t, cfg)
+		want := list + strings.Join([]string{"2.56.8.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}, eol) + eol
+		if got := readFile(t, result.OutputPath); got != want {
+			t.Errorf("%s: got %q, want %q", newline, got, want)
+		}
+		if result.NetworksWritten != 3 {
+			t.Errorf("%s: %d networks written, want the 3 new ones", newline, result.NetworksWritten)
+		}
+	}
+}
+
+func TestAppendLowMemory(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.LowMemory, cfg.Sort, cfg.Append = true, true, true
+	existing := filepath.Join(cfg.OutputFilePath, DefaultOutputFilename)
+	if err := os.WriteFile(existing, []byte("# an earlier list\n2.56.9.0/24 ; RU\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	result := generate(t, cfg)
+	want := []string{"2.56.9.0/24 ; RU", "2.56.8.0/24 ; RU", "2.56.10.0/23 ; RU", "185.1.1.0/24 ; RU"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestNewlineCRLFChunks(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Newline = NewlineCRLF
+	cfg.Format = FormatCIDR
+	cfg.MaxLines = 3
+	result := generate(t, cfg)
+	if len(result.OutputPaths) != 2 {
+		t.Fatalf("got %d chunks, want 2", len(result.OutputPaths))
+	}
+	for _, path := range result.OutputPaths {
+		checkCRLF(t, path)
+		if lines := strings.Count(readFile(t, path), "\n"); lines != 3 {
+			t.Errorf("%s has %d lines, want 3", path, lines)
+		}
+	}
+}
+
+func TestNewlineCRLFDiff(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Newline = NewlineCRLF
+	previous := filepath.Join(t.TempDir(), "previous.txt")
+	if err := os.WriteFile(previous, []byte("2.56.9.0/24 ; RU\r\n5.1.0.0/16 ; DE\r\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg.DiffAgainst = previous
+	result := generate(t, cfg)
+	added, removed := result.OutputPath+addedSuffix, result.OutputPath+removedSuffix
+	if got, want := readFile(t, added), "2.56.8.0/24 ; RU\r\n2.56.10.0/23 ; RU\r\n185.1.1.0/24 ; RU\r\n"; got != want {
+		t.Errorf("added lines %q, want %q", got, want)
+	}
+	if got, want := readFile(t, removed), "5.1.0.0/16 ; DE\r\n"; got != want {
+		t.Errorf("removed lines %q, want %q", got, want)
+	}
+}
+
+func TestOutputWriter(t *testing.T) {
+	var list bytes.Buffer
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Output = &list
+	cfg.Format = FormatCIDR
+	result := generate(t, cfg)
+	if result.OutputPath != StdoutFilename {
+		t.Errorf("output path %q, want %q", result.OutputPath, StdoutFilename)
+	}
+	want := "2.56.8.0/24\n2.56.9.0/24\n2.56.10.0/23\n185.1.1.0/24\n"
+	if _, got, _ := strings.Cut(list.String(), "\n"); got != want {
+		t.Errorf("got %q, want the header and %q", list.String(), want)
+	}
+	if result.BytesWritten != int64(list.Len()) {
+		t.Errorf("%d bytes counted, %d written", result.BytesWritten, list.Len())
+	}
+	entries, err := os.ReadDir(cfg.OutputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("files written next to the writer: %v", entries)
+	}
+}
+
+func TestOutputWriterRejectsFilename(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.Output = &bytes.Buffer{}
+	cfg.OutputFilename = "list.txt"
+	if _, err := Generate(t.Context(), cfg); err == nil {
+		t.Error("output writer accepted along with an output filename")
+	}
+}
@@ -0,0 +1,145 @@
+package blgen
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// A terminal is updated often enough to look live, a log only gets a
+	// line now and then.
+	progressTTYInterval = 200 * time.Millisecond
+	progressLogInterval = 10 * time.Second
+
+	// progressRowBatch is how many rows a scan counts before reporting them.
+	progressRowBatch = 10000
+)
+
+// progressReporter reports the download and scan progress: as a status line
+// updated in place when stderr is a terminal, and as periodic log messages
+// otherwise. A nil progressReporter reports nothing.
+type progressReporter struct {
+	w        io.Writer
+	logger   *slog.Logger
+	tty      bool
+	interval time.Duration
+	rows     atomic.Int64
+
+	mu          sync.Mutex
+	last        time.Time
+	partialLine bool
+}
+
+func newProgressReporter(stderr *os.File, logger *slog.Logger) *progressReporter {
+	p := &progressReporter{w: stderr, logger: logger, interval: progressLogInterval}
+	if info, err := stderr.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		p.tty = true
+		p.interval = progressTTYInterval
+	}
+	return p
+}
+
+// report shows the message unless the last one was shown less than the
+// interval ago. final messages are always shown.
+func (p *progressReporter) report(final bool, format string, args ...any) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if !final && now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last = now
+
+	message := fmt.Sprintf(format, args...)
+	if !p.tty {
+		p.logger.Info(message)
+		return
+	}
+	fmt.Fprintf(p.w, "\r\033[K%s", message)
+	p.partialLine = !final
+	if final {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// addRows counts scanned rows of the blocks file.
+func (p *progressReporter) addRows(n int) {
+	if p == nil {
+		return
+	}
+	p.report(false, "Scanned %d rows", p.rows.Add(int64(n)))
+}
+
+// scanDone reports the rows of the finished scan, and starts counting
+// those of the next one, such as the scan of another edition.
+func (p *progressReporter) scanDone() {
+	if p == nil {
+		return
+	}
+	p.report(true, "Scanned %d rows", p.rows.Swap(0))
+}
+
+// end finishes a status line left unfinished by an interrupted download or
+// scan, so later output starts on a line of its own.
+func (p *progressReporter) end() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.partialLine {
+		fmt.Fprintln(p.w)
+		p.partialLine = false
+	}
+}
+
+// progressReader reports the progress of a download read through it.
+type progressReader struct {
+	r        io.Reader
+	progress *progressReporter
+	what     string
+	read     int64
+	// total is the expected size, or -1 when the server didn't send it.
+	total int64
+}
+
+func (p *progressReporter) wrapDownload(r io.Reader, what string, total int64) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, progress: p, what: what, total: total}
+}
+
+func (pr *progressReader) Read(b []byte) (int, error) {
+	n, err := pr.r.Read(b)
+	pr.read += int64(n)
+	final := err == io.EOF
+	if pr.total > 0 {
+		pr.progress.report(final, "Downloaded %s of %s %s (%d%%)", formatBytes(pr.read), formatBytes(pr.total), pr.what, pr.read*100/pr.total)
+	} else {
+		pr.progress.report(final, "Downloaded %s of %s", formatBytes(pr.read), pr.what)
+	}
+	return n, err
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,77 @@
+package blgen
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// testProgress returns a reporter showing every message on a terminal,
+// written to w.
+func testProgress(w io.Writer) *progressReporter {
+	return &progressReporter{w: w, tty: true}
+}
+
+func TestProgressCountsRows(t *testing.T) {
+	var blocks strings.Builder
+	const rows = 2*progressRowBatch + 5000
+	for i := range rows {
+		fmt.Fprintf(&blocks, "10.%d.%d.0/24,2017370,2017370,,0,0,\n", i/256%256, i%256)
+	}
+	var status bytes.Buffer
+	scan := blockScan{
+		name:     "GeoLite2-Country-Blocks-IPv4.csv",
+		fields:   7,
+		columns:  map[string]int{"network": 0, "geoname_id": 1, registeredCountryColumn: 2, "represented_country_geoname_id": 3},
+		matcher:  geonameMatcher{geonames: map[string]geoname{}, fields: geonameColumns},
+		progress: testProgress(&status),
+		rows:     new(atomic.Int64),
+	}
+	skip := func(row malformedRow) error { return row.err }
+	err := scanBlocksSequential(t.Context(), strings.NewReader(blocks.String()), scan, 1, skip, func(netip.Prefix, geoname) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan.progress.scanDone()
+
+	var counts []string
+	for _, match := range regexp.MustCompile(`Scanned (\d+) rows`).FindAllStringSubmatch(status.String(), -1) {
+		counts = append(counts, match[1])
+	}
+	// A report for every batch, one for the rest and the final one.
+	if want := []string{"10000", "20000", "25000", "25000"}; !slices.Equal(counts, want) {
+		t.Errorf("reported %q rows, want %q", counts, want)
+	}
+	if !strings.HasSuffix(status.String(), "Scanned 25000 rows\n") {
+		t.Errorf("status line not finished: %q", status.String())
+	}
+}
+
+func TestProgressDownload(t *testing.T) {
+	var status bytes.Buffer
+	progress := testProgress(&status)
+	data := bytes.Repeat([]byte{'x'}, 4096)
+	r := progress.wrapDownload(io.MultiReader(bytes.NewReader(data[:1024]), bytes.NewReader(data[1024:])), "zip", int64(len(data)))
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(strings.ReplaceAll(status.String(), "\r\033[K", "\n")), "\n")
+	want := []string{"Downloaded 1.0 KiB of 4.0 KiB zip (25%)", "Downloaded 4.0 KiB of 4.0 KiB zip (100%)", "Downloaded 4.0 KiB of 4.0 KiB zip (100%)"}
+	if !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	var nilProgress *progressReporter
+	if r := nilProgress.wrapDownload(bytes.NewReader(data), "zip", 4096); r == nil {
+		t.Error("no reader without progress")
+	}
+	nilProgress.addRows(10)
+	nilProgress.scanDone()
+	nilProgress.end()
+}
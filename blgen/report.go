@@ -0,0 +1,99 @@
+package blgen
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"net/netip"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// CountryCount is the share of the database located in one country.
+type CountryCount struct {
+	// Label is the country code, or the continent code marked with a * for
+	// networks only located to a continent. It is empty for networks
+	// without a location. With the ASN edition it is the AS number.
+	Label     string
+	Name      string
+	Networks  int
+	Addresses uint64
+}
+
+// Report downloads and verifies the configured GeoLite2 database, and counts
+// the networks and addresses of every country in it. The configured codes
+// are ignored and nothing is written. The counts are sorted as ReportSort
+// says: by label, by the number of networks, or by the number of addresses,
+// the largest first for the last two.
+func Report(ctx context.Context, cfg Config) ([]CountryCount, error) {
+	var counts []CountryCount
+	err := run(ctx, &cfg, func(tmpDir string) error {
+		var matcher blockMatcher
+		err := cfg.runStage("match", tmpDir, func() error {
+			var err error
+			matcher, err = cfg.edition().newReportMatcher(ctx, tmpDir, &cfg)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		return cfg.runStage("scan", filepath.Join(tmpDir, cfg.edition().blocksCSV()), func() error {
+			blocks, err := openBlocksFile(tmpDir, matcher, &cfg)
+			if err != nil || blocks == nil {
+				return err
+			}
+			defer blocks.Close()
+
+			countries := map[geoname]*CountryCount{}
+			_, err = blocks.scanRows(ctx, &cfg, func(network netip.Prefix, country geoname) {
+				count, seen := countries[country]
+				if !seen {
+					count = &CountryCount{Label: country.label, Name: country.countryName}
+					countries[country] = count
+				}
+				count.Networks++
+				count.Addresses = addUint64Saturated(count.Addresses, addressCount(network))
+			})
+			if err != nil {
+				return err
+			}
+			for _, count := range countries {
+				counts = append(counts, *count)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(counts, func(a, b CountryCount) int {
+		byLabel := cmp.Or(strings.Compare(a.Label, b.Label), strings.Compare(a.Name, b.Name))
+		switch cfg.ReportSort {
+		case ReportSortCount:
+			return cmp.Or(cmp.Compare(b.Networks, a.Networks), byLabel)
+		case ReportSortSpace:
+			return cmp.Or(cmp.Compare(b.Addresses, a.Addresses), byLabel)
+		}
+		return byLabel
+	})
+	return counts, nil
+}
+
+// addressCount returns the number of addresses in network, capped at the
+// largest uint64 for IPv6 networks larger than that.
+func addressCount(network netip.Prefix) uint64 {
+	hostBits := network.Addr().BitLen() - network.Bits()
+	if hostBits >= 64 {
+		return math.MaxUint64
+	}
+	return 1 << hostBits
+}
+
+func addUint64Saturated(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
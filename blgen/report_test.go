@@ -0,0 +1,86 @@
+package blgen
+
+import (
+	"math"
+	"net/netip"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestReport(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	counts, err := Report(t.Context(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The configured RU is counted like any other country.
+	want := []CountryCount{
+		{"CN", "China", 1, 1 << 20},
+		{"DE", "Germany", 1, 1 << 16},
+		{"EU*", "", 1, 256},
+		{"IE", "Ireland", 1, 1 << 16},
+		{"RU", "Russia", 3, 1024},
+		{"US", "United States", 2, 512},
+	}
+	if !slices.Equal(counts, want) {
+		t.Errorf("got %+v, want %+v", counts, want)
+	}
+	if entries, _ := os.ReadDir(cfg.OutputFilePath); len(entries) != 0 {
+		t.Errorf("report wrote %d files", len(entries))
+	}
+}
+
+func TestReportSort(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	// DE and IE tie on both counts, and are ordered by code.
+	tests := []struct {
+		sort string
+		want []string
+	}{
+		{"", []string{"CN", "DE", "EU*", "IE", "RU", "US"}},
+		{ReportSortCode, []string{"CN", "DE", "EU*", "IE", "RU", "US"}},
+		{ReportSortCount, []string{"RU", "US", "CN", "DE", "EU*", "IE"}},
+		{ReportSortSpace, []string{"CN", "DE", "IE", "RU", "US", "EU*"}},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.ReportSort = test.sort
+		counts, err := Report(t.Context(), cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var labels []string
+		for _, count := range counts {
+			labels = append(labels, count.Label)
+		}
+		if !slices.Equal(labels, test.want) {
+			t.Errorf("%q: got %q, want %q", test.sort, labels, test.want)
+		}
+	}
+
+	cfg := testConfig(t, archive)
+	cfg.ReportSort = "name"
+	if _, err := Report(t.Context(), cfg); err == nil {
+		t.Error("unknown sort accepted")
+	}
+}
+
+func TestAddressCount(t *testing.T) {
+	tests := []struct {
+		network string
+		want    uint64
+	}{
+		{"2.56.10.0/23", 512},
+		{"36.0.0.0/12", 1 << 20},
+		{"8.8.8.8/32", 1},
+		{"0.0.0.0/0", 1 << 32},
+		{"2001:db8::/64", math.MaxUint64},
+		{"2001:db8::/96", 1 << 32},
+	}
+	for _, test := range tests {
+		if got := addressCount(netip.MustParsePrefix(test.network)); got != test.want {
+			t.Errorf("addressCount(%s) = %d, want %d", test.network, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package blgen
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"time"
+)
+
+// retryBaseDelay is the delay before the first retry, doubled for each
+// retry after it up to retryMaxDelay.
+var retryBaseDelay = time.Second
+
+const retryMaxDelay = 30 * time.Second
+
+// retryableError marks a failure as transient, optionally carrying the delay
+// requested by the server through a Retry-After header.
+type retryableError struct {
+	err        error
+	retryAfter time.Duration
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// fetch requests url with the configured credentials and any extra header,
+// and hands the response to handle once it has a 200 status, a 304 status
+// for conditional requests, or a 206 or 416 status for range requests.
+// Network errors, 5xx and 429 responses, and errors from handle wrapped in
+// retryableError are retried with exponential backoff up to cfg.Retries
+// attempts in total. A 401, 403 or 429 response moves on to the next
+// credential instead, as long as there is one, without counting as an
+// attempt. A 401 or 403 response with no credential left fails with
+// ErrCredentialsRejected. header is read again for every attempt, so handle may
+// change it for the next one. Each attempt, including handle reading the
+// body, has to complete within timeout.
+func fetch(ctx context.Context, what, url string, cfg *Config, header http.Header, timeout time.Duration, handle func(*http.Response) error) error {
+	for attempt := 1; ; attempt++ {
+		err := fetchOnce(ctx, what, url, cfg, header, timeout, handle)
+		var failover *credentialFailover
+		if errors.As(err, &failover) && ctx.Err() == nil {
+			// The next credential gets the same attempt.
+			cfg.Logger.Warn("credential rejected, trying the next one", "what", what, "error", err)
+			attempt--
+			continue
+		}
+		var retryErr *retryableError
+		if err == nil || !errors.As(err, &retryErr) || attempt >= cfg.Retries || ctx.Err() != nil {
+			return err
+		}
+
+		delay := retryDelay(attempt, retryErr.retryAfter)
+		cfg.Logger.Warn("download failed, retrying", "what", what, "error", err, "delay", delay, "attempt", attempt+1, "attempts", cfg.Retries)
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+func fetchOnce(ctx context.Context, what, url string, cfg *Config, header http.Header, timeout time.Duration, handle func(*http.Response) error) error {
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// The trace records whether the request got a new connection or reused
+	// one, which keeping connections alive across the requests of a run is
+	// for.
+	var conn httptrace.GotConnInfo
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) { conn = info }}
+	httpRequest, err := http.NewRequestWithContext(httptrace.WithClientTrace(attemptCtx, trace), "GET", url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create %s HTTP request: %w", what, err)
+	}
+	for key, values := range header {
+		httpRequest.Header[key] = values
+	}
+	httpRequest.Header.Set("User-Agent", cfg.UserAgent)
+	credential, credentialIndex := cfg.credentials.get()
+	httpRequest.SetBasicAuth(credential.AccountID, credential.LicenseKey)
+
+	if err := cfg.limiter.wait(ctx); err != nil {
+		return err
+	}
+	httpResponse, err := cfg.HTTPClient.Do(httpRequest)
+	if err != nil {
+		return &retryableError{err: fmt.Errorf("%s fetch failed: %w", what, err)}
+	}
+	defer httpResponse.Body.Close()
+	cfg.Logger.Debug("response", "what", what, "status", httpResponse.StatusCode, "protocol", httpResponse.Proto, "reused_connection", conn.Reused, "account_id", credential.AccountID)
+
+	conditional := httpRequest.Header.Get("If-None-Match") != "" || httpRequest.Header.Get("If-Modified-Since") != ""
+	notModified := conditional && httpResponse.StatusCode == http.StatusNotModified
+	ranged := httpRequest.Header.Get("Range") != "" &&
+		(httpResponse.StatusCode == http.StatusPartialContent || httpResponse.StatusCode == http.StatusRequestedRangeNotSatisfiable)
+	if httpResponse.StatusCode != http.StatusOK && !notModified && !ranged {
+		err := fmt.Errorf("%s bad status: %s", what, httpResponse.Status)
+		rejected := httpResponse.StatusCode == http.StatusUnauthorized || httpResponse.StatusCode == http.StatusForbidden ||
+			httpResponse.StatusCode == http.StatusTooManyRequests
+		switch {
+		case rejected && cfg.credentials.failover(credentialIndex):
+			return &credentialFailover{err: err}
+		case httpResponse.StatusCode == http.StatusUnauthorized || httpResponse.StatusCode == http.StatusForbidden:
+			return fmt.Errorf("%w: %w", ErrCredentialsRejected, err)
+		case httpResponse.StatusCode == http.StatusTooManyRequests:
+			delay := cfg.limiter.throttled()
+			cfg.Logger.Debug("request delay widened", "what", what, "delay", delay)
+			return &retryableError{err: err, retryAfter: parseRetryAfter(httpResponse.Header.Get("Retry-After"))}
+		case httpResponse.StatusCode >= 500:
+			return &retryableError{err: err}
+		}
+		return err
+	}
+
+	return handle(httpResponse)
+}
+
+// retryDelay returns the delay before the retry following attempt. A
+// Retry-After sent by the server is honored up to retryMaxDelay, so a server
+// asking for an hour doesn't hold the run up that long.
+func retryDelay(attempt int, retryAfter time.Duration) time.Duration {
+	if retryAfter > 0 {
+		return min(retryAfter, retryMaxDelay)
+	}
+	return min(retryBaseDelay<<(attempt-1), retryMaxDelay)
+}
+
+// parseRetryAfter accepts both forms of the Retry-After header, a number of
+// seconds or an HTTP date, and returns zero when it is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		return max(time.Until(date), 0)
+	}
+	return 0
+}
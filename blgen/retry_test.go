@@ -0,0 +1,108 @@
+package blgen
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fastRetries makes the retries of the test wait a millisecond.
+func fastRetries(t *testing.T) {
+	delay := retryBaseDelay
+	t.Cleanup(func() { retryBaseDelay = delay })
+	retryBaseDelay = time.Millisecond
+}
+
+// failDownloads makes the server answer the first n archive requests with
+// status, and returns the number of archive requests.
+func failDownloads(server *testServer, n int32, status int) *atomic.Int32 {
+	var requests atomic.Int32
+	server.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/db.zip" {
+			return false
+		}
+		if requests.Add(1) <= n {
+			http.Error(w, http.StatusText(status), status)
+			return true
+		}
+		return false
+	}
+	return &requests
+}
+
+func TestRetryTransientFailures(t *testing.T) {
+	fastRetries(t)
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	requests := failDownloads(server, 2, http.StatusServiceUnavailable)
+	result := generate(t, server.config(t))
+	if requests.Load() != 3 {
+		t.Errorf("archive requested %d times, want 3", requests.Load())
+	}
+	if result.NetworksWritten != 4 {
+		t.Errorf("%d networks written after the retries, want 4", result.NetworksWritten)
+	}
+}
+
+func TestRetriesExhausted(t *testing.T) {
+	fastRetries(t)
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	requests := failDownloads(server, 5, http.StatusBadGateway)
+	cfg := server.config(t)
+	cfg.Retries = 2
+	_, err := Generate(t.Context(), cfg)
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Errorf("got %v, want the bad status", err)
+	}
+	if requests.Load() != 2 {
+		t.Errorf("archive requested %d times, want 2", requests.Load())
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	fastRetries(t)
+	server := newTestServer(t, countryArchive(t, testBlocks))
+	requests := failDownloads(server, 5, http.StatusNotFound)
+	if _, err := Generate(t.Context(), server.config(t)); err == nil {
+		t.Error("404 accepted")
+	}
+	if requests.Load() != 1 {
+		t.Errorf("archive requested %d times, want 1", requests.Load())
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		attempt    int
+		retryAfter time.Duration
+		want       time.Duration
+	}{
+		{1, 0, time.Second},
+		{2, 0, 2 * time.Second},
+		{3, 0, 4 * time.Second},
+		{10, 0, retryMaxDelay},
+		{1, 7 * time.Second, 7 * time.Second},
+		{1, time.Hour, retryMaxDelay},
+	}
+	for _, test := range tests {
+		if got := retryDelay(test.attempt, test.retryAfter); got != test.want {
+			t.Errorf("retryDelay(%d, %v) = %v, want %v", test.attempt, test.retryAfter, got, test.want)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if got := parseRetryAfter("120"); got != 2*time.Minute {
+		t.Errorf("seconds parsed as %v", got)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if got := parseRetryAfter(date); got < 59*time.Minute || got > time.Hour {
+		t.Errorf("date an hour ahead parsed as %v", got)
+	}
+	for _, value := range []string{"", "soon", "-5"} {
+		if got := parseRetryAfter(value); got != 0 {
+			t.Errorf("parseRetryAfter(%q) = %v", value, got)
+		}
+	}
+}
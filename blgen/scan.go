@@ -0,0 +1,268 @@
+package blgen
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+// scanChunkSize is roughly how much of the blocks file each worker parses at
+// a time. Chunks always end on a line boundary.
+var scanChunkSize = 1 << 20
+
+// blockScan describes the rows of a blocks file following its header.
+type blockScan struct {
+	name    string
+	fields  int
+	columns map[string]int
+	matcher blockMatcher
+	// progress counts the scanned rows, it may be nil.
+	progress *progressReporter
+	// maxMalformed is the number of malformed rows skipped before the scan
+	// fails.
+	maxMalformed int
+	logger       *slog.Logger
+	// sample is the N of every Nth row used, see Config.Sample.
+	sample int
+	// rows counts the scanned rows.
+	rows *atomic.Int64
+}
+
+// emitFunc receives the network of a matched row of the blocks file, in its
+// canonical form.
+type emitFunc func(network netip.Prefix, country geoname)
+
+// malformedRow is a row of the blocks file that can't be used.
+type malformedRow struct {
+	line int
+	err  error
+}
+
+// malformedRows counts the skipped rows of a scan.
+type malformedRows struct {
+	scan  *blockScan
+	count int
+}
+
+// skip logs a malformed row, and fails once more rows than allowed were
+// skipped.
+func (m *malformedRows) skip(row malformedRow) error {
+	m.count++
+	if m.count > m.scan.maxMalformed {
+		return fmt.Errorf("too many malformed rows in %s, giving up at line %d: %w", m.scan.name, row.line, row.err)
+	}
+	m.scan.logger.Warn("skipping malformed row", "path", m.scan.name, "line", row.line, "error", row.err)
+	return nil
+}
+
+// scanBlocks calls emit for every matched row read from r, in file order, and
+// returns the number of malformed rows it skipped. With more than one worker
+// the rows are parsed and matched concurrently in chunks, and the chunks are
+// emitted in the order they were read, so the result doesn't depend on the
+// number of workers.
+func scanBlocks(ctx context.Context, r *bufio.Reader, scan blockScan, workers int, emit emitFunc) (int, error) {
+	malformed := &malformedRows{scan: &scan}
+	var err error
+	// The rows follow the header on line 1.
+	if workers <= 1 {
+		err = scanBlocksSequential(ctx, r, scan, 1, malformed.skip, emit)
+	} else {
+		err = scanBlocksParallel(ctx, r, scan, workers, malformed, emit)
+	}
+	return malformed.count, err
+}
+
+// scanBlocksSequential scans the rows read from r, which start after line
+// lineOffset of the file. Malformed rows are handed to skip, and the scan
+// stops when skip returns an error.
+func scanBlocksSequential(ctx context.Context, r io.Reader, scan blockScan, lineOffset int, skip func(malformedRow) error, emit emitFunc) error {
+	csvData := scan.newReader(r)
+	networkIdx := scan.columns["network"]
+	rows := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line, err := csvData.Read()
+		if err == io.EOF {
+			scan.progress.addRows(rows)
+			scan.rows.Add(int64(rows))
+			return nil
+		}
+		if rows++; rows == progressRowBatch {
+			scan.progress.addRows(rows)
+			scan.rows.Add(int64(rows))
+			rows = 0
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if !errors.As(err, &parseErr) {
+				return fmt.Errorf("failed to read %s CSV line: %w", scan.name, err)
+			}
+			if err := skip(malformedRow{lineOffset + parseErr.Line, parseErr.Err}); err != nil {
+				return err
+			}
+			continue
+		}
+		// Rows are sampled by line number, so chunks sample the same rows
+		// as a sequential scan.
+		if scan.sample > 1 {
+			if lineNumber, _ := csvData.FieldPos(0); (lineOffset+lineNumber-2)%scan.sample != 0 {
+				continue
+			}
+		}
+
+		country, found := scan.matcher.match(line, scan.columns)
+		if !found {
+			continue
+		}
+		network, err := netip.ParsePrefix(line[networkIdx])
+		if err != nil {
+			lineNumber, _ := csvData.FieldPos(networkIdx)
+			if err := skip(malformedRow{lineOffset + lineNumber, fmt.Errorf("invalid network %q: %w", line[networkIdx], err)}); err != nil {
+				return err
+			}
+			continue
+		}
+		emit(network.Masked(), country)
+	}
+}
+
+type scannedBlock struct {
+	network netip.Prefix
+	country geoname
+}
+
+type chunkResult struct {
+	blocks    []scannedBlock
+	malformed []malformedRow
+	err       error
+}
+
+type scanChunk struct {
+	data []byte
+	// lineOffset is the number of lines in the file before the chunk.
+	lineOffset int
+	result     chan chunkResult
+}
+
+func scanBlocksParallel(ctx context.Context, r *bufio.Reader, scan blockScan, workers int, malformed *malformedRows, emit emitFunc) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan scanChunk)
+	// ordered receives each chunk's result channel in file order, and holds
+	// a few more than there are workers so reading stays ahead of writing.
+	ordered := make(chan chan chunkResult, 2*workers)
+
+	for range workers {
+		wg.Go(func() {
+			for chunk := range chunks {
+				chunk.result <- scan.matchChunk(ctx, chunk)
+			}
+		})
+	}
+
+	var readErr error
+	wg.Go(func() {
+		defer close(ordered)
+		defer close(chunks)
+		lineOffset := 1
+		for {
+			data, err := readChunk(r)
+			if len(data) > 0 {
+				chunk := scanChunk{data: data, lineOffset: lineOffset, result: make(chan chunkResult, 1)}
+				lineOffset += bytes.Count(data, []byte{'\n'})
+				select {
+				case ordered <- chunk.result:
+				case <-ctx.Done():
+					return
+				}
+				select {
+				case chunks <- chunk:
+				case <-ctx.Done():
+					return
+				}
+			}
+			if err == io.EOF {
+				return
+			}
+			if err != nil {
+				readErr = fmt.Errorf("failed to read %s: %w", scan.name, err)
+				return
+			}
+		}
+	})
+
+	for result := range ordered {
+		select {
+		case chunk := <-result:
+			// Malformed rows are counted here rather than in the workers,
+			// so the limit is hit at the same row for any number of
+			// workers.
+			for _, row := range chunk.malformed {
+				if err := malformed.skip(row); err != nil {
+					return err
+				}
+			}
+			if chunk.err != nil {
+				return chunk.err
+			}
+			for _, block := range chunk.blocks {
+				emit(block.network, block.country)
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return readErr
+}
+
+// readChunk reads about scanChunkSize bytes from r, up to the end of a line.
+func readChunk(r *bufio.Reader) ([]byte, error) {
+	data := make([]byte, scanChunkSize)
+	n, err := io.ReadFull(r, data)
+	data = data[:n]
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return data, io.EOF
+	}
+	if err != nil {
+		return data, err
+	}
+	rest, err := r.ReadBytes('\n')
+	return append(data, rest...), err
+}
+
+func (scan blockScan) matchChunk(ctx context.Context, chunk scanChunk) chunkResult {
+	var result chunkResult
+	skip := func(row malformedRow) error {
+		result.malformed = append(result.malformed, row)
+		return nil
+	}
+	result.err = scanBlocksSequential(ctx, bytes.NewReader(chunk.data), scan, chunk.lineOffset, skip, func(network netip.Prefix, country geoname) {
+		result.blocks = append(result.blocks, scannedBlock{network, country})
+	})
+	return result
+}
+
+func (scan blockScan) newReader(r io.Reader) *csv.Reader {
+	csvData := csv.NewReader(r)
+	csvData.ReuseRecord = true
+	// Chunks don't start with the header, so the field count is set from
+	// it explicitly. Rows with a different count are reported as malformed.
+	csvData.FieldsPerRecord = scan.fields
+	return csvData
+}
@@ -0,0 +1,152 @@
+package blgen
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// shuffledBlocks returns a blocks file of n /24 networks of RU, DE and US in
+// no particular order, with every tenth one repeated at the end.
+func shuffledBlocks(n int) string {
+	geonames := []string{"2017370", "2921044", "6252001"}
+	var blocks, repeated strings.Builder
+	blocks.WriteString(testBlocksHeader)
+	for i := range n {
+		j := i * 7919 % n
+		row := fmt.Sprintf("10.%d.%d.0/24,%s,%[3]s,,0,0,\n", j/256, j%256, geonames[j%len(geonames)])
+		blocks.WriteString(row)
+		if i%10 == 0 {
+			repeated.WriteString(row)
+		}
+	}
+	blocks.WriteString(repeated.String())
+	return blocks.String()
+}
+
+func TestWorkersMatchSequential(t *testing.T) {
+	defer func(size int) { scanChunkSize = size }(scanChunkSize)
+	scanChunkSize = 256
+
+	archive := countryArchive(t, shuffledBlocks(1000))
+	tests := []func(cfg *Config){
+		func(cfg *Config) {},
+		func(cfg *Config) { cfg.Mode = ModeAllow },
+		func(cfg *Config) { cfg.BlockedCountries = codes("RU", "US") },
+		func(cfg *Config) { cfg.Format = FormatCSV },
+	}
+	for i, configure := range tests {
+		write := func(workers int) string {
+			cfg := testConfig(t, archive)
+			cfg.NoHeader = true
+			cfg.Workers = workers
+			configure(&cfg)
+			return readFile(t, generate(t, cfg).OutputPath)
+		}
+		sequential := write(1)
+		if sequential == "" {
+			t.Fatalf("config %d: empty list", i)
+		}
+		for _, workers := range []int{2, 8} {
+			if got := write(workers); got != sequential {
+				t.Errorf("config %d: %d workers wrote\n%s\nwant\n%s", i, workers, got, sequential)
+			}
+		}
+	}
+}
+
+func BenchmarkScanBlocks(b *testing.B) {
+	archive := countryArchive(b, shuffledBlocks(65536))
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			cfg := testConfig(b, archive)
+			cfg.BlockedCountries = codes("RU", "DE")
+			cfg.Workers = workers
+			for b.Loop() {
+				generate(b, cfg)
+			}
+		})
+	}
+}
+
+func TestMalformedRows(t *testing.T) {
+	blocks := testBlocks + `2.56.300.0/24,2017370,2017370,,0,0,
+2.56.12.0/24,2017370
+2.56.13.0/24,2017370,2017370,,0,0,,extra
+`
+	archive := countryArchive(t, blocks)
+	tests := []struct {
+		maxErrors int
+		valid     bool
+	}{
+		{0, false},
+		{2, false},
+		{3, true},
+		{10, true},
+	}
+	for _, test := range tests {
+		cfg := testConfig(t, archive)
+		cfg.MaxErrors = test.maxErrors
+		log := captureLog(&cfg)
+		result, err := Generate(t.Context(), cfg)
+		if (err == nil) != test.valid {
+			t.Errorf("%d errors allowed: %v", test.maxErrors, err)
+			continue
+		}
+		skipped := strings.Count(log.String(), "skipping malformed row")
+		if err == nil && (skipped != 3 || result.NetworksWritten != 4) {
+			t.Errorf("%d errors allowed: %d rows skipped and %d networks written, want 3 and 4",
+				test.maxErrors, skipped, result.NetworksWritten)
+		}
+	}
+}
+
+// Networks are written in their canonical form, and rows holding no network
+// are counted and left out.
+func TestInvalidNetworks(t *testing.T) {
+	blocks := testBlocksHeader + `2.56.8.7/24,2017370,2017370,,0,0,
+1.2.3.0/33,2017370,2017370,,0,0,
+1.2.3.4,2017370,2017370,,0,0,
+01.2.3.0/24,2017370,2017370,,0,0,
+2001:DB8:0:0::/32,2017370,2017370,,0,0,
+`
+	cfg := testConfig(t, countryArchive(t, blocks))
+	cfg.MaxErrors = 10
+	result := generate(t, cfg)
+	want := []string{"2.56.8.0/24 ; RU", "2001:db8::/32 ; RU"}
+	if got := listLines(t, result.OutputPath); !slices.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if result.MalformedRows != 3 {
+		t.Errorf("%d malformed rows counted, want 3", result.MalformedRows)
+	}
+}
+
+func TestSample(t *testing.T) {
+	defer func(size int) { scanChunkSize = size }(scanChunkSize)
+	scanChunkSize = 256
+
+	// A third of the rows are RU, spread over the file.
+	archive := countryArchive(t, shuffledBlocks(3000))
+	cfg := testConfig(t, archive)
+	cfg.AllowDuplicates = true
+	full := generate(t, cfg).NetworksWritten
+	for _, workers := range []int{1, 4} {
+		for _, n := range []int{1, 10, 100} {
+			cfg := testConfig(t, archive)
+			cfg.Sample = n
+			cfg.Workers = workers
+			cfg.AllowDuplicates = true
+			result := generate(t, cfg)
+			want := float64(full) / float64(n)
+			if got := float64(result.NetworksWritten); got < want*0.7 || got > want*1.3 {
+				t.Errorf("%d workers, sample 1/%d: %d of %d networks written, want about %.0f", workers, n, result.NetworksWritten, full, want)
+			}
+			header := readFile(t, result.OutputPath)
+			if sampled := strings.Contains(header, fmt.Sprintf("from a sample of 1 in %d rows", n)); sampled != (n > 1) {
+				t.Errorf("sample 1/%d: header %.100q", n, header)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package blgen
+
+import (
+	"cmp"
+	"container/heap"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"slices"
+)
+
+// spillChunkSize is the number of networks the low memory mode sorts in
+// memory before spilling them to a file.
+var spillChunkSize = 1 << 18
+
+// spillRecord is a network waiting to be written, with its geoname.
+type spillRecord struct {
+	network netip.Prefix
+	country geoname
+}
+
+// compareSpillRecords orders the networks like the buffered sort does: by
+// geoname, and numerically within each geoname.
+func compareSpillRecords(a, b spillRecord) int {
+	return cmp.Or(compareGeonames(a.country, b.country), compareByAddr(a.network, b.network))
+}
+
+// spillSorter sorts the networks of the low memory mode with an external
+// merge sort. The networks are sorted in chunks of spillChunkSize, each
+// spilled to a file in dir, and the files are merged as they are read back,
+// so no more than a chunk and a line of every file are ever held in memory.
+type spillSorter struct {
+	dir   string
+	chunk []spillRecord
+	files []string
+}
+
+func (s *spillSorter) add(network netip.Prefix, country geoname) error {
+	s.chunk = append(s.chunk, spillRecord{network, country})
+	if len(s.chunk) < spillChunkSize {
+		return nil
+	}
+	return s.spill()
+}
+
+// spill sorts the chunk and writes it to a file of its own.
+func (s *spillSorter) spill() error {
+	slices.SortFunc(s.chunk, compareSpillRecords)
+	file, err := os.CreateTemp(s.dir, "sort-*.csv")
+	if err != nil {
+		return fmt.Errorf("failed to create sort file: %w", err)
+	}
+	s.files = append(s.files, file.Name())
+	csvWriter := csv.NewWriter(file)
+	for _, record := range s.chunk {
+		country := record.country
+		csvWriter.Write([]string{record.network.String(), country.label, country.countryName, country.country, country.reason})
+	}
+	csvWriter.Flush()
+	if err := csvWriter.Error(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write sort file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write sort file: %w", err)
+	}
+	s.chunk = s.chunk[:0]
+	return nil
+}
+
+// merge calls fn with every network added, in order. Without any spilled
+// files the chunk is sorted in memory.
+func (s *spillSorter) merge(fn func(network netip.Prefix, country geoname)) error {
+	if len(s.files) == 0 {
+		slices.SortFunc(s.chunk, compareSpillRecords)
+		for _, record := range s.chunk {
+			fn(record.network, record.country)
+		}
+		return nil
+	}
+	if len(s.chunk) > 0 {
+		if err := s.spill(); err != nil {
+			return err
+		}
+	}
+
+	var readers spillReaders
+	defer func() {
+		for _, reader := range readers {
+			reader.file.Close()
+		}
+	}()
+	for _, path := range s.files {
+		reader, err := openSpillReader(path)
+		if err != nil {
+			return err
+		}
+		if err := reader.next(); err == io.EOF {
+			reader.file.Close()
+			continue
+		} else if err != nil {
+			reader.file.Close()
+			return err
+		}
+		readers = append(readers, reader)
+	}
+	heap.Init(&readers)
+	for len(readers) > 0 {
+		reader := readers[0]
+		fn(reader.record.network, reader.record.country)
+		err := reader.next()
+		if err == io.EOF {
+			reader.file.Close()
+			heap.Pop(&readers)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		heap.Fix(&readers, 0)
+	}
+	return nil
+}
+
+// close removes the spilled files.
+func (s *spillSorter) close() {
+	for _, path := range s.files {
+		os.Remove(path)
+	}
+}
+
+// spillReader reads a spilled file back one network at a time.
+type spillReader struct {
+	file   *os.File
+	csv    *csv.Reader
+	record spillRecord
+}
+
+func openSpillReader(path string) (*spillReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sort file: %w", err)
+	}
+	csvReader := csv.NewReader(file)
+	csvReader.FieldsPerRecord = 5
+	csvReader.ReuseRecord = true
+	return &spillReader{file: file, csv: csvReader}, nil
+}
+
+// next reads the next network into record, returning io.EOF at the end of
+// the file.
+func (r *spillReader) next() error {
+	fields, err := r.csv.Read()
+	if errors.Is(err, io.EOF) {
+		return io.EOF
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read sort file: %w", err)
+	}
+	network, err := netip.ParsePrefix(fields[0])
+	if err != nil {
+		return fmt.Errorf("failed to read sort file: %w", err)
+	}
+	r.record = spillRecord{network, geoname{label: fields[1], countryName: fields[2], country: fields[3], reason: fields[4]}}
+	return nil
+}
+
+// spillReaders is a heap of the readers by their current network.
+type spillReaders []*spillReader
+
+func (h spillReaders) Len() int { return len(h) }
+func (h spillReaders) Less(i, j int) bool {
+	return compareSpillRecords(h[i].record, h[j].record) < 0
+}
+func (h spillReaders) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *spillReaders) Push(x any)   { *h = append(*h, x.(*spillReader)) }
+func (h *spillReaders) Pop() any {
+	old := *h
+	reader := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return reader
+}
@@ -0,0 +1,55 @@
+package blgen
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLowMemoryMatchesSorted(t *testing.T) {
+	defer func(size int) { spillChunkSize = size }(spillChunkSize)
+	spillChunkSize = 64
+
+	archive := countryArchive(t, shuffledBlocks(1000))
+	tests := []func(cfg *Config){
+		func(cfg *Config) { cfg.Sort = true },
+		func(cfg *Config) { cfg.Grouped = true },
+		func(cfg *Config) { cfg.Sort, cfg.MapV4ToV6 = true, MapV4ToV6Also },
+		func(cfg *Config) { cfg.Sort, cfg.Aggregate = true, true },
+		func(cfg *Config) { cfg.Sort, cfg.Format = true, FormatNetsh },
+	}
+	for i, configure := range tests {
+		write := func(lowMemory bool) string {
+			cfg := testConfig(t, archive)
+			cfg.BlockedCountries = codes("RU", "DE", "US")
+			cfg.NoHeader = true
+			cfg.LowMemory = lowMemory
+			configure(&cfg)
+			result := generate(t, cfg)
+			data, err := os.ReadFile(result.OutputPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return string(data)
+		}
+		want, got := write(false), write(true)
+		if got != want {
+			t.Errorf("test %d: low memory list differs:\n%s\nwant:\n%s", i, got, want)
+		}
+	}
+}
+
+func TestLowMemoryRemembersNoLines(t *testing.T) {
+	cfg := Config{LowMemory: true, Sort: true}
+	var list strings.Builder
+	bw := newBlockWriter(&list, cidrFormatter{}, &cfg)
+	if bw.seen != nil {
+		t.Fatal("low memory block writer remembers the lines")
+	}
+	for _, network := range []string{"10.0.0.0/24", "10.0.0.0/24", "10.0.1.0/24", "10.0.1.0/24", "10.0.2.0/24"} {
+		bw.writeBlock(blockEntry{network: network, geoname: geoname{label: "RU"}})
+	}
+	if want := "10.0.0.0/24\n10.0.1.0/24\n10.0.2.0/24\n"; list.String() != want {
+		t.Errorf("got %q, want %q", list.String(), want)
+	}
+}
@@ -0,0 +1,259 @@
+package blgen
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// splitDir is the directory below the temp directory the per-country files of
+// SplitByCountry are written to.
+const splitDir = "split"
+
+// splitName returns the name of the per-country file a network of g goes to,
+// without extension: the country code, or for locations without a country
+// the continent or ASN it was listed for.
+func (g geoname) splitName() string {
+	if g.country != "" {
+		return g.country
+	}
+	if continent, ok := strings.CutSuffix(g.label, "*"); ok {
+		return "continent-" + continent
+	}
+	return g.label
+}
+
+// maxOpenSplitFiles is how many per-country files are kept open at once.
+// A split of every country in several formats would otherwise run into the
+// usual limit of 1024 open files.
+var maxOpenSplitFiles = 64
+
+// countrySplit writes every network to the file of its country as well, in
+// every format. The files are created when their first network comes up.
+type countrySplit struct {
+	dir     string
+	header  string
+	cfg     *Config
+	outputs map[string][]*listOutput
+	// order holds the split names in the order their files were created.
+	order []string
+	// open holds the open files, the most recently written first. The
+	// least recently written one is closed to make room for another.
+	open *list.List
+	err  error
+}
+
+func newCountrySplit(tmpDir string, cfg *Config) (*countrySplit, error) {
+	dir := filepath.Join(tmpDir, splitDir)
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create split directory: %w", err)
+	}
+	return &countrySplit{dir: dir, cfg: cfg, outputs: map[string][]*listOutput{}, open: list.New()}, nil
+}
+
+// splitFile is a per-country file. The split may close it between writes,
+// and it is reopened for appending when it is written to again. The state
+// of the list, such as the compression, is kept in memory in the meantime.
+type splitFile struct {
+	path  string
+	split *countrySplit
+	// file is nil while the file is closed.
+	file    *os.File
+	element *list.Element
+}
+
+func (f *splitFile) Write(p []byte) (int, error) {
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return 0, fmt.Errorf("failed to reopen output file %s: %w", f.path, err)
+		}
+		if err := f.split.opened(f, file); err != nil {
+			file.Close()
+			return 0, err
+		}
+	} else {
+		f.split.open.MoveToFront(f.element)
+	}
+	return f.file.Write(p)
+}
+
+func (f *splitFile) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	f.split.open.Remove(f.element)
+	err := f.file.Close()
+	f.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close output file %s: %w", f.path, err)
+	}
+	return nil
+}
+
+// opened adds file to the open files, closing the least recently written
+// one when there are too many.
+func (s *countrySplit) opened(f *splitFile, file *os.File) error {
+	if s.open.Len() >= maxOpenSplitFiles {
+		if err := s.open.Back().Value.(*splitFile).Close(); err != nil {
+			return err
+		}
+	}
+	f.file = file
+	f.element = s.open.PushFront(f)
+	return nil
+}
+
+// splitFilename returns the name of the per-country file in the format.
+func (cfg *Config) splitFilename(name, format string) string {
+	filename := name + formatExtensions[format]
+	if cfg.Gzip {
+		filename += ".gz"
+	}
+	return filename
+}
+
+func (s *countrySplit) writeBlock(entry blockEntry) {
+	if s.err != nil {
+		return
+	}
+	name := entry.splitName()
+	outputs, found := s.outputs[name]
+	if !found {
+		outputs, s.err = s.create(name)
+		if s.err != nil {
+			return
+		}
+	}
+	for _, out := range outputs {
+		out.blocks.writeBlock(entry)
+	}
+}
+
+func (s *countrySplit) create(name string) ([]*listOutput, error) {
+	var outputs []*listOutput
+	for _, format := range s.cfg.formats() {
+		outputPath := filepath.Join(s.dir, s.cfg.splitFilename(name, format))
+		out, err := s.createOutput(outputPath, format)
+		if err != nil {
+			for _, out := range outputs {
+				out.file.Close()
+			}
+			return nil, err
+		}
+		startListOutput(out, s.header, s.cfg)
+		outputs = append(outputs, out)
+	}
+	s.outputs[name] = outputs
+	s.order = append(s.order, name)
+	return outputs, nil
+}
+
+// createOutput creates the per-country file in the format.
+func (s *countrySplit) createOutput(outputPath, format string) (*listOutput, error) {
+	file, err := createOutputFile(outputPath, s.cfg)
+	if err != nil {
+		return nil, err
+	}
+	f := &splitFile{path: outputPath, split: s}
+	if err := s.opened(f, file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	out, err := newListOutput(f, outputPath, format, s.cfg)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	out.file = f
+	return out, nil
+}
+
+// all returns the outputs of every country.
+func (s *countrySplit) all() []*listOutput {
+	var all []*listOutput
+	for _, name := range s.order {
+		all = append(all, s.outputs[name]...)
+	}
+	return all
+}
+
+// moveSplitFiles moves the per-country files, each followed by its checksum,
+// to OutputFilePath and returns their paths. The files of countries an
+// earlier run wrote and this one didn't are removed.
+func moveSplitFiles(tmpDir string, cfg *Config) ([]string, error) {
+	dir := filepath.Join(tmpDir, splitDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, &StageError{Stage: "move", Path: dir, Err: fmt.Errorf("failed to read split directory: %w", err)}
+	}
+	var paths []string
+	written := map[string]bool{}
+	for _, entry := range entries {
+		filename := entry.Name()
+		if strings.HasSuffix(filename, checksumSuffix) {
+			continue
+		}
+		outputPath := filepath.Join(cfg.OutputFilePath, filename)
+		err := cfg.runStage("move", outputPath, func() error {
+			if err := moveFile(dir, filename, cfg); err != nil {
+				return err
+			}
+			if cfg.Checksum {
+				return moveFile(dir, filename+checksumSuffix, cfg)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, outputPath)
+		written[filename] = true
+	}
+	if err := removeStaleSplitFiles(written, cfg); err != nil {
+		return nil, err
+	}
+	return paths, nil
+}
+
+// splitNamePattern matches the names splitName returns.
+var splitNamePattern = regexp.MustCompile(`^([A-Z]{2}|continent-[A-Z]{2}|AS[0-9]+)$`)
+
+// removeStaleSplitFiles removes the per-country files in OutputFilePath that
+// this run didn't write, left by an earlier run splitting out more countries,
+// along with their checksums. Only the files of the formats of this run are
+// removed.
+func removeStaleSplitFiles(written map[string]bool, cfg *Config) error {
+	entries, err := os.ReadDir(cfg.OutputFilePath)
+	if err != nil {
+		return &StageError{Stage: "move", Path: cfg.OutputFilePath, Err: fmt.Errorf("failed to read output directory: %w", err)}
+	}
+	for _, entry := range entries {
+		filename := entry.Name()
+		if written[filename] || !cfg.isSplitFilename(filename) {
+			continue
+		}
+		stalePath := filepath.Join(cfg.OutputFilePath, filename)
+		if err := os.Remove(stalePath); err != nil {
+			return &StageError{Stage: "move", Path: stalePath, Err: fmt.Errorf("failed to remove stale split file: %w", err)}
+		}
+		os.Remove(stalePath + checksumSuffix)
+		cfg.Logger.Info("removed stale split file", "path", stalePath)
+	}
+	return nil
+}
+
+// isSplitFilename reports whether filename is that of a per-country file in
+// one of the formats of the run.
+func (cfg *Config) isSplitFilename(filename string) bool {
+	for _, format := range cfg.formats() {
+		name, ok := strings.CutSuffix(filename, cfg.splitFilename("", format))
+		if ok && splitNamePattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
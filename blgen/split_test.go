@@ -0,0 +1,128 @@
+package blgen
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitByCountry(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.BlockedCountries = codes("RU", "DE", "US")
+	cfg.SplitByCountry = true
+	result := generate(t, cfg)
+	want := []string{
+		filepath.Join(cfg.OutputFilePath, "DE.txt"),
+		filepath.Join(cfg.OutputFilePath, "RU.txt"),
+		filepath.Join(cfg.OutputFilePath, "US.txt"),
+	}
+	if !slices.Equal(result.OutputPaths, want) {
+		t.Fatalf("got files %q, want %q", result.OutputPaths, want)
+	}
+	if got := listLines(t, want[2]); !slices.Equal(got, []string{"8.8.8.0/24 ; US", "185.1.1.0/24 ; US"}) {
+		t.Errorf("US.txt holds %q", got)
+	}
+}
+
+// The per-country files come out the same when only one of them can be open
+// at a time, so that they are reopened for every network that goes to
+// another country.
+func TestSplitByCountryReopensFiles(t *testing.T) {
+	blocks := testBlocksHeader + strings.Repeat(`2.56.8.0/24,2017370,2017370,,0,0,
+5.1.0.0/16,2921044,2921044,,0,0,
+8.8.8.0/24,6252001,6252001,,0,0,
+`, 3)
+	archive := countryArchive(t, blocks)
+	split := func(maxOpen int) string {
+		defer func(max int) { maxOpenSplitFiles = max }(maxOpenSplitFiles)
+		maxOpenSplitFiles = maxOpen
+		cfg := testConfig(t, archive)
+		cfg.BlockedCountries = codes("RU", "DE", "US")
+		cfg.SplitByCountry = true
+		cfg.AllowDuplicates = true
+		cfg.NoHeader = true
+		cfg.Format = FormatPlain + "," + FormatCIDR
+		cfg.Gzip = true
+		cfg.Checksum = true
+		generate(t, cfg)
+		return cfg.OutputFilePath
+	}
+	want, got := split(64), split(1)
+
+	entries, err := os.ReadDir(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 12 {
+		t.Errorf("got %d files, want 6 lists and their checksums", len(entries))
+	}
+	for _, entry := range entries {
+		wantData, err := os.ReadFile(filepath.Join(want, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotData, err := os.ReadFile(filepath.Join(got, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(gotData, wantData) {
+			t.Errorf("%s differs when it is reopened", entry.Name())
+		}
+	}
+
+	list := readGzip(t, filepath.Join(got, "DE.cidr.gz"))
+	if list != strings.Repeat("5.1.0.0/16\n", 3) {
+		t.Errorf("DE.cidr.gz holds %q", list)
+	}
+	data, err := os.ReadFile(filepath.Join(got, "DE.cidr.gz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	checksum, err := os.ReadFile(filepath.Join(got, "DE.cidr.gz"+checksumSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(checksum), hex.EncodeToString(sum[:])) {
+		t.Errorf("checksum %q doesn't match the reopened file", checksum)
+	}
+}
+
+// A run splitting out fewer countries removes the files of the others, and
+// leaves the rest of the directory alone.
+func TestSplitByCountryRemovesStaleFiles(t *testing.T) {
+	cfg := testConfig(t, countryArchive(t, testBlocks))
+	cfg.BlockedCountries = codes("RU", "DE", "US")
+	cfg.SplitByCountry = true
+	cfg.SplitCombined = true
+	cfg.Checksum = true
+	generate(t, cfg)
+	// Another format's file of a country isn't this run's to remove.
+	other := filepath.Join(cfg.OutputFilePath, "US.ipset")
+	if err := os.WriteFile(other, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.BlockedCountries = codes("RU")
+	result := generate(t, cfg)
+	entries, err := os.ReadDir(cfg.OutputFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	want := []string{DefaultOutputFilename, DefaultOutputFilename + checksumSuffix, "RU.txt", "RU.txt" + checksumSuffix, "US.ipset"}
+	if !slices.Equal(names, want) {
+		t.Errorf("second run left %q, want %q", names, want)
+	}
+	if want := []string{filepath.Join(cfg.OutputFilePath, DefaultOutputFilename), filepath.Join(cfg.OutputFilePath, "RU.txt")}; !slices.Equal(result.OutputPaths, want) {
+		t.Errorf("got files %q, want %q", result.OutputPaths, want)
+	}
+}
@@ -0,0 +1,150 @@
+package blgen
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// ListEntry is a network read back from a generated list.
+type ListEntry struct {
+	Network netip.Prefix
+	// Label is what the list records after the network, such as the
+	// country code. It is empty for formats without one.
+	Label string
+}
+
+// LookupList reads the list at path, gzipped or not, and returns the most
+// specific entry containing addr, or nil when the list doesn't cover it. The
+// list can be in any format that writes networks in CIDR notation, which is
+// every format but range.
+func LookupList(path string, addr netip.Addr) (*ListEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", path, err)
+	}
+	defer file.Close()
+
+	data := bufio.NewReader(file)
+	var r io.Reader = data
+	if magic, _ := data.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gzipReader, err := gzip.NewReader(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %w", path, err)
+		}
+		defer gzipReader.Close()
+		r = gzipReader
+	}
+
+	table := prefixTable{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if entries, ok := parseNetshLine(scanner.Text()); ok {
+			for _, entry := range entries {
+				table.add(entry)
+			}
+			continue
+		}
+		if entry, ok := parseListLine(scanner.Text()); ok {
+			table.add(entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return table.lookup(addr.Unmap()), nil
+}
+
+// parseListLine returns the network on a line of a list and the label after
+// it, if any. Comments and lines without a network are skipped.
+func parseListLine(line string) (ListEntry, bool) {
+	line, _, _ = strings.Cut(line, "#")
+	line, label, found := strings.Cut(line, ";")
+	if !found {
+		// The csv format separates the label with a comma, and may be
+		// followed by the name.
+		line, label, _ = strings.Cut(line, ",")
+		label, _, _ = strings.Cut(label, ",")
+	}
+	// Annotated match reasons follow the label.
+	label, _, _ = strings.Cut(label, ";")
+	for _, field := range strings.Fields(line) {
+		if network, ok := parseListNetwork(field); ok {
+			return ListEntry{Network: network, Label: strings.TrimSpace(label)}, true
+		}
+	}
+	return ListEntry{}, false
+}
+
+// parseNetshLine returns the networks of a rule of the netsh format, which
+// lists them all on one line, labelled with the label in the rule name.
+func parseNetshLine(line string) ([]ListEntry, bool) {
+	_, rule, found := strings.Cut(line, "add rule name=\"")
+	if !found {
+		return nil, false
+	}
+	name, rule, _ := strings.Cut(rule, "\"")
+	_, remoteIPs, found := strings.Cut(rule, "remoteip=")
+	if !found {
+		return nil, false
+	}
+	// The name is the rule prefix, the label and the number of the rule.
+	label := ""
+	if fields := strings.Fields(name); len(fields) >= 2 {
+		label = fields[len(fields)-2]
+	}
+	var entries []ListEntry
+	for _, field := range strings.Split(strings.TrimSpace(remoteIPs), ",") {
+		if network, ok := parseListNetwork(field); ok {
+			entries = append(entries, ListEntry{Network: network, Label: label})
+		}
+	}
+	return entries, true
+}
+
+// parseListNetwork parses a network of a list. IPv4-mapped networks are
+// looked up as the IPv4 networks they cover.
+func parseListNetwork(field string) (netip.Prefix, bool) {
+	network, err := netip.ParsePrefix(field)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	if network.Addr().Is4In6() && network.Bits() >= 96 {
+		network = netip.PrefixFrom(network.Addr().Unmap(), network.Bits()-96)
+	}
+	return network.Masked(), true
+}
+
+// prefixTable finds the longest matching prefix of an address by looking up
+// each of its prefixes, from the longest, among the networks of that length.
+type prefixTable map[int]map[netip.Prefix]*ListEntry
+
+func (t prefixTable) add(entry ListEntry) {
+	bits := entry.Network.Bits()
+	if t[bits] == nil {
+		t[bits] = map[netip.Prefix]*ListEntry{}
+	}
+	// The first entry of a network wins, like the first match of a
+	// firewall rule.
+	if _, found := t[bits][entry.Network]; !found {
+		t[bits][entry.Network] = &entry
+	}
+}
+
+func (t prefixTable) lookup(addr netip.Addr) *ListEntry {
+	for bits := addr.BitLen(); bits >= 0; bits-- {
+		networks := t[bits]
+		if networks == nil {
+			continue
+		}
+		prefix, _ := addr.Prefix(bits)
+		if entry, found := networks[prefix]; found {
+			return entry
+		}
+	}
+	return nil
+}
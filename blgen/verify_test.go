@@ -0,0 +1,69 @@
+package blgen
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestLookupList(t *testing.T) {
+	archive := countryArchive(t, testBlocks)
+	tests := []struct {
+		addr, network, label string
+	}{
+		{"2.56.8.1", "2.56.8.0/24", "RU"},
+		{"2.56.11.255", "2.56.10.0/23", "RU"},
+		{"::ffff:185.1.1.9", "185.1.1.0/24", "RU"},
+		{"5.1.2.3", "", ""},
+		{"2.56.12.0", "", ""},
+	}
+	for _, format := range []string{FormatPlain, FormatCSV, FormatIPSet, FormatNginx, FormatNetsh} {
+		for _, gzip := range []bool{false, true} {
+			cfg := testConfig(t, archive)
+			cfg.Format = format
+			cfg.Gzip = gzip
+			path := generate(t, cfg).OutputPath
+			for _, test := range tests {
+				entry, err := LookupList(path, netip.MustParseAddr(test.addr))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if test.network == "" {
+					if entry != nil {
+						t.Errorf("%s, gzip %t: %s found in %s", format, gzip, test.addr, entry.Network)
+					}
+					continue
+				}
+				// Only the formats naming the country label the networks.
+				label := test.label
+				if format == FormatIPSet || format == FormatNginx {
+					label = ""
+				}
+				if entry == nil || entry.Network != netip.MustParsePrefix(test.network) || entry.Label != label {
+					t.Errorf("%s, gzip %t: %s found in %+v, want %s ; %s", format, gzip, test.addr, entry, test.network, label)
+				}
+			}
+		}
+	}
+}
+
+// The most specific network containing the address wins.
+func TestLookupMostSpecific(t *testing.T) {
+	table := prefixTable{}
+	table.add(ListEntry{netip.MustParsePrefix("10.0.0.0/8"), "RU"})
+	table.add(ListEntry{netip.MustParsePrefix("10.1.0.0/16"), "DE"})
+	table.add(ListEntry{netip.MustParsePrefix("10.1.0.0/16"), "IE"})
+	tests := []struct {
+		addr, want string
+	}{
+		{"10.1.2.3", "DE"},
+		{"10.2.0.0", "RU"},
+	}
+	for _, test := range tests {
+		if entry := table.lookup(netip.MustParseAddr(test.addr)); entry == nil || entry.Label != test.want {
+			t.Errorf("%s found in %+v, want %s", test.addr, entry, test.want)
+		}
+	}
+	if entry := table.lookup(netip.MustParseAddr("11.0.0.0")); entry != nil {
+		t.Errorf("11.0.0.0 found in %+v", entry)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
+)
+
+const (
+	commandGenerate = "generate"
+	commandReport   = "report"
+	commandVerify   = "verify"
+)
+
+// commands are listed in the usage, with their arguments.
+var commands = []struct {
+	name    string
+	args    string
+	summary string
+}{
+	{commandGenerate, "[options]", "Download the database and write the list, the default when no command is given"},
+	{commandReport, "[options]", "Print the number of networks and addresses of every country in the database"},
+	{commandVerify, "[options] address...", "Print whether an existing list covers the addresses"},
+}
+
+// commandArgs splits the command off the arguments. Without one, the
+// arguments are those of generate, as they were before blgen had commands.
+func commandArgs(args []string) (string, []string) {
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return commandGenerate, args
+}
+
+// printUsage lists the commands.
+func printUsage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [command] [options]\n\nCommands:\n", os.Args[0])
+	table := tabwriter.NewWriter(os.Stderr, 0, 0, 2, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(table, "  %s\t%s\n", command.name, command.summary)
+	}
+	table.Flush()
+}
+
+// newFlagSet returns the flag set of a command, whose usage lists its flags.
+// The usage of generate lists the other commands as well, since it is what
+// -h without a command shows.
+func newFlagSet(command string) *flag.FlagSet {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	fs.Usage = func() {
+		if command == commandGenerate {
+			printUsage()
+			fmt.Fprintf(os.Stderr, "\nOptions of %s:\n", command)
+		} else {
+			for _, c := range commands {
+				if c.name == command {
+					fmt.Fprintf(os.Stderr, "Usage: %s %s %s\n", os.Args[0], c.name, c.args)
+				}
+			}
+		}
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// runVerify runs the verify command, which looks addresses up in a list
+// written earlier without downloading anything.
+func runVerify(args []string) {
+	fs := newFlagSet(commandVerify)
+	list := fs.String("list", blgen.DefaultOutputFilename, "List to look the addresses up in, in any format with CIDR networks, gzipped or not")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var addrs []netip.Addr
+	for _, arg := range fs.Args() {
+		addr, err := netip.ParseAddr(arg)
+		if err != nil {
+			exitWithError(fmt.Errorf("invalid address: %w", err))
+		}
+		addrs = append(addrs, addr)
+	}
+	for _, addr := range addrs {
+		if err := verifyIP([]string{*list}, addr); err != nil {
+			exitWithError(err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
+)
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		args    []string
+		command string
+		rest    []string
+	}{
+		{nil, commandGenerate, nil},
+		{[]string{"-bc", "RU"}, commandGenerate, []string{"-bc", "RU"}},
+		{[]string{"generate", "-bc", "RU"}, commandGenerate, []string{"-bc", "RU"}},
+		{[]string{"report", "-edition", "city"}, commandReport, []string{"-edition", "city"}},
+		{[]string{"verify", "1.2.3.4"}, commandVerify, []string{"1.2.3.4"}},
+	}
+	for _, test := range tests {
+		command, rest := commandArgs(test.args)
+		if command != test.command || !slices.Equal(rest, test.rest) {
+			t.Errorf("commandArgs(%q) = %s %q, want %s %q", test.args, command, rest, test.command, test.rest)
+		}
+	}
+}
+
+func TestCommandFlags(t *testing.T) {
+	cfg, _, _ := parseCLIOptions(commandGenerate, []string{"-id", "1234", "-bc", "ru", "-format", "cidr"})
+	if _, found := cfg.BlockedCountries["RU"]; !found || cfg.AccountID != "1234" || cfg.Format != blgen.FormatCIDR || cfg.Report {
+		t.Errorf("generate: got %+v", cfg)
+	}
+	cfg, _, _ = parseCLIOptions(commandReport, []string{"-id", "1234", "-report-sort", blgen.ReportSortCount})
+	if !cfg.Report || cfg.AccountID != "1234" || cfg.ReportSort != blgen.ReportSortCount {
+		t.Errorf("report: got %+v", cfg)
+	}
+
+	list := writeFiles(t, [2]string{"list.txt", "2.56.8.0/24 ; RU\n"})[0]
+	tests := []struct {
+		args   []string
+		code   int
+		output string
+	}{
+		// The flags of generate aren't those of the other commands.
+		{[]string{"report", "-bc", "RU"}, 2, "flag provided but not defined: -bc"},
+		{[]string{"verify", "-id", "1234", "2.56.8.1"}, 2, "flag provided but not defined: -id"},
+		{[]string{"verify", "-list", list}, 2, "Usage:"},
+		{[]string{"verify", "-list", list, "2.56.8.1"}, 0, "2.56.8.1 is listed in " + list},
+		{[]string{"verify", "-list", list, "not-an-address"}, 1, "invalid address"},
+		{[]string{"lookup", "2.56.8.1"}, 2, `unknown command "lookup"`},
+	}
+	for _, test := range tests {
+		stdout, stderr, code := runMain(t, test.args...)
+		if code != test.code || !strings.Contains(stdout+stderr, test.output) {
+			t.Errorf("%q: exit code %d with %q, want %d with %q", test.args, code, stdout+stderr, test.code, test.output)
+		}
+	}
+}
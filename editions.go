@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
+)
+
+// editionConfigs returns the config of every edition of a comma-separated
+// -edition such as country,asn, each generating a list of its own. An
+// edition keeps only the codes it takes, and writes to -outname with its
+// name added before the extension, such as BlockedCountriesBlocks-asn.txt.
+// A single edition is returned as it is.
+func editionConfigs(cfg blgen.Config) ([]blgen.Config, error) {
+	names := strings.Split(cfg.Edition, ",")
+	if len(names) == 1 {
+		return []blgen.Config{cfg}, nil
+	}
+	switch {
+	case cfg.Report || cfg.CheckCredentials:
+		return nil, fmt.Errorf("the report command and -check-credentials take a single -edition")
+	case cfg.ZipPath != "" || cfg.DBURL != "" || cfg.SHAURL != "" || cfg.MMDBPath != "" || cfg.DiffAgainst != "" || cfg.SplitByCountry:
+		return nil, fmt.Errorf("-zip, -db-url, -sha-url, -also-mmdb, -diff-against and -split-by-country take a single -edition")
+	case cfg.OutputFilename == blgen.StdoutFilename:
+		return nil, fmt.Errorf("the lists of several editions can't be written to stdout")
+	}
+
+	cfgs := make([]blgen.Config, 0, len(names))
+	seen := make(map[string]bool, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		if seen[name] {
+			return nil, fmt.Errorf("edition %q given more than once", name)
+		}
+		seen[name] = true
+
+		editionCfg := cfg
+		editionCfg.Edition = name
+		if name == blgen.EditionASN {
+			editionCfg.BlockedCountries = nil
+			editionCfg.BlockedContinents = nil
+			editionCfg.ExcludedCountries = nil
+		} else {
+			editionCfg.BlockedASNsInput = nil
+		}
+		if name != blgen.EditionCity {
+			editionCfg.BlockedSubdivisions = nil
+			editionCfg.ExcludedSubdivisions = nil
+		}
+		// Another edition's codes don't make an empty list of this one
+		// what was asked for.
+		nothingToBlock := len(editionCfg.BlockedCountries) == 0 && len(editionCfg.BlockedContinents) == 0 &&
+			len(editionCfg.BlockedSubdivisions) == 0 && len(editionCfg.BlockedASNsInput) == 0
+		if nothingToBlock && cfg.Mode != blgen.ModeAllow && !cfg.AllowEmpty {
+			return nil, fmt.Errorf("no codes to block for the %s edition", name)
+		}
+		editionCfg.OutputFilename = editionFilename(cfg.OutputFilename, name)
+		cfgs = append(cfgs, editionCfg)
+	}
+	return cfgs, nil
+}
+
+// editionFilename adds the edition to the output filename before its
+// extension, and before .gz for a gzipped list.
+func editionFilename(filename, edition string) string {
+	if filename == "" {
+		filename = blgen.DefaultOutputFilename
+	}
+	name, gzipped := strings.CutSuffix(filename, ".gz")
+	ext := filepath.Ext(name)
+	name = strings.TrimSuffix(name, ext) + "-" + edition + ext
+	if gzipped {
+		name += ".gz"
+	}
+	return name
+}
+
+// combineResults sums up the results of the editions of a run, for the
+// summary, the metrics and the manifest. The database date is the oldest
+// of the editions, as that's the one an age alert is about.
+func combineResults(results []blgen.Result) blgen.Result {
+	if len(results) == 1 {
+		return results[0]
+	}
+	var combined blgen.Result
+	combined.NetworksByLabel = make(map[string]int)
+	for _, result := range results {
+		combined.OutputPaths = append(combined.OutputPaths, result.OutputPaths...)
+		combined.CountriesRequested += result.CountriesRequested
+		combined.GeonamesMatched += result.GeonamesMatched
+		combined.NetworksWritten += result.NetworksWritten
+		combined.MalformedRows += result.MalformedRows
+		combined.BytesWritten += result.BytesWritten
+		for label, n := range result.NetworksByLabel {
+			combined.NetworksByLabel[label] += n
+		}
+		if combined.DatabaseDate.IsZero() || (!result.DatabaseDate.IsZero() && result.DatabaseDate.Before(combined.DatabaseDate)) {
+			combined.DatabaseDate = result.DatabaseDate
+		}
+		combined.Elapsed = max(combined.Elapsed, result.Elapsed)
+	}
+	if len(combined.OutputPaths) > 0 {
+		combined.OutputPath = combined.OutputPaths[0]
+	}
+	return combined
+}
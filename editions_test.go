@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
+)
+
+func TestEditionConfigs(t *testing.T) {
+	t.Setenv(envAccountID, "1234")
+	t.Setenv(envLicenseKey, "key")
+	cfg, err := loadConfig(commandGenerate, []string{"-edition", "country,asn", "-bc", "RU", "-blocked-asn", "AS13335", "-outpath", t.TempDir(), "-log-level", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfgs, err := editionConfigs(*cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cfgs) != 2 {
+		t.Fatalf("got %d configs, want 2", len(cfgs))
+	}
+	country, asn := cfgs[0], cfgs[1]
+	if country.Edition != blgen.EditionCountry || len(country.BlockedCountries) != 1 || country.BlockedASNsInput != nil ||
+		country.OutputFilename != "BlockedCountriesBlocks-country.txt" {
+		t.Errorf("country edition got %+v", country)
+	}
+	if asn.Edition != blgen.EditionASN || asn.BlockedCountries != nil || len(asn.BlockedASNsInput) != 1 ||
+		asn.OutputFilename != "BlockedCountriesBlocks-asn.txt" {
+		t.Errorf("ASN edition got %+v", asn)
+	}
+
+	for _, args := range [][]string{
+		// Nothing to block for the ASN edition.
+		{"-edition", "country,asn", "-bc", "RU"},
+		{"-edition", "country,country", "-bc", "RU"},
+		{"-edition", "country,asn", "-bc", "RU", "-blocked-asn", "AS13335", "-outname", "-"},
+		{"-edition", "country,asn", "-bc", "RU", "-blocked-asn", "AS13335", "-zip", "db.zip"},
+		{"-edition", "country,bogus", "-bc", "RU"},
+	} {
+		if _, err := loadConfig(commandGenerate, append(args, "-outpath", t.TempDir(), "-log-level", "error")); err == nil {
+			t.Errorf("%q accepted", args)
+		}
+	}
+}
+
+func TestEditionFilename(t *testing.T) {
+	tests := []struct {
+		filename, want string
+	}{
+		{"", "BlockedCountriesBlocks-asn.txt"},
+		{"list.conf", "list-asn.conf"},
+		{"list.txt.gz", "list-asn.txt.gz"},
+		{"list", "list-asn"},
+	}
+	for _, test := range tests {
+		if got := editionFilename(test.filename, blgen.EditionASN); got != test.want {
+			t.Errorf("editionFilename(%q) = %q, want %q", test.filename, got, test.want)
+		}
+	}
+}
@@ -1,47 +1,47 @@
 package main
 
 import (
-	"archive/zip"
 	"bufio"
-	"crypto/sha256"
-	"encoding/csv"
-	"encoding/hex"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"maps"
-	"net/http"
+	"net/netip"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
-	"time"
+	"syscall"
+	"text/tabwriter"
 
+	"github.com/BurntSushi/toml"
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
 	"gopkg.in/yaml.v3"
 )
 
-type Config struct {
-	AccountID              string   `yaml:"account_id"`
-	LicenseKey             string   `yaml:"license_key"`
-	BlockedCountriesInput  []string `yaml:"blocked_countries"`
-	BlockedContinentsInput []string `yaml:"blocked_continents"`
-	OutputFilePath         string   `yaml:"output_filepath"`
-	OutputFilename         string   `yaml:"output_filename"`
-	BlockedCountries       map[string]struct{}
-	BlockedContinents      map[string]struct{}
-}
-
 const (
-	dbURL               = "https://download.maxmind.com/geoip/databases/GeoLite2-Country-CSV/download?suffix=zip"
-	shaURL              = "https://download.maxmind.com/geoip/databases/GeoLite2-Country-CSV/download?suffix=zip.sha256"
-	geoLiteLocationsCSV = "GeoLite2-Country-Locations-en.csv"
-	geoLiteBlocksCSV    = "GeoLite2-Country-Blocks-IPv4.csv"
+	envAccountID  = "MAXMIND_ACCOUNT_ID"
+	envLicenseKey = "MAXMIND_LICENSE_KEY"
+
+	// defaultMaxErrors tolerates the odd broken row of a database release
+	// without hiding a file that is broken throughout.
+	defaultMaxErrors = 10
+
+	// exitLocked is EX_TEMPFAIL, so schedulers can tell a skipped run from
+	// a failed one.
+	exitLocked = 75
+	// exitEmpty is EX_DATAERR, returned when a run succeeds but lists no
+	// networks, unless -allow-empty-output expects that.
+	exitEmpty = 65
+	// exitRejected is EX_NOPERM, returned when the server rejected the
+	// account ID or license key.
+	exitRejected = 77
 )
 
-var httpClient = &http.Client{
-	Timeout: 30 * time.Second,
-}
-
 type stringSlice []string
 
 func (s *stringSlice) String() string {
@@ -53,38 +53,227 @@ func (s *stringSlice) Set(value string) error {
 	return nil
 }
 
-func parseCLIOptions() (*Config, string) {
-	var blockedCountries stringSlice
-	var blockedContinents stringSlice
-	var configFilePath string
-	cfg := &Config{
-		BlockedCountries:  map[string]struct{}{},
-		BlockedContinents: map[string]struct{}{},
-	}
+// sampleRate is the N of -sample 1/N.
+type sampleRate int
 
-	flag.StringVar(&configFilePath, "c", "", "Config file")
-	flag.StringVar(&cfg.AccountID, "id", "", "Account ID")
-	flag.StringVar(&cfg.LicenseKey, "key", "", "License key")
-	flag.StringVar(&cfg.OutputFilePath, "outpath", "", "Output path")
-	flag.StringVar(&cfg.OutputFilename, "outname", "BlockedCountriesBlocks.txt", "Output file")
-	flag.Var(&blockedCountries, "bc", "ISO 3166-1 alpha-2 country codes to block (can be used multiple times)")
-	flag.Var(&blockedContinents, "bn", "MaxMind alpha-2 continent codes to block (can be used multiple times)")
+func (s *sampleRate) String() string {
+	if *s == 0 {
+		return ""
+	}
+	return fmt.Sprintf("1/%d", *s)
+}
 
-	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
-		flag.PrintDefaults()
+func (s *sampleRate) Set(value string) error {
+	n, err := strconv.Atoi(strings.TrimPrefix(value, "1/"))
+	if err != nil || n < 1 {
+		return fmt.Errorf("expected 1/N with N at least 1, got %q", value)
 	}
+	*s = sampleRate(n)
+	return nil
+}
+
+// configFiles are the config files passed with -c, in order, and how their
+// country lists are merged.
+type configFiles struct {
+	paths          []string
+	mergeCountries string
+}
 
-	flag.Parse()
+const (
+	mergeReplace = "replace"
+	mergeUnion   = "union"
+)
 
+// parseCLIOptions parses the arguments of the generate or report command.
+// Both share the flags that download the database, and only generate has the
+// ones that select and write the list.
+func parseCLIOptions(command string, args []string) (*blgen.Config, configFiles, *flag.FlagSet) {
+	var blockedCountries stringSlice
+	var blockedContinents stringSlice
+	var blockedSubdivisions stringSlice
+	var excludedCountries stringSlice
+	var excludedSubdivisions stringSlice
+	var files configFiles
+	var allow bool
+	var quiet bool
+	var showVersion bool
+	cfg := &blgen.Config{
+		BlockedCountries:     map[string]struct{}{},
+		BlockedContinents:    map[string]struct{}{},
+		BlockedSubdivisions:  map[string]struct{}{},
+		ExcludedCountries:    map[string]struct{}{},
+		ExcludedSubdivisions: map[string]struct{}{},
+		Report:               command == commandReport,
+		Generator:            "blgen " + version,
+	}
+
+	fs := newFlagSet(command)
+	// The flags shared by the commands that download the database.
+	fs.BoolVar(&showVersion, "version", false, "Print version information and exit")
+	fs.Var((*stringSlice)(&files.paths), "c", "Config file (can be used multiple times, later files override earlier ones)")
+	fs.StringVar(&files.mergeCountries, "merge-countries", mergeReplace, "How the blocked countries of several config files combine: replace or union")
+	fs.StringVar(&cfg.AccountID, "id", "", "Account ID (takes precedence over $"+envAccountID+", which takes precedence over the config file)")
+	fs.StringVar(&cfg.LicenseKey, "key", "", "License key (takes precedence over $"+envLicenseKey+", which takes precedence over the config file)")
+	fs.StringVar(&cfg.AccountIDFile, "id-file", "", "File holding the account ID, used when -id isn't given (takes precedence over $"+envAccountID+")")
+	fs.StringVar(&cfg.LicenseKeyFile, "key-file", "", "File holding the license key, used when -key isn't given (takes precedence over $"+envLicenseKey+")")
+	fs.StringVar(&cfg.NetrcFile, "netrc", "", "File in .netrc format whose login and password for the download host are the account ID and license key, used when nothing else provides them")
+	fs.StringVar(&cfg.Proxy, "proxy", "", "Proxy URL (http://, https:// or socks5://), defaults to the proxy from the environment")
+	fs.StringVar(&cfg.Edition, "edition", "", "GeoLite2 database to use: country, city or asn, or several separated by commas such as country,asn (default country)")
+	fs.StringVar(&cfg.Locale, "locale", "", "Locale of the locations file the country names are read from, e.g. de or pt-BR (default en)")
+	fs.BoolVar(&cfg.Progress, "progress", false, "Show the download and scan progress on stderr")
+	fs.StringVar(&cfg.LogLevel, "log-level", "info", "Least severe messages logged to stderr: debug, info, warn or error")
+	fs.StringVar(&cfg.LogFormat, "log-format", "text", "Format of the messages logged to stderr: text or json")
+	fs.BoolVar(&quiet, "quiet", false, "Log only errors, so a successful run prints nothing but the list and what -summary and -progress ask for")
+	fs.BoolVar(&cfg.KeepTemp, "keep-temp", false, "Keep the temp directory, named maxmind-geolite2-*, with the downloaded and extracted files")
+	fs.BoolVar(&cfg.Stream, "stream", false, "Keep the downloaded archive in memory instead of writing it to the temp directory")
+	fs.StringVar(&cfg.TempDir, "temp-dir", "", "Parent directory for the temp directory (default the system temp directory)")
+	fs.DurationVar(&cfg.Timeout, "timeout", 0, "Overall time limit for the run, e.g. 10m (default no limit)")
+	fs.DurationVar(&cfg.ConnectTimeout, "connect-timeout", blgen.DefaultConnectTimeout, "Time limit for connecting to the download server")
+	fs.DurationVar(&cfg.DownloadTimeout, "download-timeout", blgen.DefaultDownloadTimeout, "Time limit for each attempt at downloading the database, including the transfer")
+	fs.StringVar(&cfg.UserAgent, "user-agent", blgen.DefaultUserAgent+"/"+version, "User-Agent header sent with every request")
+	fs.BoolVar(&cfg.HTTP2, "http2", false, "Download over HTTP/2 only, also from http:// URLs such as an internal mirror")
+	fs.BoolVar(&cfg.CheckCredentials, "check-credentials", false, "Only check that the server accepts the credentials by fetching the small SHA256 file, exiting with status 77 when it rejects them")
+	fs.BoolVar(&cfg.StrictSchema, "strict-schema", false, "Fail when a CSV file of the database has columns other than the known ones, or in another order, instead of only checking for the columns that are read")
+	fs.IntVar(&cfg.DownloadConcurrency, "download-concurrency", 0, "Number of downloads, such as the CSV database, -also-mmdb and the databases of several -edition, to run at the same time (default all at once)")
+	fs.DurationVar(&cfg.RequestDelay, "request-delay", 0, "Least time between two requests to the download server, e.g. 2s, widened after a 429 response (default no delay)")
+	fs.IntVar(&cfg.Retries, "retries", blgen.DefaultRetries, "Maximum number of attempts for each download")
+	fs.IntVar(&cfg.Workers, "workers", 1, "Number of goroutines parsing and matching the blocks file")
+	fs.StringVar(&cfg.ReportSort, "report-sort", blgen.ReportSortCode, "Order of the report: by country code, by network count or by address space, the largest first for the last two")
+	fs.Var((*sampleRate)(&cfg.Sample), "sample", "Use only every Nth row of the blocks file, given as 1/N, for a quick look at a partial list")
+	fs.IntVar(&cfg.MaxErrors, "max-errors", defaultMaxErrors, "Number of malformed blocks file rows to skip with a warning before failing")
+	fs.StringVar(&cfg.LockFile, "lock-file", "", "File to lock for the run, so an overlapping run exits with status 75 instead of racing on the output")
+	fs.IntVar(&cfg.MaxAgeDays, "max-age-days", 0, "Fail when the database was built more than this many days ago, going by the date in the archive (default any age)")
+	fs.StringVar(&cfg.CacheDir, "cache-dir", "", "Directory to keep the downloaded archive in and only re-download it when it changed")
+	fs.StringVar(&cfg.CSVDir, "csv-dir", "", "Directory to extract the CSV files to, instead of the temp directory, so later runs can reuse them")
+	fs.BoolVar(&cfg.UseCachedCSV, "use-cached-csv", false, "Use the CSV files in -csv-dir without downloading anything when they were extracted less than -csv-max-age ago")
+	fs.DurationVar(&cfg.CSVMaxAge, "csv-max-age", blgen.DefaultCSVMaxAge, "How long the CSV files in -csv-dir are reused by -use-cached-csv")
+	fs.StringVar(&cfg.DBURL, "db-url", "", "Database download URL (default MaxMind's URL for the -archive format)")
+	fs.BoolVar(&cfg.SkipSHA, "skip-sha", false, "Don't verify the downloaded archive against its SHA256, for mirrors that don't publish one (not recommended)")
+	fs.StringVar(&cfg.SHAURL, "sha-url", "", "SHA256 download URL (default MaxMind's URL for the -archive format)")
+	fs.StringVar(&cfg.Archive, "archive", blgen.ArchiveZip, "Archive format to download: zip or tar.gz")
+	fs.StringVar(&cfg.ZipPath, "zip", "", "Use a local GeoLite2 CSV archive of the -edition, in the -archive format, instead of downloading it")
+	fs.StringVar(&cfg.SHAPath, "sha", "", "Local .sha256 file to verify the -zip archive against")
+
+	if command == commandGenerate {
+		fs.StringVar(&cfg.OutputFilePath, "outpath", "", "Output path")
+		fs.BoolVar(&cfg.MkdirOutput, "mkdir-output", false, "Create -outpath when it doesn't exist instead of failing before the download")
+		fs.StringVar(&cfg.OutputFilename, "outname", blgen.DefaultOutputFilename, "Output file, or - to write to stdout")
+		fs.Var(&blockedCountries, "bc", "ISO 3166-1 alpha-2 country codes to block (can be used multiple times)")
+		fs.Func("bc-file", "File of country codes to block, one per line, with # comments (can be used multiple times)", func(path string) error {
+			codes, err := readCodesFile(path)
+			blockedCountries = append(blockedCountries, codes...)
+			return err
+		})
+		fs.Var(&blockedContinents, "bn", "MaxMind alpha-2 continent codes to block (can be used multiple times)")
+		fs.Var(&blockedContinents, "blocked-continent", "Alias for -bn")
+		fs.Var(&excludedCountries, "exclude", "ISO 3166-1 alpha-2 country codes never to list, even when their continent matches (can be used multiple times)")
+		fs.Var(&blockedSubdivisions, "blocked-subdivision", "ISO 3166-2 subdivision codes such as US-CA to block, requires -edition city (can be used multiple times)")
+		fs.Var(&excludedSubdivisions, "excluded-subdivision", "ISO 3166-2 subdivision codes such as US-CA never to list, even when their country is blocked, requires -edition city (can be used multiple times)")
+		fs.Var((*stringSlice)(&cfg.BlockedASNsInput), "blocked-asn", "Autonomous system numbers such as AS13335 to block, requires -edition asn (can be used multiple times)")
+		fs.StringVar(&cfg.FileModeInput, "file-mode", "", "Permission of the generated file in octal, e.g. 0640 (default that of the file it replaces, or 0644 less the umask)")
+		fs.BoolVar(&cfg.Checksum, "checksum", false, "Write the SHA256 of the output file to <name>.sha256 next to it, in sha256sum format")
+		fs.BoolVar(&cfg.Append, "append", false, "Add the networks to the existing output file instead of replacing it, leaving out the lines it already has")
+		fs.IntVar(&cfg.MaxLines, "max-lines", 0, "Split the list into files of at most this many lines each, header included, named <outname>.1, <outname>.2 and so on (default one file)")
+		fs.StringVar(&cfg.Newline, "newline", blgen.NewlineLF, "Line ending of the list: lf, or crlf for Windows systems (netsh always uses crlf)")
+		fs.StringVar(&cfg.DiffAgainst, "diff-against", "", "Previous list to compare with, writing the lines added since to <name>.added and the lines removed since to <name>.removed")
+		fs.BoolVar(&cfg.SplitByCountry, "split-by-country", false, "Write the networks of every country to a file of its own in -outpath, such as RU.txt, instead of the combined list")
+		fs.BoolVar(&cfg.SplitCombined, "split-combined", false, "With -split-by-country, write the combined list to -outname as well")
+		fs.BoolVar(&cfg.Backup, "backup", false, "Keep the previous output file as <name>.bak when replacing it")
+		fs.BoolVar(&cfg.BackupTimestamped, "backup-timestamped", false, "Like -backup, but name the copy after the time it was replaced")
+		fs.BoolVar(&cfg.Gzip, "gzip", false, "Gzip-compress the output file (implied when -outname ends in .gz)")
+		fs.BoolVar(&cfg.Names, "names", false, "Append the country name as a comment to each line of the plain format, or as a column of the csv format")
+		fs.BoolVar(&cfg.AllowDuplicates, "allow-duplicates", false, "Keep repeated identical lines instead of writing each line once")
+		fs.BoolVar(&cfg.NoHeader, "no-header", false, "Leave out the header comments, so identical data produces identical output")
+		fs.BoolVar(&cfg.Sort, "sort", false, "Sort the output by country code and then numerically by network")
+		fs.BoolVar(&cfg.LowMemory, "low-memory", false, "With -sort or -grouped, sort the networks in chunks spilled to the temp directory, so memory use stays bounded for large lists")
+		fs.BoolVar(&cfg.Grouped, "grouped", false, "Write the networks of each country in a section headed by a comment such as # --- RU ---, sorted like -sort")
+		fs.StringVar(&cfg.TimestampFormat, "timestamp-format", blgen.DefaultTimestampFormat, "Go time layout of the generation time in the header, e.g. 2006-01-02T15:04:05Z07:00 for RFC 3339")
+		fs.BoolVar(&cfg.VerboseHeader, "verbose-header", false, "Record in the header how the list was generated: version, edition, mode, codes and the time in UTC")
+		fs.BoolVar(&cfg.TimestampUTC, "timestamp-utc", false, "Write the generation time in the header in UTC instead of local time")
+		fs.StringVar(&cfg.Format, "format", blgen.FormatPlain, "Output format: plain, ipset, iptables, cidr, nginx, range, csv or netsh, or a comma-separated list of them to write one file per format")
+		fs.StringVar(&cfg.SetName, "setname", "blocked", "Set name used by the ipset output format")
+		fs.StringVar(&cfg.NginxVar, "nginx-var", "blocked", "Variable set by the geo block of the nginx output format")
+		fs.StringVar(&cfg.NetshRulePrefix, "netsh-rule-prefix", "blgen", "Start of the firewall rule names of the netsh output format, followed by the country and a number")
+		fs.StringVar(&cfg.MapV4ToV6, "map-v4-to-v6", "", "Write IPv4 networks as IPv4-mapped IPv6 networks such as ::ffff:1.2.3.0/120 as well (also) or in their place (instead)")
+		fs.StringVar(&cfg.ConflictPolicy, "conflict-policy", blgen.ConflictFirst, "What to do with a network listed under more than one country: first writes it under each as it comes, last keeps the last one, error fails the run")
+		fs.BoolVar(&cfg.StripBogons, "strip-bogons", false, "Leave out networks within private and reserved ranges such as 10.0.0.0/8, 100.64.0.0/10 and fc00::/7")
+		fs.IntVar(&cfg.MinPrefix, "min-prefix", 0, "Leave out IPv4 networks with a shorter prefix length (default no limit)")
+		fs.IntVar(&cfg.MaxPrefix, "max-prefix", 0, "Leave out IPv4 networks with a longer prefix length, e.g. 24 to drop single addresses (default no limit)")
+		fs.IntVar(&cfg.MinPrefixV6, "min-prefix-v6", 0, "Leave out IPv6 networks with a shorter prefix length (default no limit)")
+		fs.IntVar(&cfg.MaxPrefixV6, "max-prefix-v6", 0, "Leave out IPv6 networks with a longer prefix length, e.g. 48 (default no limit)")
+		fs.BoolVar(&cfg.OnlyRegistered, "only-registered", false, "Match networks on the country they are registered to only, ignoring where they are located, short for -match-fields registered_country_geoname_id")
+		fs.StringVar(&cfg.MatchFields, "match-fields", "", "Comma-separated blocks file columns a network is matched on: geoname_id, registered_country_geoname_id and represented_country_geoname_id (default all three)")
+		fs.BoolVar(&cfg.NumericCodes, "numeric-codes", false, "Label the networks with the ISO 3166-1 numeric code of their country, e.g. 643 instead of RU")
+		fs.BoolVar(&cfg.AnnotateReason, "annotate-reason", false, "Add which blocks file columns matched to each line of the plain, range and csv formats: geo, registered or represented, joined by + when several did")
+		fs.BoolVar(&cfg.Aggregate, "aggregate", false, "Merge adjacent and overlapping networks of the same country into larger prefixes")
+		fs.BoolVar(&cfg.Strict, "strict", false, "Fail instead of warning when a configured code matches nothing in the database")
+		fs.BoolVar(&cfg.AllowEmpty, "allow-empty", false, "Generate a header-only list when no codes to block are configured instead of failing")
+		fs.BoolVar(&cfg.AllowEmptyOutput, "allow-empty-output", false, "Exit with status 0 instead of 65 when the configured codes match no networks")
+		fs.BoolVar(&cfg.Report, "report", false, "Print the number of networks and addresses of every country in the database instead of generating a list")
+		fs.BoolVar(&cfg.Summary, "summary", false, "Print a key=value summary of the run to stderr")
+		fs.StringVar(&cfg.MetricsFile, "metrics-file", "", "Write Prometheus metrics about the run to this file, for node_exporter's textfile collector, also when the run fails")
+		fs.StringVar(&cfg.Manifest, "manifest", "", "Write a JSON manifest with the number of networks listed per country to this file")
+		fs.StringVar(&cfg.VerifyIP, "verify-ip", "", "After writing the list, read it back and print whether it covers this IP address, and under which label")
+		fs.StringVar(&cfg.NotifyURL, "notify-url", "", "URL to POST a JSON notification to for every file a successful run writes")
+		fs.StringVar(&cfg.MMDBPath, "also-mmdb", "", "Also download the binary database of the -edition and save the .mmdb file to this path")
+		fs.StringVar(&cfg.MMDBURL, "mmdb-url", "", "Binary database download URL for -also-mmdb, its SHA256 is expected at the same URL with .sha256 appended (default MaxMind's URL)")
+		fs.BoolVar(&allow, "allow", false, "Treat the country and continent codes as an allowlist and output every other network")
+	}
+
+	fs.Parse(args)
+
+	// -version works on its own, without credentials or any other flag.
+	if showVersion {
+		fmt.Println(currentVersion())
+		os.Exit(0)
+	}
+
+	if allow {
+		cfg.Mode = blgen.ModeAllow
+	}
+	if quiet {
+		cfg.LogLevel = "error"
+	}
 	for _, block := range blockedCountries {
 		cfg.BlockedCountries[strings.ToUpper(block)] = struct{}{}
 	}
 	for _, block := range blockedContinents {
 		cfg.BlockedContinents[strings.ToUpper(block)] = struct{}{}
 	}
+	for _, block := range blockedSubdivisions {
+		cfg.BlockedSubdivisions[strings.ToUpper(block)] = struct{}{}
+	}
+	for _, exclude := range excludedCountries {
+		cfg.ExcludedCountries[strings.ToUpper(exclude)] = struct{}{}
+	}
+	for _, exclude := range excludedSubdivisions {
+		cfg.ExcludedSubdivisions[strings.ToUpper(exclude)] = struct{}{}
+	}
 
-	return cfg, configFilePath
+	return cfg, files, fs
+}
+
+// readCodesFile reads a list of codes kept in a plain text file, one per line.
+// Blank lines and everything after a # are ignored.
+func readCodesFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var codes []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		if code := strings.TrimSpace(line); code != "" {
+			codes = append(codes, code)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return codes, nil
 }
 
 func populateBlockedMap(blockedItems []string) map[string]struct{} {
@@ -95,51 +284,169 @@ func populateBlockedMap(blockedItems []string) map[string]struct{} {
 	return blockMap
 }
 
-func loadConfigFile(configFilePath string) (*Config, error) {
-	cfg := &Config{
-		BlockedCountries:  map[string]struct{}{},
-		BlockedContinents: map[string]struct{}{},
+func loadConfigFile(configFilePath string) (*blgen.Config, error) {
+	cfg := &blgen.Config{
+		BlockedCountries:     map[string]struct{}{},
+		BlockedContinents:    map[string]struct{}{},
+		BlockedSubdivisions:  map[string]struct{}{},
+		ExcludedCountries:    map[string]struct{}{},
+		ExcludedSubdivisions: map[string]struct{}{},
 	}
 
 	configFile, err := os.Open(configFilePath)
 	if err != nil {
-		return nil, fmt.Errorf("Error opening config file %s: %w", configFilePath, err)
+		return nil, fmt.Errorf("failed to open config file %s: %w", configFilePath, err)
 	}
 	defer configFile.Close()
 
-	configFileYAML := yaml.NewDecoder(configFile)
-	err = configFileYAML.Decode(cfg)
+	// The format follows the file extension, anything unknown is read as YAML.
+	switch strings.ToLower(filepath.Ext(configFilePath)) {
+	case ".json":
+		err = json.NewDecoder(configFile).Decode(cfg)
+	case ".toml":
+		_, err = toml.NewDecoder(configFile).Decode(cfg)
+	default:
+		err = yaml.NewDecoder(configFile).Decode(cfg)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("Error parsing config file %s: %w", configFilePath, err)
+		return nil, fmt.Errorf("failed to parse config file %s: %w", configFilePath, err)
 	}
 
 	cfg.BlockedCountries = populateBlockedMap(cfg.BlockedCountriesInput)
 	cfg.BlockedContinents = populateBlockedMap(cfg.BlockedContinentsInput)
+	cfg.BlockedSubdivisions = populateBlockedMap(cfg.BlockedSubdivisionsInput)
+	cfg.ExcludedCountries = populateBlockedMap(cfg.ExcludedCountriesInput)
+	cfg.ExcludedSubdivisions = populateBlockedMap(cfg.ExcludedSubdivisionsInput)
 
 	return cfg, nil
 }
 
-func loadConfig() (*Config, error) {
-	cfg, configFilePath := parseCLIOptions()
+// loadConfigFiles reads the config files in order and merges them field by
+// field, a value set in a later file overriding the one from an earlier file.
+// The blocked countries are replaced as well, or combined with -merge-countries
+// union.
+func loadConfigFiles(files configFiles) (*blgen.Config, error) {
+	if files.mergeCountries != mergeReplace && files.mergeCountries != mergeUnion {
+		return nil, fmt.Errorf("unknown -merge-countries strategy %q, expected %q or %q", files.mergeCountries, mergeReplace, mergeUnion)
+	}
 
-	if configFilePath != "" {
-		configFile, err := loadConfigFile(configFilePath)
+	merged := &blgen.Config{
+		BlockedCountries:     map[string]struct{}{},
+		BlockedContinents:    map[string]struct{}{},
+		BlockedSubdivisions:  map[string]struct{}{},
+		ExcludedCountries:    map[string]struct{}{},
+		ExcludedSubdivisions: map[string]struct{}{},
+	}
+	for _, path := range files.paths {
+		configFile, err := loadConfigFile(path)
 		if err != nil {
-			return nil, fmt.Errorf("Error loading config file %s: %w", configFilePath, err)
+			return nil, err
 		}
 
-		if cfg.AccountID == "" {
-			cfg.AccountID = configFile.AccountID
+		for _, field := range []struct{ dst, src *string }{
+			{&merged.AccountID, &configFile.AccountID},
+			{&merged.LicenseKey, &configFile.LicenseKey},
+			{&merged.AccountIDFile, &configFile.AccountIDFile},
+			{&merged.LicenseKeyFile, &configFile.LicenseKeyFile},
+			{&merged.NetrcFile, &configFile.NetrcFile},
+			{&merged.Edition, &configFile.Edition},
+			{&merged.Locale, &configFile.Locale},
+			{&merged.OutputFilePath, &configFile.OutputFilePath},
+			{&merged.OutputFilename, &configFile.OutputFilename},
+			{&merged.Mode, &configFile.Mode},
+			{&merged.Proxy, &configFile.Proxy},
+			{&merged.DBURL, &configFile.DBURL},
+			{&merged.SHAURL, &configFile.SHAURL},
+			{&merged.NotifyURL, &configFile.NotifyURL},
+			{&merged.FileModeInput, &configFile.FileModeInput},
+		} {
+			if *field.src != "" {
+				*field.dst = *field.src
+			}
+		}
+		if configFile.NoHeader {
+			merged.NoHeader = true
+		}
+		if len(configFile.Credentials) > 0 {
+			merged.Credentials = configFile.Credentials
+		}
+
+		if files.mergeCountries == mergeUnion {
+			maps.Copy(merged.BlockedCountries, configFile.BlockedCountries)
+		} else if len(configFile.BlockedCountries) > 0 {
+			merged.BlockedCountries = configFile.BlockedCountries
+		}
+		if len(configFile.BlockedContinents) > 0 {
+			merged.BlockedContinents = configFile.BlockedContinents
 		}
-		if cfg.LicenseKey == "" {
-			cfg.LicenseKey = configFile.LicenseKey
+		if len(configFile.BlockedSubdivisions) > 0 {
+			merged.BlockedSubdivisions = configFile.BlockedSubdivisions
+		}
+		if len(configFile.ExcludedCountries) > 0 {
+			merged.ExcludedCountries = configFile.ExcludedCountries
+		}
+		if len(configFile.ExcludedSubdivisions) > 0 {
+			merged.ExcludedSubdivisions = configFile.ExcludedSubdivisions
+		}
+		if len(configFile.BlockedASNsInput) > 0 {
+			merged.BlockedASNsInput = configFile.BlockedASNsInput
+		}
+	}
+	return merged, nil
+}
+
+func loadConfig(command string, args []string) (*blgen.Config, error) {
+	cfg, files, fs := parseCLIOptions(command, args)
+
+	logger, err := newLogger(cfg.LogLevel, cfg.LogFormat)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	cfg.Logger = logger
+
+	// A credential given on the command line, directly or as a file, takes
+	// precedence over the environment and the config file, where a file
+	// takes precedence over the credential itself.
+	if cfg.AccountID == "" && cfg.AccountIDFile == "" {
+		cfg.AccountID = os.Getenv(envAccountID)
+	}
+	if cfg.LicenseKey == "" && cfg.LicenseKeyFile == "" {
+		cfg.LicenseKey = os.Getenv(envLicenseKey)
+	}
+
+	if len(files.paths) > 0 {
+		configFile, err := loadConfigFiles(files)
+		if err != nil {
+			return nil, err
+		}
+
+		if cfg.AccountID == "" && cfg.AccountIDFile == "" {
+			if configFile.AccountIDFile != "" {
+				cfg.AccountIDFile = configFile.AccountIDFile
+			} else {
+				cfg.AccountID = configFile.AccountID
+			}
+		}
+		if cfg.LicenseKey == "" && cfg.LicenseKeyFile == "" {
+			if configFile.LicenseKeyFile != "" {
+				cfg.LicenseKeyFile = configFile.LicenseKeyFile
+			} else {
+				cfg.LicenseKey = configFile.LicenseKey
+			}
+		}
+		if cfg.NetrcFile == "" {
+			cfg.NetrcFile = configFile.NetrcFile
+		}
+		if len(cfg.Credentials) == 0 {
+			cfg.Credentials = configFile.Credentials
 		}
 		if cfg.OutputFilePath == "" {
 			if configFile.OutputFilePath != "" {
 				cfg.OutputFilePath = configFile.OutputFilePath
 			}
 		}
-		if cfg.OutputFilename == "BlockedCountriesBlocks.txt" && configFile.OutputFilename != "" {
+		if cfg.OutputFilename == blgen.DefaultOutputFilename && configFile.OutputFilename != "" {
 			cfg.OutputFilename = configFile.OutputFilename
 		}
 		if len(cfg.BlockedCountries) == 0 {
@@ -148,365 +455,273 @@ func loadConfig() (*Config, error) {
 		if len(cfg.BlockedContinents) == 0 {
 			maps.Copy(cfg.BlockedContinents, configFile.BlockedContinents)
 		}
+		if len(cfg.BlockedSubdivisions) == 0 {
+			maps.Copy(cfg.BlockedSubdivisions, configFile.BlockedSubdivisions)
+		}
+		if len(cfg.ExcludedCountries) == 0 {
+			maps.Copy(cfg.ExcludedCountries, configFile.ExcludedCountries)
+		}
+		if len(cfg.ExcludedSubdivisions) == 0 {
+			maps.Copy(cfg.ExcludedSubdivisions, configFile.ExcludedSubdivisions)
+		}
+		if len(cfg.BlockedASNsInput) == 0 {
+			cfg.BlockedASNsInput = configFile.BlockedASNsInput
+		}
+		if cfg.Edition == "" {
+			cfg.Edition = strings.ToLower(configFile.Edition)
+		}
+		if cfg.Locale == "" {
+			cfg.Locale = configFile.Locale
+		}
+		if cfg.Mode == "" {
+			cfg.Mode = strings.ToLower(configFile.Mode)
+		}
+		if cfg.Proxy == "" {
+			cfg.Proxy = configFile.Proxy
+		}
+		if !cfg.NoHeader {
+			cfg.NoHeader = configFile.NoHeader
+		}
+		if cfg.DBURL == "" {
+			cfg.DBURL = configFile.DBURL
+		}
+		if cfg.SHAURL == "" {
+			cfg.SHAURL = configFile.SHAURL
+		}
+		if cfg.NotifyURL == "" {
+			cfg.NotifyURL = configFile.NotifyURL
+		}
+		if cfg.FileModeInput == "" {
+			cfg.FileModeInput = configFile.FileModeInput
+		}
 	}
 
-	if cfg.AccountID == "" || cfg.LicenseKey == "" {
-		flag.Usage()
-		return nil, fmt.Errorf("Error: Account ID and License Key must be provided via CLI or config file")
+	// A block list without codes is empty, so don't download the database
+	// just to find that out. An empty allowlist is fine, it allows nothing.
+	nothingToBlock := len(cfg.BlockedCountries) == 0 && len(cfg.BlockedContinents) == 0 &&
+		len(cfg.BlockedSubdivisions) == 0 && len(cfg.BlockedASNsInput) == 0
+	if nothingToBlock && cfg.Mode != blgen.ModeAllow && !cfg.AllowEmpty && !cfg.Report && !cfg.CheckCredentials {
+		return nil, fmt.Errorf("no country, continent, subdivision or ASN codes to block, pass -allow-empty to generate an empty list anyway")
 	}
-
-	return cfg, nil
-}
-
-func downloadZip(tmpDir string, cfg *Config) (string, string, error) {
-	httpRequest, err := http.NewRequest("GET", dbURL, nil)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create zip HTTP request: %w", err)
+	// Without codes, an empty list is what was asked for.
+	if nothingToBlock {
+		cfg.AllowEmptyOutput = true
 	}
-	httpRequest.SetBasicAuth(cfg.AccountID, cfg.LicenseKey)
 
-	httpResponse, err := httpClient.Do(httpRequest)
-	if err != nil {
-		return "", "", fmt.Errorf("zip fetch failed: %w", err)
+	// Zero is a valid "use the default" for the library, but not as a flag.
+	if cfg.Retries < 1 {
+		return nil, fmt.Errorf("-retries must be at least 1")
 	}
-	defer httpResponse.Body.Close()
-
-	if httpResponse.StatusCode != http.StatusOK {
-		return "", "", fmt.Errorf("zip bad status: %s", httpResponse.Status)
+	if cfg.Workers < 1 {
+		return nil, fmt.Errorf("-workers must be at least 1")
 	}
 
-	const zipFilename = "db.zip"
-	tmpZipPath := filepath.Join(tmpDir, zipFilename+".tmp")
-	tmpZipFile, err := os.Create(tmpZipPath)
-	if err != nil {
-		return "", "", fmt.Errorf("failed to create temp file: %w", err)
+	if cfg.VerifyIP != "" {
+		if _, err := netip.ParseAddr(cfg.VerifyIP); err != nil {
+			return nil, fmt.Errorf("invalid -verify-ip address: %w", err)
+		}
+		if cfg.OutputFilename == blgen.StdoutFilename || strings.Contains(cfg.Format, blgen.FormatRange) {
+			return nil, fmt.Errorf("-verify-ip needs a list written to a file in a format with CIDR networks")
+		}
 	}
 
-	sha256Hash := sha256.New()
-	tee := io.TeeReader(httpResponse.Body, sha256Hash)
-	if _, err := io.Copy(tmpZipFile, tee); err != nil {
-		tmpZipFile.Close()
-		return "", "", fmt.Errorf("failed to write file: %w", err)
+	missingAccountID := cfg.AccountID == "" && cfg.AccountIDFile == ""
+	missingLicenseKey := cfg.LicenseKey == "" && cfg.LicenseKeyFile == ""
+	if (cfg.ZipPath == "" || cfg.MMDBPath != "") && (missingAccountID || missingLicenseKey) && cfg.NetrcFile == "" && len(cfg.Credentials) == 0 {
+		fs.Usage()
+		return nil, fmt.Errorf("Account ID and License Key must be provided via CLI, environment, config file or netrc file")
 	}
 
-	if err := tmpZipFile.Close(); err != nil {
-		return "", "", fmt.Errorf("failed to' close tmp file: %w", err)
+	// The editions of a run of several are checked with the codes each of
+	// them keeps.
+	if strings.Contains(cfg.Edition, ",") {
+		editionCfgs, err := editionConfigs(*cfg)
+		if err != nil {
+			return nil, err
+		}
+		for _, editionCfg := range editionCfgs {
+			if err := editionCfg.Prepare(); err != nil {
+				return nil, fmt.Errorf("invalid configuration of the %s edition: %w", editionCfg.Edition, err)
+			}
+		}
+		return cfg, nil
 	}
-
-	zipPath := filepath.Join(tmpDir, zipFilename)
-	if err := os.Rename(tmpZipPath, zipPath); err != nil {
-		return "", "", fmt.Errorf("failed to rename temp file: %w", err)
+	if err := cfg.Prepare(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
 	}
 
-	return zipPath, hex.EncodeToString(sha256Hash.Sum(nil)), nil
+	return cfg, nil
 }
 
-func verifySHA256(actualSHA string, cfg *Config) error {
-	httpRequest, err := http.NewRequest("GET", shaURL, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create sha HTTP request: %w", err)
-	}
-	httpRequest.SetBasicAuth(cfg.AccountID, cfg.LicenseKey)
-
-	httpResponse, err := httpClient.Do(httpRequest)
-	if err != nil {
-		return fmt.Errorf("sha fetch failed: %w", err)
-	}
-	defer httpResponse.Body.Close()
-
-	if httpResponse.StatusCode != http.StatusOK {
-		return fmt.Errorf("sha bad status: %s", httpResponse.Status)
-	}
-	httpResponseBodyMaxRead := io.LimitReader(httpResponse.Body, 1024)
-	shaData, err := io.ReadAll(httpResponseBodyMaxRead)
-	if err != nil {
-		return fmt.Errorf("failed to read sha data: %w", err)
-	}
-
-	shaParts := strings.Fields(string(shaData))
-	if len(shaParts) == 0 {
-		return fmt.Errorf("invalid sha file")
-	}
-	expectedSHA := shaParts[0]
-
-	if actualSHA != expectedSHA {
-		return fmt.Errorf("sha256 mismatch: got %s, expected %s", actualSHA, expectedSHA)
-	}
-
-	return nil
+// newLogger returns the logger selected by -log-level and -log-format. It
+// writes to stderr, so stdout is left to the list.
+func newLogger(level, format string) (*slog.Logger, error) {
+	var logLevel slog.Level
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+	options := &slog.HandlerOptions{Level: logLevel}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q, expected text or json", format)
 }
 
-func extractAndWriteFile(file *zip.File, destinationDir string) error {
-	if !filepath.IsLocal(file.Name) {
-		return fmt.Errorf("illegal file path in zip: %s", file.Name)
+func main() {
+	command, args := commandArgs(os.Args[1:])
+	switch command {
+	case commandGenerate, commandReport:
+		runGenerate(command, args)
+	case commandVerify:
+		runVerify(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		printUsage()
+		os.Exit(2)
 	}
+}
 
-	fileName := filepath.Base(file.Name)
-	extractedFilePath := filepath.Join(destinationDir, fileName)
-
-	zipFileContent, err := file.Open()
+// runGenerate runs the generate command, or the report command, which only
+// differs in what it does with the database.
+func runGenerate(command string, args []string) {
+	cfg, err := loadConfig(command, args)
 	if err != nil {
-		return fmt.Errorf("failed to open file inside zip %s: %w", fileName, err)
+		exitWithError(err)
 	}
-	defer zipFileContent.Close()
 
-	extractedFile, err := os.Create(extractedFilePath)
-	if err != nil {
-		return fmt.Errorf("failed to create file %s: %w", extractedFilePath, err)
+	// Ctrl-C and SIGTERM cancel the run, which returns once the temp
+	// directory has been cleaned up.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
 	}
 
-	_, err = io.Copy(extractedFile, zipFileContent)
-	if err != nil {
-		extractedFile.Close()
-		return fmt.Errorf("failed to write to file %s to %s: %w", fileName, extractedFilePath, err)
+	if cfg.CheckCredentials {
+		if err := blgen.CheckCredentials(ctx, *cfg); err != nil {
+			exitWithError(err)
+		}
+		slog.Info("credentials accepted")
+		return
 	}
 
-	if err := extractedFile.Close(); err != nil {
-		return fmt.Errorf("failed to close file: %w", err)
+	if cfg.Report {
+		counts, err := blgen.Report(ctx, *cfg)
+		if err != nil {
+			exitWithError(err)
+		}
+		printReport(counts)
+		return
 	}
 
-	return nil
-}
-
-func extractZip(zipPath, tmpDir string) error {
-	zipFile, err := zip.OpenReader(zipPath)
+	editionCfgs, err := editionConfigs(*cfg)
 	if err != nil {
-		return fmt.Errorf("failed to open zip file: %w", err)
+		exitWithError(err)
 	}
-	defer zipFile.Close()
-
-	filesToExtract := map[string]struct{}{
-		geoLiteLocationsCSV: {},
-		geoLiteBlocksCSV:    {},
+	results, err := blgen.GenerateEditions(ctx, editionCfgs)
+	var result blgen.Result
+	if err == nil {
+		result = combineResults(results)
 	}
-
-	foundCount := 0
-	for _, file := range zipFile.File {
-		if _, extract := filesToExtract[filepath.Base(file.Name)]; !extract {
-			continue
-		}
-
-		foundCount++
-
-		if err := extractAndWriteFile(file, tmpDir); err != nil {
-			return err
+	if cfg.MetricsFile != "" {
+		// A failed run is recorded as well, which is what monitoring
+		// is for.
+		metricsResult := &result
+		if err != nil {
+			metricsResult = nil
 		}
-		if foundCount == len(filesToExtract) {
-			break
+		if err := writeMetrics(cfg.MetricsFile, metricsResult); err != nil {
+			slog.Error(err.Error())
 		}
 	}
-
-	if foundCount < 2 {
-		return fmt.Errorf("missing required files in zip archive")
-	}
-
-	return nil
-}
-
-func downloadGeolite2(tmpDir string, cfg *Config) error {
-	zipPath, sha256Hash, err := downloadZip(tmpDir, cfg)
 	if err != nil {
-		return err
-	}
-
-	if err := verifySHA256(sha256Hash, cfg); err != nil {
-		return err
+		exitWithError(err)
 	}
 
-	if err := extractZip(zipPath, tmpDir); err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func getGeonameIDs(tmpDir string, cfg *Config) (map[string]string, error) {
-	locationsCSVPath := filepath.Join(tmpDir, geoLiteLocationsCSV)
-	locationsCSVFile, err := os.Open(locationsCSVPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open %s: %w", geoLiteLocationsCSV, err)
+	if cfg.Summary {
+		fmt.Fprintf(os.Stderr, "%s elapsed_seconds=%.3f\n", result, result.Elapsed.Seconds())
 	}
-	defer locationsCSVFile.Close()
-
-	csvData := csv.NewReader(locationsCSVFile)
-	csvData.ReuseRecord = true
-	csvHeader, err := csvData.Read()
-	if err != nil {
-		if err == io.EOF {
-			return map[string]string{}, nil
+	if cfg.Manifest != "" {
+		if err := writeManifest(cfg.Manifest, &result); err != nil {
+			exitWithError(err)
 		}
-		return nil, fmt.Errorf("failed to read %s CSV header: %w", geoLiteLocationsCSV, err)
-	}
-	columns := map[string]int{}
-	for i, name := range csvHeader {
-		columns[name] = i
 	}
-	neededFields := []string{"geoname_id", "country_iso_code", "continent_code"}
-	for _, column := range neededFields {
-		if _, ok := columns[column]; !ok {
-			return nil, fmt.Errorf("missing needed column: %s", column)
+	if cfg.VerifyIP != "" && len(result.OutputPaths) > 0 {
+		if err := verifyIP(result.OutputPaths, netip.MustParseAddr(cfg.VerifyIP)); err != nil {
+			exitWithError(err)
 		}
 	}
-
-	geonameIDsSet := make(map[string]string, 75000)
-
-	for {
-		line, err := csvData.Read()
-		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, fmt.Errorf("failed to read %s CSV line: %w", geoLiteLocationsCSV, err)
-		}
-		geonameID := line[columns["geoname_id"]]
-		countryISOCode := strings.ToUpper(line[columns["country_iso_code"]])
-		continentMMCode := strings.ToUpper(line[columns["continent_code"]])
-		_, isCountryBlocked := cfg.BlockedCountries[countryISOCode]
-		_, isContinentBlocked := cfg.BlockedContinents[continentMMCode]
-		if isCountryBlocked || isContinentBlocked {
-			if isCountryBlocked && isContinentBlocked {
-				geonameIDsSet[geonameID] = countryISOCode + ", " + continentMMCode + "*"
-			} else if isCountryBlocked {
-				geonameIDsSet[geonameID] = countryISOCode
-			} else {
-				geonameIDsSet[geonameID] = continentMMCode + "*"
-			}
-		}
+	// An appended list counts only the new networks, none of which may be
+	// new.
+	if result.NetworksWritten == 0 && !cfg.AllowEmptyOutput && !cfg.Append {
+		// The header-only list is in place, but automation should notice
+		// that the codes matched nothing.
+		slog.Warn("no networks matched, the list only has the header", "path", strings.Join(result.OutputPaths, ","))
+		os.Exit(exitEmpty)
 	}
-	return geonameIDsSet, nil
+	slog.Info("processing complete", "path", strings.Join(result.OutputPaths, ","))
 }
 
-func getAndWriteBlocks(tmpDir string, geonameIDsSet map[string]string, cfg *Config) error {
-	blocksCSVPath := filepath.Join(tmpDir, geoLiteBlocksCSV)
-	blocksCSVFile, err := os.Open(blocksCSVPath)
-	if err != nil {
-		return fmt.Errorf("failed to open %s: %w", geoLiteBlocksCSV, err)
-	}
-	defer blocksCSVFile.Close()
-
-	outputPath := filepath.Join(tmpDir, cfg.OutputFilename)
-	outputFile, err := os.Create(outputPath)
-	if err != nil {
-		return fmt.Errorf("failed to create output file %s: %w", outputPath, err)
-	}
-	defer outputFile.Close()
-
-	csvData := csv.NewReader(blocksCSVFile)
-	csvData.ReuseRecord = true
-	csvHeader, err := csvData.Read()
-	if err != nil {
-		if err == io.EOF {
-			return nil
+// exitWithError logs err, with the stage and path it failed at when known,
+// and exits. The exit status is exitLocked when another run holds the lock
+// file, and exitRejected when the credentials were rejected.
+func exitWithError(err error) {
+	var attrs []any
+	var stageErr *blgen.StageError
+	if errors.As(err, &stageErr) {
+		attrs = append(attrs, "stage", stageErr.Stage)
+		if stageErr.Path != "" {
+			attrs = append(attrs, "path", stageErr.Path)
 		}
-		return fmt.Errorf("failed to read CSV header: %w", err)
 	}
-	columns := map[string]int{}
-	for i, name := range csvHeader {
-		columns[name] = i
+	slog.Error(err.Error(), attrs...)
+	if errors.Is(err, blgen.ErrLocked) {
+		os.Exit(exitLocked)
 	}
-	neededFields := []string{"network", "geoname_id", "registered_country_geoname_id", "represented_country_geoname_id"}
-	for _, column := range neededFields {
-		if _, ok := columns[column]; !ok {
-			return fmt.Errorf("missing needed column: %s", column)
-		}
+	if errors.Is(err, blgen.ErrCredentialsRejected) {
+		os.Exit(exitRejected)
 	}
-	targetIndices := []int{
-		columns["geoname_id"],
-		columns["registered_country_geoname_id"],
-		columns["represented_country_geoname_id"],
-	}
-	networkIdx := columns["network"]
-
-	outputData := bufio.NewWriter(outputFile)
-	defer outputData.Flush()
-
-	timestamp := time.Now().Format("2006/01/02-15:04")
-	fmt.Fprintf(outputData, "# list generated %s\n", timestamp)
-	fmt.Fprintf(outputData, "# cidr ; Country Continent*\n")
+	os.Exit(1)
+}
 
-	for {
-		line, err := csvData.Read()
+// verifyIP prints whether the list at paths covers addr. The list is spread
+// over several files with chunks, several formats or per-country files, and
+// the first one covering addr is printed.
+func verifyIP(paths []string, addr netip.Addr) error {
+	for _, path := range paths {
+		entry, err := blgen.LookupList(path, addr)
 		if err != nil {
-			if err == io.EOF {
-				break
-			}
-			return fmt.Errorf("failed to read %s CSV line: %w", geoLiteBlocksCSV, err)
+			return err
 		}
-		for _, index := range targetIndices {
-			if country, found := geonameIDsSet[line[index]]; found {
-				fmt.Fprintf(outputData, "%s ; %s\n", line[networkIdx], country)
-				break
-			}
+		if entry == nil {
+			continue
 		}
-	}
-
-	return nil
-}
-
-func moveFile(tmpDir string, cfg *Config) error {
-	oldPath := filepath.Join(tmpDir, cfg.OutputFilename)
-	newPath := filepath.Join(cfg.OutputFilePath, cfg.OutputFilename)
-	if err := os.Rename(oldPath, newPath); err == nil {
+		if entry.Label == "" {
+			fmt.Printf("%s is listed in %s as %s\n", addr, path, entry.Network)
+			return nil
+		}
+		fmt.Printf("%s is listed in %s as %s ; %s\n", addr, path, entry.Network, entry.Label)
 		return nil
 	}
-	return moveFileFallback(oldPath, newPath)
-}
-
-func moveFileFallback(oldPath, newPath string) error {
-	oldFile, err := os.Open(oldPath)
-	if err != nil {
-		return fmt.Errorf("failed to open source: %w", err)
-	}
-	defer oldFile.Close()
-
-	newFile, err := os.Create(newPath)
-	if err != nil {
-		return fmt.Errorf("failed to create destination: %w", err)
-	}
-
-	if _, err := io.Copy(newFile, oldFile); err != nil {
-		newFile.Close()
-		return fmt.Errorf("copy failed: %w", err)
-	}
-
-	if err := newFile.Close(); err != nil {
-		return fmt.Errorf("failed to close destination: %w", err)
-	}
-
-	return os.Remove(oldPath)
-}
-
-func createTmpDir() (string, error) {
-	tmpDir, err := os.MkdirTemp("", "")
-	if err != nil {
-		return "", fmt.Errorf("Failed to create temp directory: %w", err)
-	}
-
-	return tmpDir, nil
+	fmt.Printf("%s is not listed in %s\n", addr, strings.Join(paths, ", "))
+	return nil
 }
 
-func main() {
-	cfg, err := loadConfig()
-	if err != nil {
-		log.Fatal(err)
-	}
-	tmpDir, err := createTmpDir()
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer os.RemoveAll(tmpDir)
-	if err = downloadGeolite2(tmpDir, cfg); err != nil {
-		log.Fatal(err)
-	}
-	geonameIDsSet, err := getGeonameIDs(tmpDir, cfg)
-	if err != nil {
-		log.Fatal(err)
-	}
-	if err = getAndWriteBlocks(tmpDir, geonameIDsSet, cfg); err != nil {
-		log.Fatal(err)
-	}
-	if err = moveFile(tmpDir, cfg); err != nil {
-		log.Fatal(err)
+// printReport writes the counts of -report as a table.
+func printReport(counts []blgen.CountryCount) {
+	table := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "CODE\tNETWORKS\tADDRESSES\tNAME")
+	for _, count := range counts {
+		label := count.Label
+		if label == "" {
+			label = "-"
+		}
+		fmt.Fprintf(table, "%s\t%d\t%d\t%s\n", label, count.Networks, count.Addresses, count.Name)
 	}
-	fmt.Println("Processing complete and file generated successfully.")
+	table.Flush()
 }
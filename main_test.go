@@ -0,0 +1,430 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
+)
+
+// TestMain runs main instead of the tests when the test binary is started
+// by runMain.
+func TestMain(m *testing.M) {
+	if args, ok := os.LookupEnv("BLGEN_TEST_MAIN_ARGS"); ok {
+		os.Args = append([]string{"blgen"}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs blgen with args in a separate process and returns what it
+// printed and its exit code.
+func runMain(t *testing.T, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "BLGEN_TEST_MAIN_ARGS="+strings.Join(args, "\n"))
+	var out, errOut bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &errOut
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		code = exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return out.String(), errOut.String(), code
+}
+
+// captureStdout returns what f prints to stdout.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- data
+	}()
+	f()
+	w.Close()
+	return string(<-output)
+}
+
+// writeFiles writes files by name into a temporary directory and returns
+// their paths in the order given.
+func writeFiles(t *testing.T, files ...[2]string) []string {
+	t.Helper()
+	dir := t.TempDir()
+	var paths []string
+	for _, file := range files {
+		path := filepath.Join(dir, file[0])
+		if err := os.WriteFile(path, []byte(file[1]), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// writeArchive writes a country edition archive listing two networks of RU
+// and one of DE, and returns its path.
+func writeArchive(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "GeoLite2-Country-CSV.zip")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for _, entry := range [][2]string{
+		{"GeoLite2-Country-Locations-en.csv", `geoname_id,locale_code,continent_code,continent_name,country_iso_code,country_name,is_in_european_union
+2017370,en,EU,Europe,RU,Russia,0
+2921044,en,EU,Europe,DE,Germany,1
+`},
+		{"GeoLite2-Country-Blocks-IPv4.csv", `network,geoname_id,registered_country_geoname_id,represented_country_geoname_id,is_anonymous_proxy,is_satellite_provider,is_anycast
+2.56.8.0/24,2017370,2017370,,0,0,
+2.56.9.0/24,2017370,2017370,,0,0,
+5.1.0.0/16,2921044,2921044,,0,0,
+`},
+	} {
+		w, err := archive.Create("GeoLite2-Country-CSV_20260101/" + entry[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.WriteString(w, entry[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVersion(t *testing.T) {
+	// -version takes precedence over a missing config file and credentials.
+	stdout, stderr, code := runMain(t, "-version", "-c", filepath.Join(t.TempDir(), "missing.yml"), "-bc", "RU")
+	if code != 0 || stdout != "blgen dev (commit unknown, built unknown)\n" || stderr != "" {
+		t.Errorf("got %q and %q with exit code %d", stdout, stderr, code)
+	}
+
+	info := versionInfo{Version: "v1.4.0", Commit: "3f2a9c1", BuildDate: "2026-01-01T00:00:00Z"}
+	if got, want := info.String(), "blgen v1.4.0 (commit 3f2a9c1, built 2026-01-01T00:00:00Z)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestConfigFileFormats(t *testing.T) {
+	paths := writeFiles(t,
+		[2]string{"config.yml", `account_id: "1234"
+license_key: key
+blocked_countries: [ru, DE]
+blocked_continents: [AS]
+output_filepath: /srv/lists
+mode: allow
+no_header: true
+proxy: http://proxy.example:3128
+`},
+		[2]string{"config.json", `{
+  "account_id": "1234",
+  "license_key": "key",
+  "blocked_countries": ["ru", "DE"],
+  "blocked_continents": ["AS"],
+  "output_filepath": "/srv/lists",
+  "mode": "allow",
+  "no_header": true,
+  "proxy": "http://proxy.example:3128"
+}
+`},
+		[2]string{"config.toml", `account_id = "1234"
+license_key = "key"
+blocked_countries = ["ru", "DE"]
+blocked_continents = ["AS"]
+output_filepath = "/srv/lists"
+mode = "allow"
+no_header = true
+proxy = "http://proxy.example:3128"
+`},
+	)
+	want, err := loadConfigFile(paths[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, found := want.BlockedCountries["RU"]; !found || len(want.BlockedCountries) != 2 || !want.NoHeader {
+		t.Fatalf("%s read as %+v", paths[0], want)
+	}
+	for _, path := range paths[1:] {
+		cfg, err := loadConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(cfg, want) {
+			t.Errorf("%s read as %+v, want %+v as from YAML", path, cfg, want)
+		}
+	}
+}
+
+func TestCredentialsFromEnvironment(t *testing.T) {
+	t.Setenv(envAccountID, "1234")
+	t.Setenv(envLicenseKey, "key")
+	var mu sync.Mutex
+	var credentials []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accountID, licenseKey, _ := r.BasicAuth()
+		mu.Lock()
+		credentials = append(credentials, accountID+":"+licenseKey)
+		mu.Unlock()
+		http.Error(w, "Invalid license key", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	cfg, err := loadConfig(commandGenerate, []string{"-bc", "RU", "-outpath", t.TempDir(), "-log-level", "error",
+		"-db-url", server.URL + "/db.zip", "-sha-url", server.URL + "/db.zip.sha256"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := blgen.Generate(t.Context(), *cfg); err == nil {
+		t.Fatal("rejected credentials accepted")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(credentials) == 0 || slices.ContainsFunc(credentials, func(c string) bool { return c != "1234:key" }) {
+		t.Errorf("requests sent with the credentials %q, want 1234:key", credentials)
+	}
+}
+
+func TestCredentialPrecedence(t *testing.T) {
+	t.Setenv(envAccountID, "from-env")
+	t.Setenv(envLicenseKey, "from-env")
+	paths := writeFiles(t, [2]string{"config.yml", "account_id: from-file\nlicense_key: from-file\nblocked_countries: [RU]\n"})
+	cfg, err := loadConfig(commandGenerate, []string{"-c", paths[0], "-id", "from-flag", "-outpath", t.TempDir(), "-log-level", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AccountID != "from-flag" || cfg.LicenseKey != "from-env" {
+		t.Errorf("got account ID %q and license key %q, want them from the flag and the environment", cfg.AccountID, cfg.LicenseKey)
+	}
+}
+
+func TestLoadConfigWithoutCodes(t *testing.T) {
+	t.Setenv(envAccountID, "1234")
+	t.Setenv(envLicenseKey, "key")
+	tests := []struct {
+		args  []string
+		valid bool
+	}{
+		{nil, false},
+		{[]string{"-allow-empty"}, true},
+		{[]string{"-allow"}, true},
+		{[]string{"-bc", "RU"}, true},
+		{[]string{"-bn", "EU"}, true},
+	}
+	for _, test := range tests {
+		args := append([]string{"-outpath", t.TempDir(), "-log-level", "error"}, test.args...)
+		_, err := loadConfig(commandGenerate, args)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: %v", test.args, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), "-allow-empty") {
+			t.Errorf("%q: error %q doesn't name -allow-empty", test.args, err)
+		}
+	}
+}
+
+func TestJSONErrorLog(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing.zip")
+	stdout, stderr, code := runMain(t, "-zip", missing, "-bc", "RU", "-outpath", t.TempDir(), "-log-format", "json")
+	if code != 1 || stdout != "" {
+		t.Fatalf("exit code %d with %q on stdout", code, stdout)
+	}
+	var record struct {
+		Level string
+		Stage string
+		Path  string
+	}
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	if err := json.Unmarshal([]byte(lines[len(lines)-1]), &record); err != nil {
+		t.Fatalf("%q: %v", stderr, err)
+	}
+	if record.Level != "ERROR" || record.Stage != "download" || record.Path != missing {
+		t.Errorf("error logged as %+v, want the download stage of %s", record, missing)
+	}
+}
+
+func TestMergeConfigFiles(t *testing.T) {
+	paths := writeFiles(t,
+		[2]string{"base.yml", "account_id: \"1234\"\nlicense_key: key\noutput_filepath: /var/lib/blgen\nblocked_countries: [RU, CN]\nmode: block\n"},
+		[2]string{"site.yml", "output_filepath: /srv/lists\nblocked_countries: [DE]\n"},
+	)
+	tests := []struct {
+		strategy string
+		want     []string
+	}{
+		{mergeReplace, []string{"DE"}},
+		{mergeUnion, []string{"CN", "DE", "RU"}},
+	}
+	for _, test := range tests {
+		cfg, err := loadConfigFiles(configFiles{paths: paths, mergeCountries: test.strategy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.OutputFilePath != "/srv/lists" || cfg.AccountID != "1234" || cfg.LicenseKey != "key" || cfg.Mode != "block" {
+			t.Errorf("%s: got %+v", test.strategy, cfg)
+		}
+		if got := slices.Sorted(maps.Keys(cfg.BlockedCountries)); !slices.Equal(got, test.want) {
+			t.Errorf("%s: blocked countries %q, want %q", test.strategy, got, test.want)
+		}
+	}
+	if _, err := loadConfigFiles(configFiles{paths: paths, mergeCountries: "intersect"}); err == nil {
+		t.Error("unknown strategy accepted")
+	}
+
+	// A flag wins over every file.
+	outputPath := t.TempDir()
+	cfg, err := loadConfig(commandGenerate, []string{"-c", paths[0], "-c", paths[1], "-outpath", outputPath, "-log-level", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.OutputFilePath != outputPath {
+		t.Errorf("output path %s, want %s from the flag", cfg.OutputFilePath, outputPath)
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	archive := writeArchive(t)
+	// Without -quiet the success is logged, to stderr.
+	stdout, stderr, code := runMain(t, "-zip", archive, "-bc", "RU", "-outpath", t.TempDir())
+	if code != 0 || stdout != "" || !strings.Contains(stderr, "processing complete") {
+		t.Errorf("exit code %d with %q on stdout and %q on stderr", code, stdout, stderr)
+	}
+	stdout, stderr, code = runMain(t, "-quiet", "-zip", archive, "-bc", "RU", "-outpath", t.TempDir())
+	if code != 0 || stdout != "" || stderr != "" {
+		t.Errorf("quiet run: exit code %d with %q on stdout and %q on stderr", code, stdout, stderr)
+	}
+	// Errors are still logged.
+	_, stderr, code = runMain(t, "-quiet", "-zip", archive+".missing", "-bc", "RU", "-outpath", t.TempDir())
+	if code != 1 || !strings.Contains(stderr, "level=ERROR") {
+		t.Errorf("quiet failure: exit code %d with %q on stderr", code, stderr)
+	}
+}
+
+func TestCodesFile(t *testing.T) {
+	paths := writeFiles(t, [2]string{"countries.txt", `# Blocked by every tool
+ru
+  De  # Germany
+
+# Added in 2026
+cN
+`})
+	cfg, err := loadConfig(commandGenerate, []string{"-zip", writeArchive(t), "-bc", "ir", "-bc-file", paths[0], "-log-level", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"CN", "DE", "IR", "RU"}
+	if got := slices.Sorted(maps.Keys(cfg.BlockedCountries)); !slices.Equal(got, want) {
+		t.Errorf("blocked countries %q, want %q", got, want)
+	}
+	if _, stderr, code := runMain(t, "-zip", writeArchive(t), "-bc-file", paths[0]+".missing"); code == 0 || !strings.Contains(stderr, "countries.txt.missing") {
+		t.Errorf("missing codes file: exit code %d with %q on stderr", code, stderr)
+	}
+}
+
+// A credential file given on the command line wins over the credential in
+// the config file.
+func TestCredentialFileFlag(t *testing.T) {
+	paths := writeFiles(t,
+		[2]string{"config.yml", "account_id: \"1234\"\nlicense_key: from-config\nblocked_countries: [RU]\n"},
+		[2]string{"license_key", "from-key-file\n"},
+	)
+	cfg, err := loadConfig(commandGenerate, []string{"-c", paths[0], "-key-file", paths[1], "-outpath", t.TempDir(), "-log-level", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.AccountID != "1234" || cfg.LicenseKey != "from-key-file" {
+		t.Errorf("got account ID %q and license key %q, want the key from -key-file", cfg.AccountID, cfg.LicenseKey)
+	}
+}
+
+func TestEmptyOutputExitCode(t *testing.T) {
+	archive := writeArchive(t)
+	tests := []struct {
+		args []string
+		code int
+	}{
+		{[]string{"-bc", "CN"}, exitEmpty},
+		{[]string{"-bc", "CN", "-allow-empty-output"}, 0},
+		{[]string{"-bc", "RU"}, 0},
+	}
+	for _, test := range tests {
+		outputPath := t.TempDir()
+		_, stderr, code := runMain(t, append([]string{"-zip", archive, "-outpath", outputPath}, test.args...)...)
+		if code != test.code {
+			t.Errorf("%q: exit code %d, want %d: %s", test.args, code, test.code, stderr)
+		}
+		if code == exitEmpty && !strings.Contains(stderr, "level=WARN") {
+			t.Errorf("%q: no warning logged: %s", test.args, stderr)
+		}
+		// The list is written either way, an empty one holding the header.
+		data, err := os.ReadFile(filepath.Join(outputPath, blgen.DefaultOutputFilename))
+		if err != nil || !strings.HasPrefix(string(data), "# list generated") {
+			t.Errorf("%q: list holds %q: %v", test.args, data, err)
+		}
+	}
+}
+
+func TestDefaultUserAgent(t *testing.T) {
+	cfg, _, _ := parseCLIOptions(commandGenerate, nil)
+	if want := blgen.DefaultUserAgent + "/" + version; cfg.UserAgent != want {
+		t.Errorf("User-Agent %q, want %q", cfg.UserAgent, want)
+	}
+}
+
+func TestVerifyIPChecksEveryChunk(t *testing.T) {
+	paths := writeFiles(t,
+		[2]string{"list.txt.1", "# list generated\n2.56.8.0/24 ; RU\n"},
+		[2]string{"list.txt.2", "# list generated\n2.56.9.0/24 ; RU\n"},
+	)
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"2.56.8.1", "2.56.8.1 is listed in " + paths[0] + " as 2.56.8.0/24 ; RU\n"},
+		{"2.56.9.4", "2.56.9.4 is listed in " + paths[1] + " as 2.56.9.0/24 ; RU\n"},
+		{"8.8.8.8", "8.8.8.8 is not listed in " + paths[0] + ", " + paths[1] + "\n"},
+	}
+	for _, test := range tests {
+		got := captureStdout(t, func() {
+			if err := verifyIP(paths, netip.MustParseAddr(test.addr)); err != nil {
+				t.Error(err)
+			}
+		})
+		if got != test.want {
+			t.Errorf("got %q, want %q", got, test.want)
+		}
+	}
+}
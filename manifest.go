@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
+)
+
+// manifest is the JSON written to -manifest after a successful run.
+type manifest struct {
+	Generated time.Time `json:"generated"`
+	// DatabaseDate is the build date of the database as YYYY-MM-DD, left
+	// out when the archive doesn't name it.
+	DatabaseDate string         `json:"database_date,omitempty"`
+	Version      string         `json:"version"`
+	Paths        []string       `json:"paths"`
+	Networks     int            `json:"networks"`
+	Countries    map[string]int `json:"countries"`
+}
+
+func writeManifest(path string, result *blgen.Result) error {
+	m := manifest{
+		Generated: time.Now().UTC(),
+		Version:   currentVersion().Version,
+		Paths:     result.OutputPaths,
+		Networks:  result.NetworksWritten,
+		Countries: result.NetworksByLabel,
+	}
+	if !result.DatabaseDate.IsZero() {
+		m.DatabaseDate = result.DatabaseDate.Format(time.DateOnly)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write manifest %s: %w", path, err)
+	}
+	return nil
+}
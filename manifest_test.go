@@ -0,0 +1,41 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestManifest(t *testing.T) {
+	outputPath := t.TempDir()
+	manifestPath := filepath.Join(t.TempDir(), "manifest.json")
+	_, stderr, code := runMain(t, "-zip", writeArchive(t), "-bc", "RU", "-bc", "DE", "-outpath", outputPath, "-manifest", manifestPath)
+	if code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m manifest
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&m); err != nil {
+		t.Fatalf("%s: %v", data, err)
+	}
+	if time.Since(m.Generated) > time.Minute || m.DatabaseDate != "2026-01-01" || m.Version != "dev" {
+		t.Errorf("got %+v", m)
+	}
+	if want := []string{filepath.Join(outputPath, "BlockedCountriesBlocks.txt")}; !slices.Equal(m.Paths, want) {
+		t.Errorf("paths %q, want %q", m.Paths, want)
+	}
+	if want := map[string]int{"RU": 2, "DE": 1}; m.Networks != 3 || !maps.Equal(m.Countries, want) {
+		t.Errorf("%d networks by country %v, want 3 by %v", m.Networks, m.Countries, want)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
+)
+
+// lastSuccessMetric is carried over from the previous metrics file when a
+// run fails, so it keeps telling how long ago the list was last updated.
+const lastSuccessMetric = "geolite_last_success_timestamp"
+
+// writeMetrics writes -metrics-file in the Prometheus text format, for
+// node_exporter's textfile collector. result is nil when the run failed.
+func writeMetrics(path string, result *blgen.Result) error {
+	var b bytes.Buffer
+	metric := func(name, help, typ string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	success := 0
+	if result != nil {
+		success = 1
+	}
+	metric("geolite_last_run_success", "Whether the last run generated the list.", "gauge")
+	fmt.Fprintf(&b, "geolite_last_run_success %d\n", success)
+
+	lastSuccess := previousLastSuccess(path)
+	if result != nil {
+		lastSuccess = fmt.Sprintf("%d", time.Now().Unix())
+	}
+	if lastSuccess != "" {
+		metric(lastSuccessMetric, "Unix time of the last run that generated the list.", "gauge")
+		fmt.Fprintf(&b, "%s %s\n", lastSuccessMetric, lastSuccess)
+	}
+
+	if result != nil {
+		metric("geolite_generation_seconds", "Time the last run took.", "gauge")
+		fmt.Fprintf(&b, "geolite_generation_seconds %.3f\n", result.Elapsed.Seconds())
+		if !result.DatabaseDate.IsZero() {
+			metric("geolite_database_timestamp", "Unix time of the build date of the database.", "gauge")
+			fmt.Fprintf(&b, "geolite_database_timestamp %d\n", result.DatabaseDate.Unix())
+		}
+		metric("geolite_malformed_rows", "Blocks file rows skipped because they couldn't be parsed.", "gauge")
+		fmt.Fprintf(&b, "geolite_malformed_rows %d\n", result.MalformedRows)
+		metric("geolite_bytes_written", "Size of the generated list.", "gauge")
+		fmt.Fprintf(&b, "geolite_bytes_written %d\n", result.BytesWritten)
+		metric("geolite_networks_total", "Networks in the generated list by label, such as the country code.", "gauge")
+		for _, label := range slices.Sorted(maps.Keys(result.NetworksByLabel)) {
+			fmt.Fprintf(&b, "geolite_networks_total{country=\"%s\"} %d\n", escapeLabelValue(label), result.NetworksByLabel[label])
+		}
+	}
+
+	// The collector may read the file at any time, so it is replaced in one
+	// rename rather than rewritten in place.
+	tmpFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics %s: %w", path, err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(b.Bytes()); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write metrics %s: %w", path, err)
+	}
+	if err := tmpFile.Chmod(0o644); err != nil {
+		tmpFile.Close()
+		return fmt.Errorf("failed to write metrics %s: %w", path, err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics %s: %w", path, err)
+	}
+	if err := os.Rename(tmpFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to write metrics %s: %w", path, err)
+	}
+	return nil
+}
+
+// previousLastSuccess returns the last success time of the metrics file at
+// path, or "" when there is none.
+func previousLastSuccess(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, found := strings.CutPrefix(scanner.Text(), lastSuccessMetric+" "); found {
+			return strings.TrimSpace(value)
+		}
+	}
+	return ""
+}
+
+// escapeLabelValue escapes a label value as the text format requires.
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chrismika/maxmind-geolite2-textfile-go/blgen"
+)
+
+// sampleLine is a sample of the Prometheus text format: the metric name, its
+// labels if any and the value.
+var sampleLine = regexp.MustCompile(`^([a-zA-Z_:][a-zA-Z0-9_:]*)(\{(?:[a-zA-Z_][a-zA-Z0-9_]*="(?:[^"\\]|\\.)*",?)*\})? (\S+)$`)
+
+// parseMetrics parses a metrics file in the Prometheus text format, checking
+// that every metric is declared with HELP and TYPE before its samples, and
+// returns the values by series, such as geolite_networks_total{country="RU"}.
+func parseMetrics(t *testing.T, path string) map[string]float64 {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	series := map[string]float64{}
+	declared := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == "#" {
+			declared[fields[2]] += fields[1]
+			continue
+		}
+		match := sampleLine.FindStringSubmatch(line)
+		if match == nil {
+			t.Errorf("malformed sample %q", line)
+			continue
+		}
+		if declared[match[1]] != "HELPTYPE" {
+			t.Errorf("sample of %s before its HELP and TYPE", match[1])
+		}
+		value, err := strconv.ParseFloat(match[3], 64)
+		if err != nil {
+			t.Errorf("sample %q: %v", line, err)
+		}
+		series[match[1]+match[2]] = value
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return series
+}
+
+func TestMetricsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blgen.prom")
+	before := time.Now().Unix()
+	result := &blgen.Result{
+		NetworksByLabel: map[string]int{"RU": 4, "DE": 1, `EU"*`: 2},
+		MalformedRows:   3,
+		BytesWritten:    120,
+		DatabaseDate:    time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+		Elapsed:         1500 * time.Millisecond,
+	}
+	if err := writeMetrics(path, result); err != nil {
+		t.Fatal(err)
+	}
+	series := parseMetrics(t, path)
+	want := map[string]float64{
+		"geolite_last_run_success":                1,
+		"geolite_generation_seconds":              1.5,
+		"geolite_database_timestamp":              float64(result.DatabaseDate.Unix()),
+		"geolite_malformed_rows":                  3,
+		"geolite_bytes_written":                   120,
+		`geolite_networks_total{country="RU"}`:    4,
+		`geolite_networks_total{country="DE"}`:    1,
+		`geolite_networks_total{country="EU\"*"}`: 2,
+	}
+	for name, value := range want {
+		if got, found := series[name]; !found || got != value {
+			t.Errorf("%s = %v, want %v", name, got, value)
+		}
+	}
+	lastSuccess := series[lastSuccessMetric]
+	if lastSuccess < float64(before) || lastSuccess > float64(time.Now().Unix()) {
+		t.Errorf("%s = %v, want the time of the run", lastSuccessMetric, lastSuccess)
+	}
+
+	// A failed run keeps the time of the last success.
+	if err := writeMetrics(path, nil); err != nil {
+		t.Fatal(err)
+	}
+	series = parseMetrics(t, path)
+	if series["geolite_last_run_success"] != 0 || series[lastSuccessMetric] != lastSuccess {
+		t.Errorf("after a failure got %v, want the success of the run before", series)
+	}
+	if _, found := series["geolite_generation_seconds"]; found {
+		t.Errorf("failed run reported its generation time")
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("%d files next to the metrics, want none", len(entries)-1)
+	}
+}
+
+func TestMetricsFileFlag(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blgen.prom")
+	if _, stderr, code := runMain(t, "-zip", writeArchive(t), "-bc", "RU", "-outpath", t.TempDir(), "-metrics-file", path); code != 0 {
+		t.Fatalf("exit code %d: %s", code, stderr)
+	}
+	series := parseMetrics(t, path)
+	if series["geolite_last_run_success"] != 1 || series[`geolite_networks_total{country="RU"}`] != 2 {
+		t.Errorf("got %v, want a success listing two networks of RU", series)
+	}
+}
@@ -0,0 +1,29 @@
+package main
+
+import "fmt"
+
+// Build metadata, set at build time through
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildDate = "unknown"
+)
+
+type versionInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+}
+
+func currentVersion() versionInfo {
+	return versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+	}
+}
+
+func (v versionInfo) String() string {
+	return fmt.Sprintf("blgen %s (commit %s, built %s)", v.Version, v.Commit, v.BuildDate)
+}